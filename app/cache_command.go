@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+const cacheUsage = `Usage: cache [-admin address] [-token token] [-view name] <command>
+
+Commands:
+  list [pattern]          list cached answers for a name, a wildcard such as *.example.com, or *
+  flush [-subtree] [name] remove the answers for a name, or with -subtree for the names below it too,
+                          or every answer without a name
+  seed <record>...        cache records given as master file lines with absolute names
+`
+
+// runCacheCommand inspects and manages the cache of a running server
+// through its admin API.
+func runCacheCommand(args []string) error {
+	flags := flag.NewFlagSet("cache", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(flags.Output(), cacheUsage) }
+	admin := flags.String("admin", "127.0.0.1:8053", "Address of the server's admin API")
+	token := flags.String("token", os.Getenv("DNS_ADMIN_TOKEN"), "Token of the admin API, defaults to $DNS_ADMIN_TOKEN")
+	view := flags.String("view", "", "View whose cache to use, the default view when empty")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	endpoint := url.URL{Scheme: "http", Host: *admin, Path: "/cache"}
+	parameters := url.Values{}
+	if *view != "" {
+		parameters.Set("view", *view)
+	}
+
+	switch command, rest := flags.Arg(0), flags.Args()[1:]; command {
+	case "list":
+		if len(rest) > 0 {
+			parameters.Set("name", rest[0])
+		}
+		endpoint.RawQuery = parameters.Encode()
+		var entries []struct {
+			Name    string   `json:"name"`
+			Type    string   `json:"type"`
+			Class   string   `json:"class"`
+			Rcode   string   `json:"rcode"`
+			TTL     uint32   `json:"ttl"`
+			Stale   bool     `json:"stale"`
+			Hits    int      `json:"hits"`
+			Records []string `json:"records"`
+		}
+		if err := adminRequest(http.MethodGet, endpoint, *token, nil, &entries); err != nil {
+			return err
+		}
+		table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(table, "NAME\tTYPE\tCLASS\tRCODE\tTTL\tHITS\tRECORDS")
+		for _, entry := range entries {
+			ttl := fmt.Sprint(entry.TTL)
+			if entry.Stale {
+				ttl = "stale"
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%d\t%d\n", entry.Name, entry.Type, entry.Class, entry.Rcode, ttl, entry.Hits, len(entry.Records))
+		}
+		return table.Flush()
+
+	case "flush":
+		flushFlags := flag.NewFlagSet("flush", flag.ExitOnError)
+		subtree := flushFlags.Bool("subtree", false, "Also flush the names below the name")
+		flushFlags.Parse(rest)
+		if flushFlags.NArg() > 0 {
+			parameters.Set("name", flushFlags.Arg(0))
+			if *subtree {
+				parameters.Set("subtree", "true")
+			}
+		}
+		endpoint.RawQuery = parameters.Encode()
+		var result struct {
+			Flushed int `json:"flushed"`
+		}
+		if err := adminRequest(http.MethodDelete, endpoint, *token, nil, &result); err != nil {
+			return err
+		}
+		fmt.Printf("Flushed %d answers\n", result.Flushed)
+		return nil
+
+	case "seed":
+		if len(rest) == 0 {
+			return fmt.Errorf("[Cache Error] no records to seed")
+		}
+		endpoint.RawQuery = parameters.Encode()
+		body, err := json.Marshal(map[string][]string{"records": rest})
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Seeded int `json:"seeded"`
+		}
+		if err := adminRequest(http.MethodPost, endpoint, *token, body, &result); err != nil {
+			return err
+		}
+		fmt.Printf("Seeded %d answers\n", result.Seeded)
+		return nil
+
+	default:
+		flags.Usage()
+		os.Exit(2)
+		return nil
+	}
+}
+
+// adminRequest sends a request to the admin API, with the token when
+// there is one, and decodes its JSON response into result.
+func adminRequest(method string, endpoint url.URL, token string, body []byte, result any) error {
+	request, err := http.NewRequest(method, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("[Admin Error] %w", err)
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("[Admin Error] %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("[Admin Error] %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return fmt.Errorf("[Admin Error] %w", err)
+	}
+	return nil
+}
@@ -2,15 +2,66 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
 )
 
-
-
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		if err := runCacheCommand(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	resolver := flag.String("resolver", "", "The DNS resolver to forward queries to")
+	configPath := flag.String("config", "", "Path to a JSON configuration file")
+	admin := flag.String("admin", "", "Address to serve the admin API on")
 	flag.Parse()
 
-	mydns.StartDNSServer(*resolver)
-}
+	config := mydns.Config{}
+	if *configPath != "" {
+		var err error
+		config, err = mydns.LoadConfig(*configPath)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	if *resolver != "" {
+		config.Resolver = *resolver
+	}
+	if *admin != "" {
+		if config.Admin == nil {
+			config.Admin = &mydns.AdminConfig{}
+		}
+		config.Admin.Listen = *admin
+	}
 
+	if err := mydns.ConfigureLogging(config.Log); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	server, err := mydns.NewDNSServer(config)
+	if err != nil {
+		fmt.Println("[Failed to load configuration]")
+		fmt.Println(err)
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		server.Shutdown()
+		os.Exit(0)
+	}()
+
+	server.Serve()
+}
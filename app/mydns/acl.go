@@ -0,0 +1,156 @@
+package mydns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ACL lists the networks and TSIG keys allowed to perform an operation.
+// Entries are addresses, CIDR blocks, "key:<name>" to match requests
+// signed with that key, or the name of a group of entries: one defined
+// under "acls" in the configuration or one of the built-in groups "any",
+// "none", "localhost" and "localnets". An empty ACL allows nothing.
+type ACL struct {
+	networks []*net.IPNet
+	keys     []string
+}
+
+var builtinACLs = map[string]func() ([]*net.IPNet, error){
+	"any": func() ([]*net.IPNet, error) {
+		return []*net.IPNet{
+			{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+			{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+		}, nil
+	},
+	"none":      func() ([]*net.IPNet, error) { return nil, nil },
+	"localhost": localhostNetworks,
+	"localnets": localNetworks,
+}
+
+// localhostNetworks are the loopback networks and each address of the
+// host's own interfaces.
+func localhostNetworks() ([]*net.IPNet, error) {
+	networks := []*net.IPNet{
+		{IP: net.IPv4(127, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)},
+		{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)},
+	}
+	interfaces, err := localNetworks()
+	if err != nil {
+		return nil, err
+	}
+	for _, network := range interfaces {
+		bits := 8 * len(network.IP)
+		networks = append(networks, &net.IPNet{IP: network.IP, Mask: net.CIDRMask(bits, bits)})
+	}
+	return networks, nil
+}
+
+// localNetworks are the networks the host's interfaces are attached to.
+func localNetworks() ([]*net.IPNet, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("[ACL Error] %w", err)
+	}
+	var networks []*net.IPNet
+	for _, addr := range addrs {
+		if network, ok := addr.(*net.IPNet); ok {
+			ip := network.IP
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			networks = append(networks, &net.IPNet{IP: ip.Mask(network.Mask), Mask: network.Mask})
+		}
+	}
+	return networks, nil
+}
+
+// parseACL resolves a list of entries against the named groups.
+func parseACL(entries []string, groups map[string][]string) (ACL, error) {
+	var acl ACL
+	if err := acl.add(entries, groups, map[string]bool{}); err != nil {
+		return ACL{}, err
+	}
+	return acl, nil
+}
+
+// add appends entries to the ACL. expanding holds the groups being
+// resolved, to catch groups that include themselves.
+func (a *ACL) add(entries []string, groups map[string][]string, expanding map[string]bool) error {
+	for _, entry := range entries {
+		if keyName, isKey := strings.CutPrefix(entry, "key:"); isKey {
+			a.keys = append(a.keys, canonicalName(keyName))
+			continue
+		}
+		if members, isGroup := groups[entry]; isGroup {
+			if expanding[entry] {
+				return fmt.Errorf("[ACL Error] group %q includes itself", entry)
+			}
+			expanding[entry] = true
+			if err := a.add(members, groups, expanding); err != nil {
+				return err
+			}
+			delete(expanding, entry)
+			continue
+		}
+		if builtin, isBuiltin := builtinACLs[entry]; isBuiltin {
+			networks, err := builtin()
+			if err != nil {
+				return err
+			}
+			a.networks = append(a.networks, networks...)
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return fmt.Errorf("[ACL Error] %q is neither an address nor a group", entry)
+			}
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("[ACL Error] %w", err)
+		}
+		a.networks = append(a.networks, network)
+	}
+	return nil
+}
+
+// parseACLGroups checks the groups defined in the configuration, which
+// may not take the names of the built-in ones.
+func parseACLGroups(groups map[string][]string) error {
+	for name, entries := range groups {
+		if _, isBuiltin := builtinACLs[name]; isBuiltin {
+			return fmt.Errorf("[ACL Error] group %q is built in and cannot be redefined", name)
+		}
+		if _, err := parseACL(entries, groups); err != nil {
+			return fmt.Errorf("[ACL Error] group %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// allows reports whether a request from ip, signed with keyName (empty
+// for unsigned requests), matches the ACL.
+func (a ACL) allows(ip net.IP, keyName string) bool {
+	for _, network := range a.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	if keyName == "" {
+		return false
+	}
+	for _, key := range a.keys {
+		if key == keyName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,369 @@
+package mydns
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultAdminAddress = "127.0.0.1:8053"
+
+func (c AdminConfig) listenAddress() string {
+	if c.Listen == "" {
+		return defaultAdminAddress
+	}
+	return c.Listen
+}
+
+// loadAdminToken returns the token the admin API requires, refusing to
+// listen on an address other than loopback without one.
+func loadAdminToken(config AdminConfig) (string, error) {
+	token := config.Token
+	if config.TokenFile != "" {
+		data, err := os.ReadFile(config.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("[Admin Error] %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	host, _, err := net.SplitHostPort(config.listenAddress())
+	if err != nil {
+		return "", fmt.Errorf("[Admin Error] invalid listen address %q", config.Listen)
+	}
+	ip := net.ParseIP(host)
+	if token == "" && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("[Admin Error] the admin API needs a token to listen on %s", config.listenAddress())
+	}
+	return token, nil
+}
+
+// serveAdmin serves the admin HTTP API. Requests about a view name it with
+// the view parameter.
+func (s *DNSServer) serveAdmin() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", s.adminStatus)
+	mux.HandleFunc("GET /config", s.adminConfig)
+	mux.HandleFunc("GET /queries", s.adminQueries)
+	mux.HandleFunc("GET /metrics", s.adminMetrics)
+	mux.HandleFunc("POST /zones/reload", s.adminReloadZones)
+	mux.HandleFunc("GET /upstreams", s.adminUpstreams)
+	mux.HandleFunc("GET /blocklists", s.adminBlocklists)
+	mux.HandleFunc("PUT /blocklists/{name}", s.adminToggleBlocklist)
+	mux.HandleFunc("GET /cache", s.adminListCache)
+	mux.HandleFunc("DELETE /cache", s.adminFlushCache)
+	mux.HandleFunc("POST /cache", s.adminSeedCache)
+
+	address := s.config.Admin.listenAddress()
+	slog.Info("Admin API listening", "address", address)
+	if err := http.ListenAndServe(address, s.adminAuthorized(mux)); err != nil {
+		slog.Error("Failed to start the admin API", "err", err)
+	}
+}
+
+// adminAuthorized lets through the requests that carry the admin token as
+// a bearer token, when there is one.
+func (s *DNSServer) adminAuthorized(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken != "" {
+			token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !found || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type viewStatus struct {
+	Name       string   `json:"name"`
+	Zones      []string `json:"zones"`
+	Forwarders []string `json:"forwarders"`
+	Cached     int      `json:"cached"`
+}
+
+// adminStatus reports how long the server has been running and what each
+// view serves.
+func (s *DNSServer) adminStatus(w http.ResponseWriter, r *http.Request) {
+	status := struct {
+		Started    time.Time    `json:"started"`
+		Uptime     float64      `json:"uptime-seconds"`
+		Listen     []string     `json:"listen"`
+		GoVersion  string       `json:"go-version"`
+		Goroutines int          `json:"goroutines"`
+		Views      []viewStatus `json:"views"`
+		Queries    QueryStats   `json:"queries"`
+	}{
+		Started:    s.started,
+		Uptime:     time.Since(s.started).Seconds(),
+		Listen:     append([]string{s.config.listenAddress()}, s.config.AlsoListen...),
+		GoVersion:  runtime.Version(),
+		Goroutines: runtime.NumGoroutine(),
+		Queries:    s.QueryStats(),
+	}
+	for _, view := range s.views {
+		viewStatus := viewStatus{Name: view.Name, Zones: view.zones.origins(), Forwarders: view.forwarders}
+		if view.cache != nil {
+			viewStatus.Cached = view.cache.len()
+		}
+		status.Views = append(status.Views, viewStatus)
+	}
+	writeJSON(w, status)
+}
+
+// adminConfig returns the configuration the server runs with, without
+// its secrets.
+func (s *DNSServer) adminConfig(w http.ResponseWriter, r *http.Request) {
+	config := s.config
+	config.Keys = slices.Clone(config.Keys)
+	for i := range config.Keys {
+		config.Keys[i].Secret = redacted
+	}
+	if config.Cookies.Secret != "" {
+		config.Cookies.Secret = redacted
+	}
+	if config.Cookies.PreviousSecret != "" {
+		config.Cookies.PreviousSecret = redacted
+	}
+	if config.Admin != nil && config.Admin.Token != "" {
+		admin := *config.Admin
+		admin.Token = redacted
+		config.Admin = &admin
+	}
+	writeJSON(w, config)
+}
+
+const redacted = "<redacted>"
+
+func (s *DNSServer) adminQueries(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.QueryStats())
+}
+
+func (s *DNSServer) adminMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.writeMetrics(w)
+}
+
+// adminReloadZones reads the zone named by the zone parameter from its
+// file again, or every zone without one, in the view named by the view
+// parameter or in every view.
+func (s *DNSServer) adminReloadZones(w http.ResponseWriter, r *http.Request) {
+	origin, viewName := r.URL.Query().Get("zone"), r.URL.Query().Get("view")
+	reloaded := []string{}
+	for _, view := range s.views {
+		if viewName != "" && view.Name != viewName {
+			continue
+		}
+		origins, err := view.zones.reload(origin)
+		for _, origin := range origins {
+			reloaded = append(reloaded, fmt.Sprintf("%s in view %s", fqdn(origin), view.Name))
+		}
+		if err != nil {
+			slog.Error("Failed to reload zones", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(reloaded) == 0 {
+		http.Error(w, "no zone to reload", http.StatusNotFound)
+		return
+	}
+	slog.Info("Reloaded zones", "zones", strings.Join(reloaded, ", "))
+	writeJSON(w, map[string][]string{"reloaded": reloaded})
+}
+
+type upstreamReport struct {
+	upstreamStatus
+	Resolver string   `json:"resolver"`
+	Views    []string `json:"views"`
+	Healthy  bool     `json:"healthy"`
+	ProbeRTT float64  `json:"probe-rtt-ms,omitempty"`
+	Probe    string   `json:"probe-error,omitempty"`
+}
+
+// adminUpstreams probes every resolver the views forward to, and reports
+// that along with how their forwarded queries have fared.
+func (s *DNSServer) adminUpstreams(w http.ResponseWriter, r *http.Request) {
+	var reports []*upstreamReport
+	byResolver := make(map[string]*upstreamReport)
+	for _, view := range s.views {
+		for _, resolver := range view.forwarders {
+			if byResolver[resolver] == nil {
+				byResolver[resolver] = &upstreamReport{Resolver: resolver, upstreamStatus: s.upstreams.status(resolver)}
+				reports = append(reports, byResolver[resolver])
+			}
+			byResolver[resolver].Views = append(byResolver[resolver].Views, view.Name)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, report := range reports {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			if err := testResolver(report.Resolver); err != nil {
+				report.Probe = err.Error()
+				return
+			}
+			report.Healthy = true
+			report.ProbeRTT = float64(time.Since(start).Microseconds()) / 1000
+		}()
+	}
+	wg.Wait()
+	if reports == nil {
+		reports = []*upstreamReport{}
+	}
+	writeJSON(w, reports)
+}
+
+type blocklistStatus struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	Enabled bool   `json:"enabled"`
+}
+
+// adminBlocklists lists the blocklist and the response policy zones, by
+// the names they are toggled with.
+func (s *DNSServer) adminBlocklists(w http.ResponseWriter, r *http.Request) {
+	statuses := []blocklistStatus{}
+	if s.blocklist != nil {
+		statuses = append(statuses, blocklistStatus{Name: "blocklist", Kind: "blocklist", Enabled: !s.blocklist.disabled.Load()})
+	}
+	for _, policy := range s.policies {
+		statuses = append(statuses, blocklistStatus{Name: fqdn(policy.origin), Kind: "rpz", Enabled: !policy.disabled.Load()})
+	}
+	writeJSON(w, statuses)
+}
+
+// adminToggleBlocklist turns the blocklist, or the response policy zone
+// with the name in the path, on or off as the request body says.
+func (s *DNSServer) adminToggleBlocklist(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Enabled == nil {
+		http.Error(w, `expected {"enabled": true} or {"enabled": false}`, http.StatusBadRequest)
+		return
+	}
+
+	name := r.PathValue("name")
+	status := blocklistStatus{Name: name, Enabled: *request.Enabled}
+	switch {
+	case name == "blocklist" && s.blocklist != nil:
+		s.blocklist.disabled.Store(!*request.Enabled)
+		status.Kind = "blocklist"
+	default:
+		index := slices.IndexFunc(s.policies, func(policy *PolicyZone) bool { return policy.origin == canonicalName(name) })
+		if index < 0 {
+			http.Error(w, fmt.Sprintf("no blocklist named %s", name), http.StatusNotFound)
+			return
+		}
+		s.policies[index].disabled.Store(!*request.Enabled)
+		status.Name, status.Kind = fqdn(s.policies[index].origin), "rpz"
+	}
+
+	slog.Info("Toggled a blocklist", "name", status.Name, "enabled", status.Enabled)
+	writeJSON(w, status)
+}
+
+// adminCache returns the cache of the view a request names, or writes the
+// error when there is none.
+func (s *DNSServer) adminCache(w http.ResponseWriter, r *http.Request) (*Cache, bool) {
+	name := r.URL.Query().Get("view")
+	if name == "" {
+		name = defaultViewName
+	}
+	for _, view := range s.views {
+		if view.Name != name {
+			continue
+		}
+		if view.cache == nil {
+			http.Error(w, fmt.Sprintf("view %s has no cache", name), http.StatusNotFound)
+			return nil, false
+		}
+		return view.cache, true
+	}
+	http.Error(w, fmt.Sprintf("no view named %s", name), http.StatusNotFound)
+	return nil, false
+}
+
+// adminListCache lists the cached answers for the names matching the name
+// parameter, which is a name, a wildcard such as *.example.com, or * for
+// all of them and the default.
+func (s *DNSServer) adminListCache(w http.ResponseWriter, r *http.Request) {
+	cache, ok := s.adminCache(w, r)
+	if !ok {
+		return
+	}
+	pattern := r.URL.Query().Get("name")
+	if pattern == "" {
+		pattern = "*"
+	}
+	entries := cache.list(pattern)
+	if entries == nil {
+		entries = []cacheEntryInfo{}
+	}
+	writeJSON(w, entries)
+}
+
+// adminFlushCache removes the cached answers for the name parameter, with
+// subtree=true also those for the names below it, and without a name
+// every cached answer.
+func (s *DNSServer) adminFlushCache(w http.ResponseWriter, r *http.Request) {
+	cache, ok := s.adminCache(w, r)
+	if !ok {
+		return
+	}
+	name := r.URL.Query().Get("name")
+	subtree := name == "" || r.URL.Query().Get("subtree") == "true"
+	flushed := cache.flush(name, subtree)
+	slog.Info("Flushed answers from the cache", "count", flushed, "name", name, "subtree", subtree)
+	writeJSON(w, map[string]int{"flushed": flushed})
+}
+
+// adminSeedCache caches the records in the request, given as master file
+// lines with absolute names.
+func (s *DNSServer) adminSeedCache(w http.ResponseWriter, r *http.Request) {
+	cache, ok := s.adminCache(w, r)
+	if !ok {
+		return
+	}
+	var request struct {
+		Records []string `json:"records"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var records []DNSAnswer
+	for _, line := range request.Records {
+		record, err := parseRecordText(line)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		records = append(records, record)
+	}
+	seeded := cache.seed(records)
+	slog.Info("Seeded answers into the cache", "count", seeded)
+	writeJSON(w, map[string]int{"seeded": seeded})
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
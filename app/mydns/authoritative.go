@@ -0,0 +1,199 @@
+package mydns
+
+import (
+	"log/slog"
+)
+
+// maxChainLength caps how many CNAME and DNAME redirections are followed
+// while answering one question.
+const maxChainLength = 8
+
+// answerFromZones answers a query from the zone that contains its name.
+// It reports false when the server is not authoritative for the question.
+func (v *View) answerFromZones(message DNSMessage) ([]byte, bool) {
+	if len(message.Questions) != 1 || message.Header.getOpcode() != OpcodeQuery {
+		return nil, false
+	}
+	question := message.Questions[0]
+	zone := v.zones.findZone(question.QNAME)
+	if zone == nil {
+		return nil, false
+	}
+
+	result := zone.resolve(question.QNAME, question.QTYPE)
+	answers := result.answers
+
+	// Follow CNAMEs and synthesized CNAMEs through the data we serve. The
+	// chain stops at a name outside our zones, which the client resolves
+	// itself, or at a loop or the length cap, returning what was found.
+	visited := map[string]bool{canonicalName(question.QNAME): true}
+	for steps := 0; result.target != ""; steps++ {
+		target := canonicalName(result.target)
+		if visited[target] || steps >= maxChainLength {
+			slog.Debug("Stopped following the alias chain", "qname", question.QNAME, "target", result.target)
+			result = zoneAnswer{rcode: RcodeNoError}
+			break
+		}
+		visited[target] = true
+
+		zone := v.zones.findZone(target)
+		if zone == nil {
+			result = zoneAnswer{rcode: RcodeNoError}
+			break
+		}
+		result = zone.resolve(result.target, question.QTYPE)
+		answers = append(answers, result.answers...)
+	}
+
+	// The last link decides whether the answer is authoritative, since a
+	// chain that ends in a referral is not.
+	response := DNSMessage{
+		Header:      buildResponseHeader(message.Header, !result.referral, result.rcode),
+		Questions:   message.Questions,
+		Answers:     answers,
+		Authorities: result.authorities,
+		Additionals: result.additionals,
+	}
+	return PackDNSMessage(response), true
+}
+
+// zoneAnswer is the outcome of looking a question up in a zone.
+type zoneAnswer struct {
+	rcode       uint16
+	answers     []DNSAnswer
+	authorities []DNSAnswer
+	additionals []DNSAnswer
+	referral    bool   // the name is below a zone cut, so the answer is not authoritative
+	target      string // the name a CNAME or DNAME in answers redirects to
+}
+
+// resolve looks up a name in the zone, referring the client to the child
+// zone for names below a delegation, redirecting names below a DNAME, and
+// synthesizing answers from wildcards (RFC 4592) when the name does not
+// exist.
+func (z *Zone) resolve(qname string, qtype uint16) zoneAnswer {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	switch owner, rrtype := z.findRedirection(qname, qtype); rrtype {
+	case TypeNS:
+		return z.referral(owner)
+	case TypeDNAME:
+		return z.substituteDNAME(owner, qname)
+	}
+
+	if z.nameInUse(qname) {
+		return z.answerAt(qname, qname, qtype)
+	}
+
+	// The closest encloser is the nearest existing ancestor; the apex
+	// always exists, so the walk ends within the zone. An empty
+	// non-terminal counts as existing, so a wildcard above one never
+	// matches names below it.
+	closestEncloser := parentName(canonicalName(qname))
+	for closestEncloser != "" && !z.nameInUse(closestEncloser) {
+		closestEncloser = parentName(closestEncloser)
+	}
+
+	wildcard := "*." + closestEncloser
+	if closestEncloser == "" {
+		wildcard = "*"
+	}
+	if len(z.records[wildcard]) > 0 {
+		return z.answerAt(wildcard, qname, qtype)
+	}
+	return zoneAnswer{rcode: RcodeNXDomain, authorities: z.negativeSOA()}
+}
+
+// answerAt answers from the records at owner, writing them under qname. The
+// two differ when the answer is synthesized from a wildcard. A CNAME at
+// owner answers any other type and redirects the query to its target, and
+// an ANY query is answered with a single RRset (RFC 8482).
+func (z *Zone) answerAt(owner string, qname string, qtype uint16) zoneAnswer {
+	var target string
+	answers := findRRSet(z.records, owner, qtype)
+	if qtype == TypeANY && len(answers) > 0 {
+		answers = findRRSet(z.records, owner, answers[0].ATYPE)
+	}
+	if len(answers) == 0 && qtype != TypeCNAME {
+		answers = findRRSet(z.records, owner, TypeCNAME)
+		if len(answers) > 0 {
+			target = rdataName(answers[0])
+		}
+	}
+	if len(answers) == 0 {
+		return zoneAnswer{rcode: RcodeNoError, authorities: z.negativeSOA()}
+	}
+	for i := range answers {
+		answers[i].ANAME = qname
+	}
+	return zoneAnswer{rcode: RcodeNoError, answers: answers, target: target}
+}
+
+// findRedirection walks down from the apex towards qname and returns the
+// first zone cut or DNAME above it, with the type of record found there.
+// The DS records of a child zone are held by the parent, so a DS query at
+// the cut itself is answered rather than referred.
+func (z *Zone) findRedirection(qname string, qtype uint16) (string, uint16) {
+	qname = canonicalName(qname)
+	var ancestors []string
+	for name := qname; name != z.Origin && name != ""; name = parentName(name) {
+		ancestors = append(ancestors, name)
+	}
+	ancestors = append(ancestors, z.Origin)
+
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		name := ancestors[i]
+		if name != z.Origin && !(name == qname && qtype == TypeDS) && len(findRRSet(z.records, name, TypeNS)) > 0 {
+			return name, TypeNS
+		}
+		if name != qname && len(findRRSet(z.records, name, TypeDNAME)) > 0 {
+			return name, TypeDNAME
+		}
+	}
+	return "", 0
+}
+
+// referral lists the delegation's NS records in the authority section and
+// the addresses of any name servers inside this zone as glue.
+func (z *Zone) referral(cut string) zoneAnswer {
+	nameservers := findRRSet(z.records, cut, TypeNS)
+
+	var glue []DNSAnswer
+	for _, nameserver := range nameservers {
+		target := rdataName(nameserver)
+		if !isSubdomain(target, z.Origin) {
+			continue
+		}
+		glue = append(glue, findRRSet(z.records, target, TypeA)...)
+		glue = append(glue, findRRSet(z.records, target, TypeAAAA)...)
+	}
+	return zoneAnswer{rcode: RcodeNoError, authorities: nameservers, additionals: glue, referral: true}
+}
+
+// substituteDNAME answers a name below a DNAME with the DNAME itself and a
+// CNAME synthesized by replacing the DNAME's owner with its target
+// (RFC 6672 section 3.3).
+func (z *Zone) substituteDNAME(owner string, qname string) zoneAnswer {
+	dname := findRRSet(z.records, owner, TypeDNAME)[0]
+	prefix := qname
+	if owner != "" {
+		prefix = qname[:len(qname)-len(owner)-1]
+	}
+	target := prefix + "." + rdataName(dname)
+	if rdataName(dname) == "" {
+		target = prefix
+	}
+	if len(encodeName(target)) > 255 {
+		return zoneAnswer{rcode: RcodeYXDomain, answers: []DNSAnswer{dname}}
+	}
+
+	cname := DNSAnswer{
+		ANAME:  qname,
+		ATYPE:  TypeCNAME,
+		ACLASS: dname.ACLASS,
+		TTL:    dname.TTL,
+		RDATA:  encodeName(target),
+	}
+	return zoneAnswer{rcode: RcodeNoError, answers: []DNSAnswer{dname, cname}, target: target}
+}
@@ -0,0 +1,315 @@
+package mydns
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	blockedTTL                    = 60
+	defaultBlocklistRefreshPeriod = time.Hour
+)
+
+// ruleSet matches names against the rules read from the list files.
+type ruleSet struct {
+	exact     map[string]bool // the name only
+	subtree   map[string]bool // the name and every name below it
+	wildcards []string        // glob patterns such as *.ads.example.com
+	regexes   []*regexp.Regexp
+}
+
+func newRuleSet() *ruleSet {
+	return &ruleSet{exact: make(map[string]bool), subtree: make(map[string]bool)}
+}
+
+func (r *ruleSet) matches(name string) bool {
+	name = canonicalName(name)
+	if r.exact[name] {
+		return true
+	}
+	for ancestor := name; ancestor != ""; ancestor = parentName(ancestor) {
+		if r.subtree[ancestor] {
+			return true
+		}
+	}
+	for _, pattern := range r.wildcards {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	for _, regex := range r.regexes {
+		if regex.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ruleSet) size() int {
+	return len(r.exact) + len(r.subtree) + len(r.wildcards) + len(r.regexes)
+}
+
+// addRule adds one line of a list file to the block or allow rules:
+//
+//	0.0.0.0 ads.example.com     hosts format, blocks the name only
+//	ads.example.com             domain list, blocks the name only
+//	||ads.example.com^          adblock, blocks the name and its subdomains
+//	@@||cdn.example.com^        adblock exception, allows the name and its subdomains
+//	*.ads.example.com           wildcard, blocks matching names
+//	/^ad[0-9]+\./               regular expression, blocks matching names
+func addRule(line string, blocked *ruleSet, allowed *ruleSet) error {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		return nil
+	}
+
+	rules := blocked
+	if exception, isException := strings.CutPrefix(line, "@@"); isException {
+		rules = allowed
+		line = exception
+	}
+
+	if strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") && len(line) > 2 {
+		regex, err := regexp.Compile(line[1 : len(line)-1])
+		if err != nil {
+			return err
+		}
+		rules.regexes = append(rules.regexes, regex)
+		return nil
+	}
+
+	if domain, isAdblock := strings.CutPrefix(line, "||"); isAdblock {
+		domain, _, _ = strings.Cut(domain, "$") // options such as $important do not apply to DNS
+		domain = strings.TrimSuffix(domain, "^")
+		if strings.ContainsAny(domain, "/*^") {
+			return fmt.Errorf("unsupported adblock rule %q", line)
+		}
+		rules.subtree[canonicalName(domain)] = true
+		return nil
+	}
+
+	line, _, _ = strings.Cut(line, "#")
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	if net.ParseIP(fields[0]) != nil {
+		for _, name := range fields[1:] {
+			name = canonicalName(name)
+			if name != "localhost" && name != "" {
+				rules.exact[name] = true
+			}
+		}
+		return nil
+	}
+	if len(fields) != 1 {
+		return fmt.Errorf("unrecognised rule %q", line)
+	}
+	if strings.ContainsAny(fields[0], "*?[") {
+		rules.wildcards = append(rules.wildcards, canonicalName(fields[0]))
+		return nil
+	}
+	rules.exact[canonicalName(fields[0])] = true
+	return nil
+}
+
+func loadRuleFile(filePath string, blocked *ruleSet, allowed *ruleSet) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("[Blocklist Error] %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		if err := addRule(scanner.Text(), blocked, allowed); err != nil {
+			slog.Warn("Skipped an invalid blocklist rule", "file", filePath, "line", lineNumber, "err", err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("[Blocklist Error] %s: %w", filePath, err)
+	}
+	return nil
+}
+
+// blockAction is how blocked names are answered.
+type blockAction struct {
+	rcode uint16
+	ip    net.IP // answer A or AAAA queries with this address, if set
+	null  bool   // answer with 0.0.0.0 or ::
+}
+
+func parseBlockAction(text string) (blockAction, error) {
+	switch strings.ToLower(text) {
+	case "", "nxdomain":
+		return blockAction{rcode: RcodeNXDomain}, nil
+	case "null":
+		return blockAction{rcode: RcodeNoError, null: true}, nil
+	case "refused":
+		return blockAction{rcode: RcodeRefused}, nil
+	}
+	ip := net.ParseIP(text)
+	if ip == nil {
+		return blockAction{}, fmt.Errorf("[Blocklist Error] invalid block response %q", text)
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+	return blockAction{rcode: RcodeNoError, ip: ip}, nil
+}
+
+type Blocklist struct {
+	config   BlocklistConfig
+	action   blockAction
+	refresh  time.Duration
+	mu       sync.RWMutex
+	blocked  *ruleSet
+	allowed  *ruleSet
+	modTimes map[string]time.Time
+	disabled atomic.Bool // turned off through the admin API
+}
+
+func NewBlocklist(config BlocklistConfig) (*Blocklist, error) {
+	action, err := parseBlockAction(config.Response)
+	if err != nil {
+		return nil, err
+	}
+	refresh := defaultBlocklistRefreshPeriod
+	if config.RefreshInterval != "" {
+		if refresh, err = time.ParseDuration(config.RefreshInterval); err != nil || refresh <= 0 {
+			return nil, fmt.Errorf("[Blocklist Error] invalid refresh interval %q", config.RefreshInterval)
+		}
+	}
+
+	blocklist := &Blocklist{config: config, action: action, refresh: refresh}
+	if err := blocklist.load(); err != nil {
+		return nil, err
+	}
+	return blocklist, nil
+}
+
+func (b *Blocklist) load() error {
+	blocked := newRuleSet()
+	allowed := newRuleSet()
+	modTimes := make(map[string]time.Time)
+
+	for _, filePath := range b.config.Files {
+		if err := loadRuleFile(filePath, blocked, allowed); err != nil {
+			return err
+		}
+		modTimes[filePath] = fileModTime(filePath)
+	}
+	for _, filePath := range b.config.Allowlist {
+		if err := loadRuleFile(filePath, allowed, allowed); err != nil {
+			return err
+		}
+		modTimes[filePath] = fileModTime(filePath)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.blocked = blocked
+	b.allowed = allowed
+	b.modTimes = modTimes
+	slog.Info("Loaded blocklists", "block_rules", blocked.size(), "allow_rules", allowed.size())
+	return nil
+}
+
+func fileModTime(filePath string) time.Time {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// watch reloads the list files when any of them has changed.
+func (b *Blocklist) watch() {
+	for range time.Tick(b.refresh) {
+		if !b.changed() {
+			continue
+		}
+		if err := b.load(); err != nil {
+			slog.Error("Failed to reload blocklists", "err", err)
+		}
+	}
+}
+
+func (b *Blocklist) changed() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for filePath, modTime := range b.modTimes {
+		if !fileModTime(filePath).Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Blocklist) isBlocked(name string) bool {
+	if b.disabled.Load() {
+		return false
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return !b.allowed.matches(name) && b.blocked.matches(name)
+}
+
+// answerBlocked answers a query when any of its questions is for a blocked
+// name, and reports false otherwise.
+func (s *DNSServer) answerBlocked(message DNSMessage) ([]byte, bool) {
+	if s.blocklist == nil || message.Header.getOpcode() != OpcodeQuery {
+		return nil, false
+	}
+	blocked := false
+	for _, question := range message.Questions {
+		if s.blocklist.isBlocked(question.QNAME) {
+			slog.Debug("Blocked a query", "qname", question.QNAME)
+			blocked = true
+		}
+	}
+	if !blocked {
+		return nil, false
+	}
+
+	action := s.blocklist.action
+	response := DNSMessage{
+		Header:    buildResponseHeader(message.Header, false, action.rcode),
+		Questions: message.Questions,
+	}
+	for _, question := range message.Questions {
+		if answer, ok := action.answer(question); ok {
+			response.Answers = append(response.Answers, answer)
+		}
+	}
+	addEDE(&response, EDEBlocked, "blocked by the blocklist")
+	return PackDNSMessage(response), true
+}
+
+func (a blockAction) answer(question DNSQuestion) (DNSAnswer, bool) {
+	answer := DNSAnswer{ANAME: question.QNAME, ATYPE: question.QTYPE, ACLASS: ClassIN, TTL: blockedTTL}
+	switch {
+	case a.null && question.QTYPE == TypeA:
+		answer.RDATA = net.IPv4zero.To4()
+	case a.null && question.QTYPE == TypeAAAA:
+		answer.RDATA = net.IPv6zero
+	case a.ip != nil && len(a.ip) == net.IPv4len && question.QTYPE == TypeA:
+		answer.RDATA = a.ip
+	case a.ip != nil && len(a.ip) == net.IPv6len && question.QTYPE == TypeAAAA:
+		answer.RDATA = a.ip
+	default:
+		return DNSAnswer{}, false
+	}
+	return answer, true
+}
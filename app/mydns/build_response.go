@@ -7,9 +7,15 @@ import (
 	"strings"
 )
 
-func BuildDNSResponse(message DNSMessage) []byte {
-	response := new(bytes.Buffer)
+// placeholderTTL is the TTL of the placeholder answers given when the
+// server has no data of its own and no resolver to forward to.
+const placeholderTTL = 67543
+
+// minimalANYTTL is the TTL of the synthesized HINFO answer to ANY queries,
+// kept short as RFC 8482 suggests so resolvers do not hold on to it.
+const minimalANYTTL = 60
 
+func BuildDNSResponse(message DNSMessage) []byte {
 	// HEADER
 	flags := uint16(0)
 	flags |= 1 << 15                                  // QR
@@ -20,58 +26,168 @@ func BuildDNSResponse(message DNSMessage) []byte {
 	flags |= 0 << 7                                   // RA
 	flags |= 0b000 << 4                               // Z
 	if message.Header.getOpcode() != 0b0000 {         // RCODE
-		flags |= 0b0100
+		flags |= RcodeNotImp
+	} else if !supportedClasses(message) {
+		flags |= RcodeRefused
 	}
 
-	header := DNSHeader{
-		ID:      message.Header.ID,
-		Flags:   flags,
-		QDCount: uint16(len(message.Questions)),
-		ANCount: uint16(len(message.Questions)),
-		NSCount: 0,
-		ARCount: 0,
+	response := DNSMessage{
+		Header: DNSHeader{
+			ID:    message.Header.ID,
+			Flags: flags,
+		},
+		Questions: message.Questions,
+	}
+	if response.Header.getRcode() != RcodeNoError {
+		return PackDNSMessage(response)
 	}
-	binary.Write(response, binary.BigEndian, header)
 
-	offsets := make(map[string]uint)
+	// ANSWERS
+	for _, question := range message.Questions {
+		answer := DNSAnswer{
+			ANAME:  question.QNAME,
+			ATYPE:  question.QTYPE,
+			ACLASS: ClassIN,
+			TTL:    placeholderTTL,
+		}
+		switch question.QTYPE {
+		case TypeA:
+			answer.RDATA = net.IPv4zero.To4()
+		case TypeAAAA:
+			answer.RDATA = net.IPv6zero
+		case TypeANY:
+			answer = minimalANYResponse(question.QNAME)
+		default:
+			// The name exists without data of this type (NODATA)
+			continue
+		}
+		response.Answers = append(response.Answers, answer)
+	}
 
-	// QUESTIONS
+	return PackDNSMessage(response)
+}
+
+// supportedClasses reports whether every question is for the IN class, the
+// only class the server holds data for. QCLASS ANY is treated as IN.
+func supportedClasses(message DNSMessage) bool {
 	for _, question := range message.Questions {
-		writeQname(response, question.QNAME, offsets)
+		if question.QCLASS != ClassIN && question.QCLASS != ClassANY {
+			return false
+		}
+	}
+	return true
+}
 
-		binary.Write(response, binary.BigEndian, question.QTYPE)
-		binary.Write(response, binary.BigEndian, question.QCLASS)
+// minimalANYResponse is the synthesized HINFO record RFC 8482 recommends
+// for answering QTYPE=ANY without listing every record of a name.
+func minimalANYResponse(name string) DNSAnswer {
+	rdata := []byte{byte(len("RFC8482"))}
+	rdata = append(rdata, "RFC8482"...)
+	rdata = append(rdata, 0)
+	return DNSAnswer{
+		ANAME:  name,
+		ATYPE:  TypeHINFO,
+		ACLASS: ClassIN,
+		TTL:    minimalANYTTL,
+		RDATA:  rdata,
 	}
+}
+
+// PackDNSMessage serializes a message, compressing names across all of its
+// sections. The section counts in the header are taken from the message.
+func PackDNSMessage(message DNSMessage) []byte {
+	packet := new(bytes.Buffer)
+
+	header := message.Header
+	header.QDCount = uint16(len(message.Questions))
+	header.ANCount = uint16(len(message.Answers))
+	header.NSCount = uint16(len(message.Authorities))
+	header.ARCount = uint16(len(message.Additionals))
+	binary.Write(packet, binary.BigEndian, header)
+
+	offsets := make(map[string]uint)
 
-	// ANSWERS
 	for _, question := range message.Questions {
-		writeQname(response, question.QNAME, offsets)
+		writeQname(packet, question.QNAME, offsets)
 
-		binary.Write(response, binary.BigEndian, question.QTYPE)
-		binary.Write(response, binary.BigEndian, question.QCLASS)
+		binary.Write(packet, binary.BigEndian, question.QTYPE)
+		binary.Write(packet, binary.BigEndian, question.QCLASS)
+	}
 
-		binary.Write(response, binary.BigEndian, uint32(67543))
-		binary.Write(response, binary.BigEndian, uint16(4))
-		binary.Write(response, binary.BigEndian, net.ParseIP("0.0.0.0").To4())
+	for _, section := range [][]DNSAnswer{message.Answers, message.Authorities, message.Additionals} {
+		for _, record := range section {
+			writeRecord(packet, record, offsets)
+		}
 	}
 
-	return response.Bytes()
+	return packet.Bytes()
+}
+
+func writeRecord(w *bytes.Buffer, record DNSAnswer, offsets map[string]uint) {
+	writeQname(w, record.ANAME, offsets)
+
+	binary.Write(w, binary.BigEndian, record.ATYPE)
+	binary.Write(w, binary.BigEndian, record.ACLASS)
+	binary.Write(w, binary.BigEndian, record.TTL)
+	binary.Write(w, binary.BigEndian, uint16(len(record.RDATA)))
+	w.Write(record.RDATA)
+}
+
+// malformedQueryResponse answers a query that could not be parsed with
+// FORMERR, echoing its ID and, if it can be read, its question. Packets too
+// short for a header, and responses, which must never be answered, get
+// nothing.
+func malformedQueryResponse(packet []byte) ([]byte, bool) {
+	header, position, err := parseDNSHeader(packet)
+	if err != nil || header.Flags&(1<<15) != 0 {
+		return nil, false
+	}
+	response := DNSMessage{Header: buildResponseHeader(header, false, RcodeFormErr)}
+	if header.QDCount > 0 {
+		if question, _, err := parseDNSQuestion(packet, position); err == nil {
+			response.Questions = []DNSQuestion{question}
+		}
+	}
+	return PackDNSMessage(response), true
+}
+
+// buildResponseHeader mirrors the ID, OPCODE and RD of a query.
+func buildResponseHeader(query DNSHeader, authoritative bool, rcode uint16) DNSHeader {
+	flags := uint16(0)
+	flags |= 1 << 15                 // QR
+	flags |= query.getOpcode() << 11 // OPCODE
+	if authoritative {               // AA
+		flags |= 1 << 10
+	}
+	flags |= query.getRecusionDesired() << 8 // RD
+	flags |= rcode & 0b1111                  // RCODE
+
+	return DNSHeader{
+		ID:    query.ID,
+		Flags: flags,
+	}
 }
 
 func writeQname(w *bytes.Buffer, name string, offsets map[string]uint) {
+	if name == "" {
+		w.WriteByte(0)
+		return
+	}
 	labels := strings.Split(name, ".")
 	for i, label := range labels {
-		// Write a pointer to any existing name
-		remainingName := strings.Join(labels[i:], ".")
+		// Write a pointer to any existing name. Names compare without
+		// regard to case, so a synthesized owner name such as one expanded
+		// from a wildcard still points back to the question.
+		remainingName := strings.ToLower(strings.Join(labels[i:], "."))
 		if offset, exists := offsets[remainingName]; exists {
 			pointer := 0xC000 | offset
 			binary.Write(w, binary.BigEndian, uint16(pointer))
 			return
 		}
-		if i == 0 {
-			offsets[name] = uint(w.Len())
+		// Pointers only have 14 bits for the offset
+		if w.Len() < 0x4000 {
+			offsets[remainingName] = uint(w.Len())
 		}
-		offsets[remainingName] = uint(w.Len())
 		w.WriteByte(byte(len(label)))
 		w.WriteString(label)
 	}
@@ -0,0 +1,401 @@
+package mydns
+
+import (
+	"cmp"
+	"container/list"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultCacheSize           = 10000
+	defaultCacheMaxTTL         = 86400
+	defaultCacheMaxNegativeTTL = 3600
+	defaultStaleAnswerTTL      = 30
+	defaultPrefetchHits        = 3
+	defaultPrefetchWindow      = time.Minute
+	defaultCacheSaveInterval   = 5 * time.Minute
+)
+
+type cacheKey struct {
+	name   string // canonical
+	qtype  uint16
+	qclass uint16
+}
+
+func newCacheKey(question DNSQuestion) cacheKey {
+	return cacheKey{name: canonicalName(question.QNAME), qtype: question.QTYPE, qclass: question.QCLASS}
+}
+
+type cacheEntry struct {
+	key         cacheKey
+	response    DNSMessage
+	stored      time.Time
+	expires     time.Time
+	hits        int
+	prefetching bool
+	windowStart time.Time // when the hits counted towards prefetching began
+	windowHits  int
+}
+
+// Cache holds forwarded responses until their TTL runs out, evicting the
+// least recently used entry when it is full. Expired responses are kept
+// for the stale window, to be served if the resolvers fail.
+type Cache struct {
+	mu                 sync.Mutex
+	entries            map[cacheKey]*list.Element
+	recent             *list.List // of *cacheEntry, most recently used first
+	size               int
+	maxTTL             uint32
+	maxNegativeTTL     uint32
+	staleWindow        time.Duration
+	staleAnswerTTL     uint32
+	staleClientTimeout time.Duration
+	prefetchPercent    int
+	prefetchHits       int
+	prefetchWindow     time.Duration
+	file               string
+	saveInterval       time.Duration
+	hits               atomic.Uint64
+	misses             atomic.Uint64
+	evictions          atomic.Uint64
+}
+
+func NewCache(config CacheConfig) (*Cache, error) {
+	cache := &Cache{
+		entries:         make(map[cacheKey]*list.Element),
+		recent:          list.New(),
+		size:            config.Size,
+		maxTTL:          config.MaxTTL,
+		maxNegativeTTL:  config.MaxNegativeTTL,
+		staleAnswerTTL:  config.StaleAnswerTTL,
+		prefetchPercent: config.PrefetchPercent,
+		prefetchHits:    config.PrefetchHits,
+		prefetchWindow:  defaultPrefetchWindow,
+		file:            config.File,
+		saveInterval:    defaultCacheSaveInterval,
+	}
+	if cache.size <= 0 {
+		cache.size = defaultCacheSize
+	}
+	if cache.maxTTL == 0 {
+		cache.maxTTL = defaultCacheMaxTTL
+	}
+	if cache.maxNegativeTTL == 0 {
+		cache.maxNegativeTTL = defaultCacheMaxNegativeTTL
+	}
+	if cache.staleAnswerTTL == 0 {
+		cache.staleAnswerTTL = defaultStaleAnswerTTL
+	}
+	if cache.prefetchHits <= 0 {
+		cache.prefetchHits = defaultPrefetchHits
+	}
+	if cache.prefetchPercent < 0 || cache.prefetchPercent >= 100 {
+		return nil, fmt.Errorf("[Cache Error] the prefetch percentage must be between 0 and 99")
+	}
+	var err error
+	if config.StaleWindow != "" {
+		if cache.staleWindow, err = time.ParseDuration(config.StaleWindow); err != nil || cache.staleWindow < 0 {
+			return nil, fmt.Errorf("[Cache Error] invalid stale window %q", config.StaleWindow)
+		}
+	}
+	if config.StaleClientTimeout != "" {
+		if cache.staleClientTimeout, err = time.ParseDuration(config.StaleClientTimeout); err != nil || cache.staleClientTimeout <= 0 {
+			return nil, fmt.Errorf("[Cache Error] invalid stale client timeout %q", config.StaleClientTimeout)
+		}
+	}
+	if config.PrefetchWindow != "" {
+		if cache.prefetchWindow, err = time.ParseDuration(config.PrefetchWindow); err != nil || cache.prefetchWindow <= 0 {
+			return nil, fmt.Errorf("[Cache Error] invalid prefetch window %q", config.PrefetchWindow)
+		}
+	}
+	if config.SaveInterval != "" {
+		if cache.saveInterval, err = time.ParseDuration(config.SaveInterval); err != nil || cache.saveInterval <= 0 {
+			return nil, fmt.Errorf("[Cache Error] invalid save interval %q", config.SaveInterval)
+		}
+	}
+
+	// A cache that cannot be restored is only a slower start
+	if cache.file != "" {
+		if err := cache.restore(); err != nil {
+			slog.Warn("Failed to restore the cache", "err", err)
+		}
+	}
+	return cache, nil
+}
+
+// lookup returns the cached response to a question with its TTLs reduced
+// by the time it has spent in the cache. It also reports when the response
+// should be prefetched: once it has been asked for often enough within the
+// prefetch window and little of its TTL is left. That is reported only
+// once for each response.
+func (c *Cache) lookup(question DNSQuestion) (DNSMessage, bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := newCacheKey(question)
+	element, exists := c.entries[key]
+	if !exists {
+		c.misses.Add(1)
+		return DNSMessage{}, false, false
+	}
+	entry := element.Value.(*cacheEntry)
+	now := time.Now()
+	if !now.Before(entry.expires) {
+		if !now.Before(entry.expires.Add(c.staleWindow)) {
+			c.recent.Remove(element)
+			delete(c.entries, key)
+		}
+		c.misses.Add(1)
+		return DNSMessage{}, false, false
+	}
+	c.recent.MoveToFront(element)
+	c.hits.Add(1)
+	entry.hits++
+	if now.Sub(entry.windowStart) >= c.prefetchWindow {
+		entry.windowStart, entry.windowHits = now, 0
+	}
+	entry.windowHits++
+
+	prefetch := false
+	if c.prefetchPercent > 0 && !entry.prefetching && entry.windowHits >= c.prefetchHits {
+		lifetime, remaining := entry.expires.Sub(entry.stored), entry.expires.Sub(now)
+		if remaining*100 < lifetime*time.Duration(c.prefetchPercent) {
+			entry.prefetching = true
+			prefetch = true
+		}
+	}
+	return agedResponse(entry.response, uint32(now.Sub(entry.stored).Seconds())), true, prefetch
+}
+
+// lookupStale returns an expired response still within the stale window,
+// with every TTL set to the stale answer TTL.
+func (c *Cache) lookupStale(question DNSQuestion) (DNSMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, exists := c.entries[newCacheKey(question)]
+	if !exists {
+		return DNSMessage{}, false
+	}
+	entry := element.Value.(*cacheEntry)
+	now := time.Now()
+	if now.Before(entry.expires) || !now.Before(entry.expires.Add(c.staleWindow)) {
+		return DNSMessage{}, false
+	}
+	c.recent.MoveToFront(element)
+
+	response := entry.response
+	for _, section := range []*[]DNSAnswer{&response.Answers, &response.Authorities, &response.Additionals} {
+		records := make([]DNSAnswer, len(*section))
+		for i, record := range *section {
+			record.TTL = c.staleAnswerTTL
+			records[i] = record
+		}
+		*section = records
+	}
+	return response, true
+}
+
+func agedResponse(response DNSMessage, age uint32) DNSMessage {
+	response.Answers = ageRecords(response.Answers, age)
+	response.Authorities = ageRecords(response.Authorities, age)
+	response.Additionals = ageRecords(response.Additionals, age)
+	return response
+}
+
+func ageRecords(records []DNSAnswer, age uint32) []DNSAnswer {
+	aged := make([]DNSAnswer, len(records))
+	for i, record := range records {
+		record.TTL -= min(record.TTL, age)
+		aged[i] = record
+	}
+	return aged
+}
+
+// store caches a response for as long as its records may be kept: the
+// lowest TTL of the answer and authority sections for positive answers,
+// and the SOA's negative TTL for NXDOMAIN and NODATA (RFC 2308). It
+// reports whether the response could be cached.
+func (c *Cache) store(question DNSQuestion, response DNSMessage) bool {
+	rcode := response.Header.getRcode()
+	if response.Header.Flags&(1<<9) != 0 || (rcode != RcodeNoError && rcode != RcodeNXDomain) {
+		return false
+	}
+	ttl, cacheable := c.responseTTL(response)
+	if !cacheable {
+		return false
+	}
+
+	// The OPT record belongs to the exchange with the resolver, not to the
+	// answer, so it is not kept
+	var additionals []DNSAnswer
+	for _, record := range response.Additionals {
+		if record.ATYPE != TypeOPT {
+			additionals = append(additionals, record)
+		}
+	}
+	response.Additionals = additionals
+
+	now := time.Now()
+	entry := &cacheEntry{
+		key:      newCacheKey(question),
+		response: response,
+		stored:   now,
+		expires:  now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.insert(entry)
+	return true
+}
+
+// insert adds an entry as the most recently used, evicting the least
+// recently used ones over the size. The caller holds the lock.
+func (c *Cache) insert(entry *cacheEntry) {
+	if element, exists := c.entries[entry.key]; exists {
+		c.recent.Remove(element)
+	}
+	c.entries[entry.key] = c.recent.PushFront(entry)
+	for c.recent.Len() > c.size {
+		oldest := c.recent.Back()
+		c.recent.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.evictions.Add(1)
+	}
+}
+
+func (c *Cache) responseTTL(response DNSMessage) (uint32, bool) {
+	if response.Header.getRcode() == RcodeNXDomain || len(response.Answers) == 0 {
+		for _, record := range response.Authorities {
+			if record.ATYPE != TypeSOA {
+				continue
+			}
+			soa, err := parseSOA(record.RDATA)
+			if err != nil {
+				return 0, false
+			}
+			ttl := min(record.TTL, soa.Minimum, c.maxNegativeTTL)
+			return ttl, ttl > 0
+		}
+		return 0, false
+	}
+
+	ttl := c.maxTTL
+	for _, record := range append(append([]DNSAnswer{}, response.Answers...), response.Authorities...) {
+		ttl = min(ttl, record.TTL)
+	}
+	return ttl, ttl > 0
+}
+
+// len returns the number of answers in the cache, stale ones included.
+func (c *Cache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.recent.Len()
+}
+
+// cacheEntryInfo describes a cached answer, as the admin API lists it.
+type cacheEntryInfo struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Class   string   `json:"class"`
+	Rcode   string   `json:"rcode"`
+	TTL     uint32   `json:"ttl"` // seconds left, 0 once stale
+	Stale   bool     `json:"stale"`
+	Hits    int      `json:"hits"`
+	Records []string `json:"records"`
+}
+
+// list describes the cached answers for names matching a pattern: a name,
+// a wildcard such as *.example.com for the names below it, or * for all.
+func (c *Cache) list(pattern string) []cacheEntryInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	var infos []cacheEntryInfo
+	for key, element := range c.entries {
+		entry := element.Value.(*cacheEntry)
+		if !matchesNamePattern(key.name, pattern) || !now.Before(entry.expires.Add(c.staleWindow)) {
+			continue
+		}
+		info := cacheEntryInfo{
+			Name:  fqdn(key.name),
+			Type:  typeToString(key.qtype),
+			Class: classToString(key.qclass),
+			Rcode: rcodeToString(entry.response.Header.getRcode()),
+			Stale: !now.Before(entry.expires),
+			Hits:  entry.hits,
+		}
+		if !info.Stale {
+			info.TTL = uint32(entry.expires.Sub(now).Seconds())
+		}
+		aged := agedResponse(entry.response, uint32(now.Sub(entry.stored).Seconds()))
+		for _, record := range append(append([]DNSAnswer{}, aged.Answers...), aged.Authorities...) {
+			info.Records = append(info.Records, recordToString(record))
+		}
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b cacheEntryInfo) int {
+		return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(a.Type, b.Type), cmp.Compare(a.Class, b.Class))
+	})
+	return infos
+}
+
+// flush removes the cached answers for a name, or with subtree for the
+// name and every name below it. Flushing the subtree of the root empties
+// the cache. It returns the number of answers removed.
+func (c *Cache) flush(name string, subtree bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name = canonicalName(name)
+	flushed := 0
+	for key, element := range c.entries {
+		if key.name == name || (subtree && isSubdomain(key.name, name)) {
+			c.recent.Remove(element)
+			delete(c.entries, key)
+			flushed++
+		}
+	}
+	return flushed
+}
+
+// seed caches records as if a resolver had answered them, one answer for
+// each name, type and class. The answers expire with the lowest TTL of
+// their records, like forwarded ones, and it returns how many were cached.
+func (c *Cache) seed(records []DNSAnswer) int {
+	type rrset struct {
+		question DNSQuestion
+		records  []DNSAnswer
+	}
+	var rrsets []*rrset
+	byKey := make(map[cacheKey]*rrset)
+	for _, record := range records {
+		question := DNSQuestion{QNAME: record.ANAME, QTYPE: record.ATYPE, QCLASS: record.ACLASS}
+		key := newCacheKey(question)
+		if byKey[key] == nil {
+			byKey[key] = &rrset{question: question}
+			rrsets = append(rrsets, byKey[key])
+		}
+		byKey[key].records = append(byKey[key].records, record)
+	}
+
+	seeded := 0
+	for _, set := range rrsets {
+		if c.store(set.question, DNSMessage{
+			Header:    DNSHeader{Flags: 1<<15 | 1<<7}, // QR, RA
+			Questions: []DNSQuestion{set.question},
+			Answers:   set.records,
+		}) {
+			seeded++
+		}
+	}
+	return seeded
+}
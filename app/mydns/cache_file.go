@@ -0,0 +1,132 @@
+package mydns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheFileVersion is bumped whenever the format of cache files changes,
+// and files of other versions are ignored.
+const cacheFileVersion = 1
+
+// cacheFile is the JSON a cache is saved as. Responses are kept in wire
+// format, and the times they were stored and expire are absolute, so TTLs
+// count down across a restart.
+type cacheFile struct {
+	Version int              `json:"version"`
+	Saved   time.Time        `json:"saved"`
+	Entries []cacheFileEntry `json:"entries"` // most recently used first
+}
+
+type cacheFileEntry struct {
+	Name     string    `json:"name"`
+	Type     uint16    `json:"type"`
+	Class    uint16    `json:"class"`
+	Stored   time.Time `json:"stored"`
+	Expires  time.Time `json:"expires"`
+	Response []byte    `json:"response"`
+}
+
+// save writes the cache to its file, through a temporary file so a crash
+// never leaves half of one.
+func (c *Cache) save() error {
+	c.mu.Lock()
+	file := cacheFile{Version: cacheFileVersion, Saved: time.Now()}
+	for element := c.recent.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*cacheEntry)
+		if !file.Saved.Before(entry.expires.Add(c.staleWindow)) {
+			continue
+		}
+		file.Entries = append(file.Entries, cacheFileEntry{
+			Name:     entry.key.name,
+			Type:     entry.key.qtype,
+			Class:    entry.key.qclass,
+			Stored:   entry.stored,
+			Expires:  entry.expires,
+			Response: PackDNSMessage(entry.response),
+		})
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return fmt.Errorf("[Cache Error] %w", err)
+	}
+	temporary, err := os.CreateTemp(filepath.Dir(c.file), filepath.Base(c.file)+".*")
+	if err != nil {
+		return fmt.Errorf("[Cache Error] %w", err)
+	}
+	defer os.Remove(temporary.Name())
+	if _, err := temporary.Write(data); err != nil {
+		temporary.Close()
+		return fmt.Errorf("[Cache Error] %w", err)
+	}
+	if err := temporary.Close(); err != nil {
+		return fmt.Errorf("[Cache Error] %w", err)
+	}
+	if err := os.Rename(temporary.Name(), c.file); err != nil {
+		return fmt.Errorf("[Cache Error] %w", err)
+	}
+	return nil
+}
+
+// restore loads the entries of the cache file that have not expired since
+// it was saved, or are still within the stale window. Entries that cannot
+// be read are skipped, so one bad entry does not lose the rest.
+func (c *Cache) restore() error {
+	data, err := os.ReadFile(c.file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("[Cache Error] %w", err)
+	}
+	var file cacheFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("[Cache Error] %s: %w", c.file, err)
+	}
+	if file.Version != cacheFileVersion {
+		return fmt.Errorf("[Cache Error] %s has version %d, expected %d", c.file, file.Version, cacheFileVersion)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	restored, skipped := 0, 0
+	for i := len(file.Entries) - 1; i >= 0; i-- {
+		saved := file.Entries[i]
+		if !now.Before(saved.Expires.Add(c.staleWindow)) {
+			continue
+		}
+		response, err := ParseDNSMessage(saved.Response)
+		if err != nil {
+			slog.Warn("Skipped an invalid cached response", "file", c.file, "name", saved.Name, "err", err)
+			skipped++
+			continue
+		}
+		c.insert(&cacheEntry{
+			key:      cacheKey{name: saved.Name, qtype: saved.Type, qclass: saved.Class},
+			response: response,
+			stored:   saved.Stored,
+			expires:  saved.Expires,
+		})
+		restored++
+	}
+	slog.Info("Restored the cache", "answers", restored, "skipped", skipped, "file", c.file)
+	return nil
+}
+
+// autosave saves the cache at every save interval.
+func (c *Cache) autosave() {
+	for range time.Tick(c.saveInterval) {
+		if err := c.save(); err != nil {
+			slog.Error("Failed to save the cache", "err", err)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package mydns
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const defaultListenAddress = "127.0.0.1:2053"
+
+// Config is the server configuration, loaded from a JSON file.
+type Config struct {
+	Listen   string       `json:"listen"`
+	Resolver string       `json:"resolver"`
+	Zones    []ZoneConfig `json:"zones"`
+	Keys     []KeyConfig  `json:"keys"`
+	Cache    *CacheConfig `json:"cache"`
+
+	// ACLs are named groups of ACL entries, which other ACLs can include
+	// by name
+	ACLs map[string][]string `json:"acls"`
+
+	// AllowQuery lists the clients that may query the server at all, and
+	// AllowRecursion those whose queries may be forwarded. Others only get
+	// answers from the server's own data. They default to "any" and to
+	// "localhost" and "localnets".
+	AllowQuery     []string `json:"allow-query"`
+	AllowRecursion []string `json:"allow-recursion"`
+
+	// AlsoListen are more addresses to serve on, so views can be chosen
+	// by the address a query arrived at
+	AlsoListen []string `json:"also-listen"`
+
+	// Views are checked in order, and clients matching none of them get
+	// the zones, resolver and cache configured at the top level
+	Views []ViewConfig `json:"views"`
+
+	// HostsFiles are /etc/hosts formatted files to answer names from
+	HostsFiles []string `json:"hosts-files"`
+
+	Blocklist *BlocklistConfig `json:"blocklist"`
+
+	// RPZ lists the response policy zones, in order of priority
+	RPZ []RPZConfig `json:"rpz"`
+
+	// Rewrites are applied, in order, to queries that are forwarded
+	Rewrites []RewriteConfig `json:"rewrite"`
+
+	RateLimit   *RateLimitConfig `json:"rate-limit"`
+	QueryLimits QueryLimitConfig `json:"query-limits"`
+	Cookies     CookieConfig     `json:"cookies"`
+
+	// Admin turns on the admin HTTP API
+	Admin *AdminConfig `json:"admin"`
+
+	Log      LogConfig       `json:"log"`
+	QueryLog *QueryLogConfig `json:"query-log"`
+	Dnstap   *DnstapConfig   `json:"dnstap"`
+}
+
+type ZoneConfig struct {
+	Name          string   `json:"name"`
+	File          string   `json:"file"`
+	Journal       string   `json:"journal"`
+	AllowUpdate   []string `json:"allow-update"`
+	AllowTransfer []string `json:"allow-transfer"`
+}
+
+// ViewConfig is a view of the server's data for the clients it matches.
+// Clients are matched with the same entries as an ACL, and an empty list
+// matches everyone. Views without allow-query or allow-recursion use the
+// ones at the top level.
+type ViewConfig struct {
+	Name              string       `json:"name"`
+	MatchClients      []string     `json:"match-clients"`
+	MatchDestinations []string     `json:"match-destinations"`
+	Zones             []ZoneConfig `json:"zones"`
+	Forwarders        []string     `json:"forwarders"`
+	Cache             *CacheConfig `json:"cache"`
+	AllowQuery        []string     `json:"allow-query"`
+	AllowRecursion    []string     `json:"allow-recursion"`
+}
+
+// CacheConfig sizes the cache of forwarded responses. The cache is on
+// unless disabled. With a stale window, expired answers are kept that much
+// longer to be served when the resolvers fail (RFC 8767), and with
+// prefetching, busy answers are refreshed before they expire.
+type CacheConfig struct {
+	Disabled           bool   `json:"disabled"`
+	Size               int    `json:"size"`                 // maximum number of responses
+	MaxTTL             uint32 `json:"max-ttl"`              // longest time to keep an answer
+	MaxNegativeTTL     uint32 `json:"max-negative-ttl"`     // longest time to keep NXDOMAIN and NODATA
+	StaleWindow        string `json:"stale-window"`         // how long to keep expired answers, off when empty
+	StaleAnswerTTL     uint32 `json:"stale-answer-ttl"`     // TTL of stale answers, defaults to 30
+	StaleClientTimeout string `json:"stale-client-timeout"` // answer stale after waiting this long for a resolver
+	PrefetchPercent    int    `json:"prefetch-percent"`     // refresh busy answers with less than this share of their TTL left, off when 0
+	PrefetchHits       int    `json:"prefetch-hits"`        // hits within the prefetch window that make an answer busy, defaults to 3
+	PrefetchWindow     string `json:"prefetch-window"`      // how recent those hits must be, defaults to 1m
+	File               string `json:"file"`                 // where to save the cache across restarts
+	SaveInterval       string `json:"save-interval"`        // how often to save it, defaults to 5m
+}
+
+// KeyConfig is a named TSIG key with a base64 encoded secret.
+type KeyConfig struct {
+	Name      string `json:"name"`
+	Algorithm string `json:"algorithm"`
+	Secret    string `json:"secret"`
+}
+
+// BlocklistConfig lists the files of domains to block. The format of each
+// line is detected on its own, so hosts files, plain domain lists and
+// adblock filter lists can be used as they are published.
+type BlocklistConfig struct {
+	Files           []string `json:"files"`
+	Allowlist       []string `json:"allowlist"`        // files of domains that are never blocked
+	Response        string   `json:"response"`         // nxdomain, null, refused, or an IP address
+	RefreshInterval string   `json:"refresh-interval"` // how often to check the files for changes
+}
+
+// RPZConfig is a response policy zone, read from a master file or
+// transferred from a primary server.
+type RPZConfig struct {
+	Name    string `json:"name"`
+	File    string `json:"file"`
+	Primary string `json:"primary"` // address to transfer the zone from
+	Key     string `json:"key"`     // TSIG key to sign the transfer with
+	Refresh string `json:"refresh"` // how often to check for a new version
+}
+
+// RewriteConfig changes forwarded queries for names matching Match, which
+// is a name or a wildcard such as *.example.com for the names below it.
+type RewriteConfig struct {
+	Match  string   `json:"match"`
+	Types  []string `json:"types"`  // only apply to queries of these types
+	Rename string   `json:"rename"` // forward the query for this name instead
+	TTL    *uint32  `json:"ttl"`    // set the TTL of every record in the response
+	Strip  []string `json:"strip"`  // remove records of these types from the response
+	Rcode  string   `json:"rcode"`  // answer with this RCODE instead of forwarding
+}
+
+// RateLimitConfig limits the UDP responses sent to each network, so the
+// server cannot be used to flood a spoofed address. Each kind of response
+// has its own limit: answers, NXDOMAIN, and errors such as REFUSED.
+type RateLimitConfig struct {
+	ResponsesPerSecond float64  `json:"responses-per-second"` // defaults to 10
+	NXDomainsPerSecond float64  `json:"nxdomains-per-second"` // defaults to responses-per-second
+	ErrorsPerSecond    float64  `json:"errors-per-second"`    // defaults to responses-per-second
+	Slip               *int     `json:"slip"`                 // send every Nth dropped response truncated, 0 for never
+	IPv4PrefixLength   int      `json:"ipv4-prefix-length"`   // size of the networks counted together
+	IPv6PrefixLength   int      `json:"ipv6-prefix-length"`
+	Exempt             []string `json:"exempt-clients"` // ACL of clients that are never limited
+	LogOnly            bool     `json:"log-only"`       // only log the responses that would be dropped
+}
+
+// QueryLimitConfig bounds the work the server takes on. Queries are
+// handled by a fixed number of workers, and each client address can be
+// limited in how fast it sends queries and how many it has in progress.
+type QueryLimitConfig struct {
+	Workers          int      `json:"workers"`            // queries handled at once, defaults to 128
+	QueueSize        int      `json:"queue-size"`         // queries waiting for a worker, defaults to 1024
+	QueriesPerSecond float64  `json:"queries-per-second"` // for each client address, 0 for no limit
+	MaxInFlight      int      `json:"max-in-flight"`      // for each client address, 0 for no limit
+	Action           string   `json:"action"`             // refuse or drop the queries over a limit
+	Exempt           []string `json:"exempt-clients"`     // ACL of clients that are never limited
+}
+
+// CookieConfig sets up DNS Cookies (RFC 7873), with which clients show
+// they can receive responses at the address they send from.
+type CookieConfig struct {
+	Disabled       bool   `json:"disabled"`
+	Secret         string `json:"secret"`          // hex encoded 16 byte secret shared by anycast servers, random when empty
+	PreviousSecret string `json:"previous-secret"` // still accepted while changing the secret
+	Rotate         string `json:"rotate"`          // how often to replace a random secret, defaults to 24h
+	Require        bool   `json:"require"`         // answer UDP queries without a valid server cookie with BADCOOKIE
+}
+
+// AdminConfig sets up the admin HTTP API, which inspects and manages the
+// server while it runs. With a token, every request must carry it as a
+// bearer token, and one is needed to listen on other than loopback.
+type AdminConfig struct {
+	Listen    string `json:"listen"`     // defaults to 127.0.0.1:8053
+	Token     string `json:"token"`      // bearer token requests must carry
+	TokenFile string `json:"token-file"` // file to read the token from instead
+}
+
+// LogConfig sets up the server's log, which is written to stdout.
+type LogConfig struct {
+	Level  string `json:"level"`  // debug, info, warn or error, defaults to info
+	Format string `json:"format"` // text, which is logfmt, or json, defaults to text
+}
+
+// QueryLogConfig turns on the query log, a line for each response sent
+// with the query it answers and how it was answered.
+type QueryLogConfig struct {
+	File       string  `json:"file"`        // stdout when empty
+	Format     string  `json:"format"`      // json or text, defaults to json
+	SampleRate float64 `json:"sample-rate"` // share of the queries to log, defaults to 1 for all of them
+	MaxSize    int     `json:"max-size"`    // megabytes to write to the file before rotating it, 0 for never
+	MaxBackups int     `json:"max-backups"` // rotated files to keep, defaults to 5
+}
+
+// DnstapConfig sends dnstap messages for the queries the server answers
+// and forwards, to a file or a Unix socket.
+type DnstapConfig struct {
+	File       string `json:"file"`
+	Socket     string `json:"socket"`
+	Identity   string `json:"identity"`    // defaults to the hostname
+	Version    string `json:"version"`     // sent when set
+	BufferSize int    `json:"buffer-size"` // messages queued before dropping them, defaults to 10000
+}
+
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("[Config Error] %w", err)
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return Config{}, fmt.Errorf("[Config Error] %s: %w", path, err)
+	}
+	return config, nil
+}
+
+func (c Config) listenAddress() string {
+	if c.Listen == "" {
+		return defaultListenAddress
+	}
+	return c.Listen
+}
@@ -0,0 +1,249 @@
+package mydns
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	clientCookieSize      = 8
+	serverCookieSize      = 16
+	serverCookieVersion   = 1
+	cookieLifetime        = time.Hour
+	cookieClockSkew       = 5 * time.Minute
+	defaultCookieRotation = 24 * time.Hour
+)
+
+type dnsCookie struct {
+	client []byte
+	server []byte // empty until the client has learned one
+}
+
+// parseCookie returns the COOKIE option of a query, which holds an 8 byte
+// client cookie and a server cookie of 8 to 32 bytes once the client has
+// one (RFC 7873 section 4).
+func parseCookie(opt edns) (dnsCookie, bool, error) {
+	data, present := opt.option(OptionCookie)
+	if !present {
+		return dnsCookie{}, false, nil
+	}
+	if len(data) != clientCookieSize && (len(data) < 16 || len(data) > 40) {
+		return dnsCookie{}, false, fmt.Errorf("[Cookie Error] COOKIE option has invalid length %d", len(data))
+	}
+	return dnsCookie{client: data[:clientCookieSize], server: data[clientCookieSize:]}, true, nil
+}
+
+// ServerCookies issues and checks server cookies in the interoperable
+// format of RFC 9018: a version, a timestamp, and a SipHash-2-4 of the
+// client cookie, those fields and the client's address under a secret.
+type ServerCookies struct {
+	mu       sync.RWMutex
+	current  [16]byte
+	previous *[16]byte
+	rotation time.Duration // 0 when the secret is configured
+	require  bool
+}
+
+func NewServerCookies(config CookieConfig) (*ServerCookies, error) {
+	cookies := &ServerCookies{require: config.Require}
+	if config.Secret == "" {
+		cookies.rotation = defaultCookieRotation
+		if config.Rotate != "" {
+			rotation, err := time.ParseDuration(config.Rotate)
+			if err != nil || rotation <= 0 {
+				return nil, fmt.Errorf("[Cookie Error] invalid rotation interval %q", config.Rotate)
+			}
+			cookies.rotation = rotation
+		}
+		rand.Read(cookies.current[:])
+		return cookies, nil
+	}
+
+	secret, err := parseCookieSecret(config.Secret)
+	if err != nil {
+		return nil, err
+	}
+	cookies.current = secret
+	if config.PreviousSecret != "" {
+		previous, err := parseCookieSecret(config.PreviousSecret)
+		if err != nil {
+			return nil, err
+		}
+		cookies.previous = &previous
+	}
+	return cookies, nil
+}
+
+func parseCookieSecret(encoded string) ([16]byte, error) {
+	var secret [16]byte
+	decoded, err := hex.DecodeString(encoded)
+	if err != nil || len(decoded) != len(secret) {
+		return secret, fmt.Errorf("[Cookie Error] the secret must be 16 bytes in hex")
+	}
+	copy(secret[:], decoded)
+	return secret, nil
+}
+
+// watch replaces a random secret at each rotation. Cookies made with the
+// one before are accepted until the next rotation.
+func (c *ServerCookies) watch() {
+	if c.rotation == 0 {
+		return
+	}
+	for range time.Tick(c.rotation) {
+		c.mu.Lock()
+		previous := c.current
+		c.previous = &previous
+		rand.Read(c.current[:])
+		c.mu.Unlock()
+		slog.Info("Rotated the server cookie secret")
+	}
+}
+
+// generate returns a server cookie for a client cookie and address.
+func (c *ServerCookies) generate(client []byte, ip net.IP, now time.Time) []byte {
+	c.mu.RLock()
+	secret := c.current
+	c.mu.RUnlock()
+
+	cookie := []byte{serverCookieVersion, 0, 0, 0}
+	cookie = binary.BigEndian.AppendUint32(cookie, uint32(now.Unix()))
+	return binary.LittleEndian.AppendUint64(cookie, serverCookieHash(secret, client, cookie, ip))
+}
+
+// serverCookieHash is written little-endian, as SipHash's reference
+// implementation and RFC 9018's examples do.
+func serverCookieHash(secret [16]byte, client []byte, header []byte, ip net.IP) uint64 {
+	input := append(append([]byte{}, client...), header...)
+	if ip4 := ip.To4(); ip4 != nil {
+		input = append(input, ip4...)
+	} else {
+		input = append(input, ip.To16()...)
+	}
+	return sipHash24(secret, input)
+}
+
+// valid reports whether a query's server cookie was issued by this server
+// to the same client cookie and address within the last hour.
+func (c *ServerCookies) valid(cookie dnsCookie, ip net.IP, now time.Time) bool {
+	if len(cookie.server) != serverCookieSize || cookie.server[0] != serverCookieVersion {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint32(cookie.server[4:])), 0)
+	if issued.Before(now.Add(-cookieLifetime)) || issued.After(now.Add(cookieClockSkew)) {
+		return false
+	}
+
+	c.mu.RLock()
+	secrets := [][16]byte{c.current}
+	if c.previous != nil {
+		secrets = append(secrets, *c.previous)
+	}
+	c.mu.RUnlock()
+	for _, secret := range secrets {
+		hash := serverCookieHash(secret, cookie.client, cookie.server[:8], ip)
+		if binary.LittleEndian.Uint64(cookie.server[8:]) == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// responseCookie is the COOKIE option for a response: the client's cookie
+// and a fresh server cookie.
+func (s *DNSServer) responseCookie(query edns, ip net.IP) ([]byte, bool) {
+	if s.cookies == nil {
+		return nil, false
+	}
+	cookie, present, err := parseCookie(query)
+	if !present || err != nil {
+		return nil, false
+	}
+	return append(append([]byte{}, cookie.client...), s.cookies.generate(cookie.client, ip, time.Now())...), true
+}
+
+// upstreamCookieJar holds the client cookies the server sends to its
+// upstream servers and the server cookies they have returned.
+type upstreamCookieJar struct {
+	mu      sync.Mutex
+	secret  [16]byte
+	servers map[string][]byte
+}
+
+var upstreamCookies = newUpstreamCookieJar()
+
+func newUpstreamCookieJar() *upstreamCookieJar {
+	jar := &upstreamCookieJar{servers: make(map[string][]byte)}
+	rand.Read(jar.secret[:])
+	return jar
+}
+
+// clientCookie differs for each upstream, so that one cannot be used to
+// track the server across the others (RFC 7873 section 4.1).
+func (j *upstreamCookieJar) clientCookie(server string) []byte {
+	return binary.BigEndian.AppendUint64(nil, sipHash24(j.secret, []byte(server)))
+}
+
+// attach sets the COOKIE option of a query to the server's own cookies for
+// an upstream, adding an OPT record if needed. Queries that cannot be
+// parsed or are signed with TSIG are left alone, and no cookie is returned.
+func (j *upstreamCookieJar) attach(query []byte, server string) ([]byte, []byte) {
+	message, err := ParseDNSMessage(query)
+	if err != nil {
+		return query, nil
+	}
+	if count := len(message.Additionals); count > 0 && message.Additionals[count-1].ATYPE == TypeTSIG {
+		return query, nil
+	}
+	opt, err := parseEDNS(message)
+	if err != nil {
+		return query, nil
+	}
+	if !opt.present {
+		// Without EDNS the client can only take 512 bytes over UDP
+		opt = edns{present: true, udpSize: 512}
+	}
+
+	client := j.clientCookie(server)
+	j.mu.Lock()
+	cookie := append(append([]byte{}, client...), j.servers[server]...)
+	j.mu.Unlock()
+	setEDNS(&message, opt.withOption(OptionCookie, cookie))
+	return PackDNSMessage(message), client
+}
+
+// learn keeps the server cookie from an upstream's response. It fails for
+// responses echoing a different client cookie, which are not answers to
+// the server's query, and reports BADCOOKIE responses, which should be
+// retried with the new server cookie.
+func (j *upstreamCookieJar) learn(response []byte, server string, client []byte) (bool, error) {
+	message, err := ParseDNSMessage(response)
+	if err != nil {
+		return false, nil
+	}
+	opt, err := parseEDNS(message)
+	if err != nil || !opt.present {
+		return false, nil
+	}
+	cookie, present, err := parseCookie(opt)
+	if !present {
+		return false, nil
+	}
+	if err != nil || !bytes.Equal(cookie.client, client) {
+		return false, fmt.Errorf("response from %s has the wrong client cookie", server)
+	}
+	if len(cookie.server) > 0 {
+		j.mu.Lock()
+		j.servers[server] = append([]byte{}, cookie.server...)
+		j.mu.Unlock()
+	}
+	rcode := uint16(opt.extendedRcode)<<4 | message.Header.getRcode()
+	return rcode == RcodeBadCookie, nil
+}
@@ -0,0 +1,378 @@
+package mydns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDnstapBufferSize = 10000
+	dnstapRetryInterval     = time.Second
+	dnstapContentType       = "protobuf:dnstap.Dnstap"
+)
+
+// Message types of dnstap.proto
+const (
+	dnstapClientQuery       = 5
+	dnstapClientResponse    = 6
+	dnstapForwarderQuery    = 7
+	dnstapForwarderResponse = 8
+)
+
+// dnstapWriter sends dnstap messages about the queries the server answers
+// and forwards to a file or a Unix socket, as Frame Streams. Messages are
+// queued in a buffer and written by a goroutine of their own, and dropped
+// when the buffer is full, so a slow reader never holds up queries. Its
+// methods do nothing on a nil writer, which is what servers without dnstap
+// have.
+type dnstapWriter struct {
+	file     string
+	socket   string
+	identity []byte
+	version  []byte
+	mu       sync.RWMutex
+	closed   bool
+	frames   chan []byte
+	dropped  atomic.Uint64
+	done     chan struct{}
+}
+
+func newDnstapWriter(config DnstapConfig) (*dnstapWriter, error) {
+	if (config.File == "") == (config.Socket == "") {
+		return nil, fmt.Errorf("[Dnstap Error] dnstap needs either a file or a socket")
+	}
+	identity := config.Identity
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+	size := config.BufferSize
+	if size <= 0 {
+		size = defaultDnstapBufferSize
+	}
+	return &dnstapWriter{
+		file:     config.File,
+		socket:   config.Socket,
+		identity: []byte(identity),
+		version:  []byte(config.Version),
+		frames:   make(chan []byte, size),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+func (d *dnstapWriter) clientQuery(job queryJob) {
+	if d == nil {
+		return
+	}
+	message := dnstapMessage(dnstapClientQuery, job.source, job.local)
+	message = appendTime(message, 8, 9, job.received)
+	message = appendBytesField(message, 10, job.packet)
+	d.send(message)
+}
+
+func (d *dnstapWriter) clientResponse(job queryJob, response []byte) {
+	if d == nil {
+		return
+	}
+	message := dnstapMessage(dnstapClientResponse, job.source, job.local)
+	message = appendTime(message, 8, 9, job.received)
+	message = appendTime(message, 12, 13, time.Now())
+	message = appendBytesField(message, 14, response)
+	d.send(message)
+}
+
+func (d *dnstapWriter) forwarderQuery(resolver string, query []byte, sent time.Time) {
+	if d == nil {
+		return
+	}
+	message := dnstapMessage(dnstapForwarderQuery, nil, resolverAddr(resolver))
+	message = appendTime(message, 8, 9, sent)
+	message = appendBytesField(message, 10, query)
+	d.send(message)
+}
+
+func (d *dnstapWriter) forwarderResponse(resolver string, response []byte, sent time.Time) {
+	if d == nil {
+		return
+	}
+	message := dnstapMessage(dnstapForwarderResponse, nil, resolverAddr(resolver))
+	message = appendTime(message, 8, 9, sent)
+	message = appendTime(message, 12, 13, time.Now())
+	message = appendBytesField(message, 14, response)
+	d.send(message)
+}
+
+func resolverAddr(resolver string) net.Addr {
+	addrPort, err := netip.ParseAddrPort(resolver)
+	if err != nil {
+		return nil
+	}
+	return net.UDPAddrFromAddrPort(addrPort)
+}
+
+// dnstapMessage starts a dnstap Message with its type and the addresses
+// of the exchange, either of which may be unknown.
+func dnstapMessage(messageType uint64, queryAddr net.Addr, responseAddr net.Addr) []byte {
+	message := appendVarintField(nil, 1, messageType)
+	protocol := uint64(1) // UDP
+	if _, isTCP := queryAddr.(*net.TCPAddr); isTCP {
+		protocol = 2
+	}
+	family := uint64(0)
+	for _, address := range []struct {
+		addr                 net.Addr
+		addrField, portField int
+	}{{queryAddr, 4, 6}, {responseAddr, 5, 7}} {
+		ip, port := addrIPPort(address.addr)
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, family = ip4, 1 // INET
+		} else {
+			family = 2 // INET6
+		}
+		message = appendBytesField(message, address.addrField, ip)
+		message = appendVarintField(message, address.portField, uint64(port))
+	}
+	if family != 0 {
+		message = appendVarintField(message, 2, family)
+	}
+	return appendVarintField(message, 3, protocol)
+}
+
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP, addr.Port
+	case *net.TCPAddr:
+		return addr.IP, addr.Port
+	}
+	return nil, 0
+}
+
+// send wraps a Message in a Dnstap and queues it, or drops it when the
+// buffer is full.
+func (d *dnstapWriter) send(message []byte) {
+	var frame []byte
+	if len(d.identity) > 0 {
+		frame = appendBytesField(frame, 1, d.identity)
+	}
+	if len(d.version) > 0 {
+		frame = appendBytesField(frame, 2, d.version)
+	}
+	frame = appendBytesField(frame, 14, message)
+	frame = appendVarintField(frame, 15, 1) // MESSAGE
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return
+	}
+	select {
+	case d.frames <- frame:
+	default:
+		if dropped := d.dropped.Add(1); dropped%1000 == 1 {
+			slog.Warn("Dropped dnstap messages, as the output cannot keep up", "dropped", dropped)
+		}
+	}
+}
+
+// run writes the queued messages until the writer is closed. A socket is
+// connected again whenever it fails, and messages are dropped meanwhile.
+func (d *dnstapWriter) run() {
+	defer close(d.done)
+	for {
+		output, err := d.open()
+		if err == nil {
+			if err = d.write(output); err == nil {
+				return
+			}
+		}
+		if d.file != "" {
+			slog.Error("Stopped writing dnstap", "file", d.file, "err", err)
+			d.discard(nil)
+			return
+		}
+		slog.Warn("Failed to write dnstap to the socket, connecting again", "socket", d.socket, "err", err)
+		if !d.discard(time.After(dnstapRetryInterval)) {
+			return
+		}
+	}
+}
+
+// discard drops the queued messages until the timer fires, and reports
+// false if the writer is closed first.
+func (d *dnstapWriter) discard(timer <-chan time.Time) bool {
+	for {
+		select {
+		case _, ok := <-d.frames:
+			if !ok {
+				return false
+			}
+			d.dropped.Add(1)
+		case <-timer:
+			return true
+		}
+	}
+}
+
+// open creates the file, or connects to the socket and goes through the
+// Frame Streams handshake, and starts the stream.
+func (d *dnstapWriter) open() (io.ReadWriteCloser, error) {
+	if d.file != "" {
+		file, err := os.Create(d.file)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := file.Write(controlFrame(frameStart, true)); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return file, nil
+	}
+
+	conn, err := net.DialTimeout("unix", d.socket, dnstapRetryInterval)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(dnstapRetryInterval))
+	if _, err := conn.Write(controlFrame(frameReady, true)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := readControlFrame(conn, frameAccept); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := conn.Write(controlFrame(frameStart, true)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// write writes messages to the output until the writer is closed, then
+// stops the stream.
+func (d *dnstapWriter) write(output io.ReadWriteCloser) error {
+	defer output.Close()
+	w := bufio.NewWriter(output)
+	for frame := range d.frames {
+		w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(frame))))
+		w.Write(frame)
+		if len(d.frames) > 0 {
+			continue
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	w.Write(controlFrame(frameStop, false))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if conn, isConn := output.(net.Conn); isConn {
+		conn.SetReadDeadline(time.Now().Add(dnstapRetryInterval))
+		readControlFrame(conn, frameFinish)
+	}
+	return nil
+}
+
+// close stops the stream once the queued messages are written.
+func (d *dnstapWriter) close() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	close(d.frames)
+	d.mu.Unlock()
+	<-d.done
+}
+
+// Frame Streams control frames
+const (
+	frameAccept = 0x01
+	frameStart  = 0x02
+	frameStop   = 0x03
+	frameReady  = 0x04
+	frameFinish = 0x05
+
+	frameFieldContentType = 0x01
+)
+
+// controlFrame encodes a control frame, which is told apart from data
+// frames by starting with a length of zero.
+func controlFrame(controlType uint32, withContentType bool) []byte {
+	control := binary.BigEndian.AppendUint32(nil, controlType)
+	if withContentType {
+		control = binary.BigEndian.AppendUint32(control, frameFieldContentType)
+		control = binary.BigEndian.AppendUint32(control, uint32(len(dnstapContentType)))
+		control = append(control, dnstapContentType...)
+	}
+	frame := binary.BigEndian.AppendUint32(nil, 0)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(control)))
+	return append(frame, control...)
+}
+
+func readControlFrame(r io.Reader, expected uint32) error {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if binary.BigEndian.Uint32(header) != 0 || length < 4 || length > 512 {
+		return fmt.Errorf("[Dnstap Error] expected a control frame")
+	}
+	control := make([]byte, length)
+	if _, err := io.ReadFull(r, control); err != nil {
+		return err
+	}
+	if controlType := binary.BigEndian.Uint32(control); controlType != expected {
+		return fmt.Errorf("[Dnstap Error] expected control frame %d, got %d", expected, controlType)
+	}
+	return nil
+}
+
+// Protocol buffers encoding, for the few field types dnstap uses
+
+func appendVarint(b []byte, value uint64) []byte {
+	for value >= 0x80 {
+		b = append(b, byte(value)|0x80)
+		value >>= 7
+	}
+	return append(b, byte(value))
+}
+
+func appendVarintField(b []byte, field int, value uint64) []byte {
+	b = appendVarint(b, uint64(field)<<3)
+	return appendVarint(b, value)
+}
+
+func appendBytesField(b []byte, field int, value []byte) []byte {
+	b = appendVarint(b, uint64(field)<<3|2)
+	b = appendVarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// appendTime appends a time as its seconds, a varint, and nanoseconds, a
+// fixed32.
+func appendTime(b []byte, secondsField int, nanosecondsField int, t time.Time) []byte {
+	b = appendVarintField(b, secondsField, uint64(t.Unix()))
+	b = appendVarint(b, uint64(nanosecondsField)<<3|5)
+	return binary.LittleEndian.AppendUint32(b, uint32(t.Nanosecond()))
+}
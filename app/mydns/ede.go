@@ -0,0 +1,59 @@
+package mydns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const OptionEDE uint16 = 15
+
+// Extended DNS Error codes (RFC 8914)
+const (
+	EDEOther                uint16 = 0
+	EDEStaleAnswer          uint16 = 3
+	EDEForgedAnswer         uint16 = 4
+	EDEBlocked              uint16 = 15
+	EDEProhibited           uint16 = 18
+	EDEStaleNXDomainAnswer  uint16 = 19
+	EDENotAuthoritative     uint16 = 20
+	EDENotSupported         uint16 = 21
+	EDENoReachableAuthority uint16 = 22
+	EDENetworkError         uint16 = 23
+)
+
+// addEDE adds an Extended DNS Error explaining a response to its OPT
+// record. The option is kept when the server sets its own OPT record on
+// the way out, and dropped with it for queries that had none.
+func addEDE(message *DNSMessage, code uint16, text string) {
+	opt, err := parseEDNS(*message)
+	if err != nil {
+		opt = edns{}
+	}
+	opt.present = true
+	data := binary.BigEndian.AppendUint16(nil, code)
+	opt.options = append(opt.options, ednsOption{code: OptionEDE, data: append(data, text...)})
+	setEDNS(message, opt)
+}
+
+// errorResponse answers a query with an RCODE and an Extended DNS Error.
+func errorResponse(query DNSMessage, rcode uint16, code uint16, text string) []byte {
+	response := DNSMessage{
+		Header:    buildResponseHeader(query.Header, false, rcode),
+		Questions: query.Questions,
+	}
+	addEDE(&response, code, text)
+	return PackDNSMessage(response)
+}
+
+// forwardFailure is the SERVFAIL for a query no resolver answered, telling
+// timeouts apart from other network errors. The error names the resolvers
+// and local addresses, so it is only logged and the client gets a fixed
+// text.
+func forwardFailure(query DNSMessage, err error) []byte {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errorResponse(query, RcodeServFail, EDENoReachableAuthority, "no resolver answered")
+	}
+	return errorResponse(query, RcodeServFail, EDENetworkError, "no resolver could be reached")
+}
@@ -0,0 +1,228 @@
+package mydns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	// ednsUDPSize is the UDP payload size advertised in OPT records, the
+	// size that avoids IP fragmentation on almost every path
+	ednsUDPSize = 1232
+
+	// maxUDPMessageSize is the largest response read from a resolver
+	maxUDPMessageSize = 65535
+
+	OptionCookie uint16 = 10
+
+	// Extended response codes, the upper 8 bits of which are carried in
+	// the OPT record
+	RcodeBadVers   uint16 = 16
+	RcodeBadCookie uint16 = 23
+)
+
+type ednsOption struct {
+	code uint16
+	data []byte
+}
+
+// edns is the OPT record of a message (RFC 6891).
+type edns struct {
+	present       bool
+	udpSize       uint16
+	extendedRcode uint8 // upper 8 bits of the RCODE
+	version       uint8
+	dnssecOK      bool
+	options       []ednsOption
+}
+
+func parseEDNS(message DNSMessage) (edns, error) {
+	var opt edns
+	for _, record := range message.Additionals {
+		if record.ATYPE != TypeOPT {
+			continue
+		}
+		if opt.present {
+			return edns{}, fmt.Errorf("[EDNS Error] more than one OPT record")
+		}
+		if record.ANAME != "" {
+			return edns{}, fmt.Errorf("[EDNS Error] OPT record is not owned by the root")
+		}
+		opt.present = true
+		opt.udpSize = record.ACLASS
+		opt.extendedRcode = uint8(record.TTL >> 24)
+		opt.version = uint8(record.TTL >> 16)
+		opt.dnssecOK = record.TTL&(1<<15) != 0
+
+		rdata := record.RDATA
+		for len(rdata) > 0 {
+			if len(rdata) < 4 {
+				return edns{}, fmt.Errorf("[EDNS Error] truncated option")
+			}
+			code, length := binary.BigEndian.Uint16(rdata), binary.BigEndian.Uint16(rdata[2:])
+			if len(rdata) < 4+int(length) {
+				return edns{}, fmt.Errorf("[EDNS Error] truncated option %d", code)
+			}
+			opt.options = append(opt.options, ednsOption{code: code, data: rdata[4 : 4+length]})
+			rdata = rdata[4+length:]
+		}
+	}
+	return opt, nil
+}
+
+func (e edns) option(code uint16) ([]byte, bool) {
+	for _, option := range e.options {
+		if option.code == code {
+			return option.data, true
+		}
+	}
+	return nil, false
+}
+
+// withOption replaces every option with the code by data.
+func (e edns) withOption(code uint16, data []byte) edns {
+	e = e.without(code)
+	e.options = append(e.options, ednsOption{code: code, data: data})
+	return e
+}
+
+func (e edns) without(code uint16) edns {
+	var options []ednsOption
+	for _, option := range e.options {
+		if option.code != code {
+			options = append(options, option)
+		}
+	}
+	e.options = options
+	return e
+}
+
+func (e edns) record() DNSAnswer {
+	var rdata []byte
+	for _, option := range e.options {
+		rdata = binary.BigEndian.AppendUint16(rdata, option.code)
+		rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(option.data)))
+		rdata = append(rdata, option.data...)
+	}
+	ttl := uint32(e.extendedRcode)<<24 | uint32(e.version)<<16
+	if e.dnssecOK {
+		ttl |= 1 << 15
+	}
+	return DNSAnswer{ATYPE: TypeOPT, ACLASS: e.udpSize, TTL: ttl, RDATA: rdata}
+}
+
+// setEDNS replaces the OPT record of a message.
+func setEDNS(message *DNSMessage, opt edns) {
+	removeEDNS(message)
+	message.Additionals = append(message.Additionals, opt.record())
+}
+
+func removeEDNS(message *DNSMessage) bool {
+	var kept []DNSAnswer
+	for _, record := range message.Additionals {
+		if record.ATYPE != TypeOPT {
+			kept = append(kept, record)
+		}
+	}
+	removed := len(kept) != len(message.Additionals)
+	message.Additionals = kept
+	return removed
+}
+
+// withTruncation keeps UDP responses within the payload size the client
+// can receive: the size in its OPT record, up to ednsUDPSize, or 512 bytes
+// without one. reserve is the room to leave for a TSIG record signed in
+// after truncation.
+func withTruncation(respond func([]byte), query edns, source net.Addr, reserve int) func([]byte) {
+	if _, isUDP := source.(*net.UDPAddr); !isUDP {
+		return respond
+	}
+	limit := 512
+	if query.present {
+		limit = min(max(int(query.udpSize), 512), ednsUDPSize)
+	}
+	limit -= reserve
+	return func(response []byte) {
+		if len(response) > limit {
+			response = truncateResponse(response, limit)
+		}
+		respond(response)
+	}
+}
+
+// truncateResponse sets TC on a response and drops the additional records
+// other than the OPT record, then the answer and authority records if it
+// still does not fit, so the client retries over TCP.
+func truncateResponse(response []byte, limit int) []byte {
+	message, err := ParseDNSMessage(response)
+	if err != nil {
+		header, _, err := parseDNSHeader(response)
+		if err != nil {
+			return response
+		}
+		message = DNSMessage{Header: header}
+	}
+	message.Header.Flags |= 1 << 9 // TC
+
+	var opt []DNSAnswer
+	for _, record := range message.Additionals {
+		if record.ATYPE == TypeOPT {
+			opt = append(opt, record)
+		}
+	}
+	message.Additionals = opt
+	if truncated := PackDNSMessage(message); len(truncated) <= limit {
+		return truncated
+	}
+	message.Answers, message.Authorities = nil, nil
+	return PackDNSMessage(message)
+}
+
+// extendedRcodeResponse answers a query with an RCODE above 15, whose
+// upper bits go in the OPT record.
+func extendedRcodeResponse(message DNSMessage, rcode uint16) []byte {
+	response := DNSMessage{
+		Header:    buildResponseHeader(message.Header, false, rcode&0xF),
+		Questions: message.Questions,
+	}
+	setEDNS(&response, edns{present: true, udpSize: ednsUDPSize, extendedRcode: uint8(rcode >> 4)})
+	return PackDNSMessage(response)
+}
+
+// withEDNS gives every response to a query with an OPT record one of the
+// server's own, keeping the extended RCODE and options of any OPT record
+// already in the response, such as one from the resolver, except for its
+// cookie. Responses to queries without one have any OPT record removed.
+func (s *DNSServer) withEDNS(respond func([]byte), query edns, source net.Addr) func([]byte) {
+	return func(response []byte) {
+		if !query.present && (len(response) < 12 || binary.BigEndian.Uint16(response[10:]) == 0) {
+			respond(response)
+			return
+		}
+		message, err := ParseDNSMessage(response)
+		if err != nil {
+			respond(response)
+			return
+		}
+		if !query.present {
+			if removeEDNS(&message) {
+				response = PackDNSMessage(message)
+			}
+			respond(response)
+			return
+		}
+
+		opt, err := parseEDNS(message)
+		if err != nil || !opt.present {
+			opt = edns{}
+		}
+		opt.present, opt.udpSize, opt.version, opt.dnssecOK = true, ednsUDPSize, 0, query.dnssecOK
+		opt = opt.without(OptionCookie)
+		if cookie, ok := s.responseCookie(query, addrIP(source)); ok {
+			opt = opt.withOption(OptionCookie, cookie)
+		}
+		setEDNS(&message, opt)
+		respond(PackDNSMessage(message))
+	}
+}
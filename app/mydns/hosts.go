@@ -0,0 +1,219 @@
+package mydns
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hostsTTL            = 60
+	hostsReloadInterval = 5 * time.Second
+)
+
+// HostsBackend answers from /etc/hosts formatted files. Every name on a
+// line, including aliases, resolves to the line's address, and the address
+// resolves back to the first name with a synthesized PTR record.
+type HostsBackend struct {
+	files    []string
+	mu       sync.RWMutex
+	forward  map[string][]net.IP // canonical name to addresses
+	reverse  map[string][]string // in-addr.arpa or ip6.arpa name to names
+	modTimes map[string]time.Time
+}
+
+func NewHostsBackend(files []string) (*HostsBackend, error) {
+	hosts := &HostsBackend{files: files}
+	if err := hosts.load(); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// load reads every file and replaces the current data only if all of them
+// parse, so a half written file never empties the backend.
+func (h *HostsBackend) load() error {
+	forward := make(map[string][]net.IP)
+	reverse := make(map[string][]string)
+	modTimes := make(map[string]time.Time)
+
+	for _, path := range h.files {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("[Hosts Error] %w", err)
+		}
+		modTimes[path] = info.ModTime()
+		if err := parseHostsFile(path, forward, reverse); err != nil {
+			return err
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.forward = forward
+	h.reverse = reverse
+	h.modTimes = modTimes
+	return nil
+}
+
+func parseHostsFile(path string, forward map[string][]net.IP, reverse map[string][]string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("[Hosts Error] %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("[Hosts Error] %s line %d: expected an address and a name", path, lineNumber)
+		}
+
+		address, _, _ := strings.Cut(fields[0], "%") // drop IPv6 zone identifiers
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return fmt.Errorf("[Hosts Error] %s line %d: invalid address %q", path, lineNumber, fields[0])
+		}
+		if ipv4 := ip.To4(); ipv4 != nil {
+			ip = ipv4
+		}
+
+		for _, name := range fields[1:] {
+			name = canonicalName(name)
+			if !containsIP(forward[name], ip) {
+				forward[name] = append(forward[name], ip)
+			}
+		}
+		reverseName := reverseAddressName(ip)
+		reverse[reverseName] = append(reverse[reverseName], canonicalName(fields[1]))
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("[Hosts Error] %s: %w", path, err)
+	}
+	return nil
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, existing := range ips {
+		if existing.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// reverseAddressName returns the name used for reverse lookups of an
+// address, such as 4.3.2.1.in-addr.arpa for 1.2.3.4.
+func reverseAddressName(ip net.IP) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ipv4[3], ipv4[2], ipv4[1], ipv4[0])
+	}
+	var nibbles []string
+	ipv6 := ip.To16()
+	for i := len(ipv6) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, fmt.Sprintf("%x", ipv6[i]&0xF), fmt.Sprintf("%x", ipv6[i]>>4))
+	}
+	return strings.Join(nibbles, ".") + ".ip6.arpa"
+}
+
+// watch reloads the files whenever one of them changes on disk.
+func (h *HostsBackend) watch() {
+	for range time.Tick(hostsReloadInterval) {
+		if !h.changed() {
+			continue
+		}
+		if err := h.load(); err != nil {
+			slog.Error("Failed to reload hosts files", "err", err)
+			continue
+		}
+		slog.Info("Reloaded hosts files")
+	}
+}
+
+func (h *HostsBackend) changed() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, path := range h.files {
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().Equal(h.modTimes[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the records for a name, and whether the name is known at
+// all. A known name without records of the type is answered with NODATA.
+func (h *HostsBackend) lookup(qname string, qtype uint16) ([]DNSAnswer, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	name := canonicalName(qname)
+	if names, exists := h.reverse[name]; exists {
+		var answers []DNSAnswer
+		if qtype == TypePTR || qtype == TypeANY {
+			for _, target := range names {
+				answers = append(answers, DNSAnswer{ANAME: qname, ATYPE: TypePTR, ACLASS: ClassIN, TTL: hostsTTL, RDATA: encodeName(target)})
+			}
+		}
+		return answers, true
+	}
+
+	ips, exists := h.forward[name]
+	if !exists {
+		return nil, false
+	}
+	var answers []DNSAnswer
+	for _, ip := range ips {
+		isIPv4 := len(ip) == net.IPv4len
+		switch {
+		case isIPv4 && (qtype == TypeA || qtype == TypeANY):
+			answers = append(answers, DNSAnswer{ANAME: qname, ATYPE: TypeA, ACLASS: ClassIN, TTL: hostsTTL, RDATA: ip})
+		case !isIPv4 && (qtype == TypeAAAA || qtype == TypeANY):
+			answers = append(answers, DNSAnswer{ANAME: qname, ATYPE: TypeAAAA, ACLASS: ClassIN, TTL: hostsTTL, RDATA: ip})
+		}
+	}
+	// Answer ANY with a single RRset (RFC 8482)
+	if qtype == TypeANY && len(answers) > 0 {
+		var rrset []DNSAnswer
+		for _, answer := range answers {
+			if answer.ATYPE == answers[0].ATYPE {
+				rrset = append(rrset, answer)
+			}
+		}
+		answers = rrset
+	}
+	return answers, true
+}
+
+// answerFromHosts answers a query for a name in the hosts files. It reports
+// false for names the files do not mention, so they can be forwarded.
+func (s *DNSServer) answerFromHosts(message DNSMessage) ([]byte, bool) {
+	if s.hosts == nil || len(message.Questions) != 1 || message.Header.getOpcode() != OpcodeQuery {
+		return nil, false
+	}
+	question := message.Questions[0]
+	answers, found := s.hosts.lookup(question.QNAME, question.QTYPE)
+	if !found {
+		return nil, false
+	}
+
+	response := DNSMessage{
+		Header:    buildResponseHeader(message.Header, true, RcodeNoError),
+		Questions: message.Questions,
+		Answers:   answers,
+	}
+	return PackDNSMessage(response), true
+}
@@ -0,0 +1,144 @@
+package mydns
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// journalEntry records one committed change to a zone. Entries are written
+// as text, one record per line, much like the differences of an IXFR:
+//
+//	serial 2024010101 2024010102
+//	del example.com. 3600 IN SOA ns.example.com. admin.example.com. 2024010101 ...
+//	add example.com. 3600 IN SOA ns.example.com. admin.example.com. 2024010102 ...
+//	add host.example.com. 300 IN A 192.0.2.10
+type journalEntry struct {
+	OldSerial uint32
+	NewSerial uint32
+	Deleted   []DNSAnswer
+	Added     []DNSAnswer
+}
+
+func (z *Zone) appendJournal(entry journalEntry) error {
+	if z.journal == "" {
+		return nil
+	}
+	file, err := os.OpenFile(z.journal, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("[Journal Error] %w", err)
+	}
+	defer file.Close()
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "serial %d %d\n", entry.OldSerial, entry.NewSerial)
+	for _, record := range entry.Deleted {
+		fmt.Fprintf(&text, "del %s\n", recordToString(record))
+	}
+	for _, record := range entry.Added {
+		fmt.Fprintf(&text, "add %s\n", recordToString(record))
+	}
+	if _, err := file.WriteString(text.String()); err != nil {
+		return fmt.Errorf("[Journal Error] %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("[Journal Error] %w", err)
+	}
+	return nil
+}
+
+func readJournal(path string) ([]journalEntry, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[Journal Error] %w", err)
+	}
+	defer file.Close()
+
+	var entries []journalEntry
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		keyword, rest, _ := strings.Cut(line, " ")
+		switch keyword {
+		case "serial":
+			var entry journalEntry
+			if _, err := fmt.Sscanf(rest, "%d %d", &entry.OldSerial, &entry.NewSerial); err != nil {
+				return nil, fmt.Errorf("[Journal Error] %s line %d: %w", path, lineNumber, err)
+			}
+			entries = append(entries, entry)
+		case "del", "add":
+			if len(entries) == 0 {
+				return nil, fmt.Errorf("[Journal Error] %s line %d: record before serial", path, lineNumber)
+			}
+			record, err := parseRecordText(rest)
+			if err != nil {
+				return nil, fmt.Errorf("[Journal Error] %s line %d: %w", path, lineNumber, err)
+			}
+			entry := &entries[len(entries)-1]
+			if keyword == "del" {
+				entry.Deleted = append(entry.Deleted, record)
+			} else {
+				entry.Added = append(entry.Added, record)
+			}
+		default:
+			return nil, fmt.Errorf("[Journal Error] %s line %d: unknown keyword %q", path, lineNumber, keyword)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("[Journal Error] %w", err)
+	}
+	return entries, nil
+}
+
+// replayJournal applies the journal entries that follow on from the serial
+// loaded from the zone file, so updates survive a restart.
+func (z *Zone) replayJournal() error {
+	if z.journal == "" {
+		return nil
+	}
+	entries, err := readJournal(z.journal)
+	if err != nil {
+		return err
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	for _, entry := range entries {
+		if entry.OldSerial != serialOf(z.records, z.Origin) {
+			continue
+		}
+		for _, record := range entry.Deleted {
+			removeRecords(z.records, record.ANAME, func(existing DNSAnswer) bool {
+				return sameRecord(existing, record)
+			})
+		}
+		for _, record := range entry.Added {
+			addRecord(z.records, record)
+		}
+	}
+	z.setRecords(z.records)
+	return nil
+}
+
+func serialOf(records map[string][]DNSAnswer, origin string) uint32 {
+	soa := findRRSet(records, origin, TypeSOA)
+	if len(soa) == 0 {
+		return 0
+	}
+	fields, err := parseSOA(soa[0].RDATA)
+	if err != nil {
+		return 0
+	}
+	return fields.Serial
+}
@@ -0,0 +1,41 @@
+package mydns
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// ConfigureLogging makes the server log at the configured level and in the
+// configured format. Servers log through the default slog logger, so this
+// applies to every server in the process.
+func ConfigureLogging(config LogConfig) error {
+	var level slog.Level
+	if config.Level != "" {
+		if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+			return fmt.Errorf("[Log Error] unknown level %q, expected debug, info, warn or error", config.Level)
+		}
+	}
+	handler, err := newLogHandler(os.Stdout, config.Format, "text", &slog.HandlerOptions{Level: level})
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+func newLogHandler(w io.Writer, format string, defaultFormat string, options *slog.HandlerOptions) (slog.Handler, error) {
+	if format == "" {
+		format = defaultFormat
+	}
+	switch strings.ToLower(format) {
+	case "text", "logfmt":
+		return slog.NewTextHandler(w, options), nil
+	case "json":
+		return slog.NewJSONHandler(w, options), nil
+	default:
+		return nil, fmt.Errorf("[Log Error] unknown format %q, expected text or json", format)
+	}
+}
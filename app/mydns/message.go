@@ -1,9 +1,11 @@
 package mydns
 
 type DNSMessage struct {
-	Header    DNSHeader
-	Questions []DNSQuestion
-	Answers   []DNSAnswer
+	Header      DNSHeader
+	Questions   []DNSQuestion
+	Answers     []DNSAnswer
+	Authorities []DNSAnswer
+	Additionals []DNSAnswer
 }
 
 type DNSHeader struct {
@@ -31,6 +33,10 @@ func (h DNSHeader) getRecusionDesired() uint16 {
 	return (h.Flags >> 8) & 0b1
 }
 
+func (h DNSHeader) getRcode() uint16 {
+	return h.Flags & 0b1111
+}
+
 type DNSQuestion struct {
 	QNAME  string // Domain Name
 	QTYPE  uint16 // Type of query
@@ -45,3 +51,53 @@ type DNSAnswer struct {
 	RDLENGTH uint16 // Length of the resource data
 	RDATA    []byte // Resource data
 }
+
+// Record types
+const (
+	TypeA     uint16 = 1
+	TypeNS    uint16 = 2
+	TypeCNAME uint16 = 5
+	TypeSOA   uint16 = 6
+	TypePTR   uint16 = 12
+	TypeHINFO uint16 = 13
+	TypeMX    uint16 = 15
+	TypeTXT   uint16 = 16
+	TypeAAAA  uint16 = 28
+	TypeSRV   uint16 = 33
+	TypeDNAME uint16 = 39
+	TypeOPT   uint16 = 41
+	TypeDS    uint16 = 43
+	TypeIXFR  uint16 = 251
+	TypeAXFR  uint16 = 252
+	TypeANY   uint16 = 255
+)
+
+// Record classes
+const (
+	ClassIN   uint16 = 1
+	ClassCH   uint16 = 3
+	ClassNONE uint16 = 254
+	ClassANY  uint16 = 255
+)
+
+// Operation codes
+const (
+	OpcodeQuery  uint16 = 0
+	OpcodeNotify uint16 = 4
+	OpcodeUpdate uint16 = 5
+)
+
+// Response codes
+const (
+	RcodeNoError  uint16 = 0
+	RcodeFormErr  uint16 = 1
+	RcodeServFail uint16 = 2
+	RcodeNXDomain uint16 = 3
+	RcodeNotImp   uint16 = 4
+	RcodeRefused  uint16 = 5
+	RcodeYXDomain uint16 = 6
+	RcodeYXRRSet  uint16 = 7
+	RcodeNXRRSet  uint16 = 8
+	RcodeNotAuth  uint16 = 9
+	RcodeNotZone  uint16 = 10
+)
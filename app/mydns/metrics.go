@@ -0,0 +1,266 @@
+package mydns
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The metrics are written in the Prometheus text format, so any Prometheus
+// compatible scraper can collect them from the admin API.
+
+// counterVec is a counter for each combination of the values of its labels.
+type counterVec struct {
+	mu     sync.Mutex
+	labels []string
+	values map[string]*labeledValue
+}
+
+type labeledValue struct {
+	labels []string
+	value  uint64
+}
+
+func newCounterVec(labels ...string) *counterVec {
+	return &counterVec{labels: labels, values: make(map[string]*labeledValue)}
+}
+
+func (c *counterVec) inc(labels ...string) {
+	key := strings.Join(labels, "\x00")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, exists := c.values[key]
+	if !exists {
+		value = &labeledValue{labels: labels}
+		c.values[key] = value
+	}
+	value.value++
+}
+
+// histogramVec is a histogram for each combination of the values of its
+// labels.
+type histogramVec struct {
+	mu      sync.Mutex
+	labels  []string
+	buckets []float64 // upper bounds, in increasing order
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64 // for each bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// latencyBuckets suit durations from a cache hit to a slow resolver, in
+// seconds.
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+func newHistogramVec(buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{labels: labels, buckets: buckets, values: make(map[string]*histogramValue)}
+}
+
+func (h *histogramVec) observe(value float64, labels ...string) {
+	key := strings.Join(labels, "\x00")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	histogram, exists := h.values[key]
+	if !exists {
+		histogram = &histogramValue{labels: labels, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = histogram
+	}
+	if index, _ := slices.BinarySearch(h.buckets, value); index < len(h.buckets) {
+		histogram.counts[index]++
+	}
+	histogram.sum += value
+	histogram.count++
+}
+
+// metricsWriter writes metrics in the Prometheus text format.
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (m metricsWriter) header(name string, kind string, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (m metricsWriter) sample(name string, labels []string, values []string, value float64) {
+	fmt.Fprintf(m.w, "%s%s %s\n", name, formatLabels(labels, values), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// single writes a metric with a single value and no labels.
+func (m metricsWriter) single(name string, kind string, help string, value float64) {
+	m.header(name, kind, help)
+	m.sample(name, nil, nil, value)
+}
+
+func (m metricsWriter) counterVec(name string, help string, counter *counterVec) {
+	m.header(name, "counter", help)
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	for _, key := range sortedKeys(counter.values) {
+		value := counter.values[key]
+		m.sample(name, counter.labels, value.labels, float64(value.value))
+	}
+}
+
+func (m metricsWriter) histogramVec(name string, help string, histogram *histogramVec) {
+	m.header(name, "histogram", help)
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+	labels := append(slices.Clone(histogram.labels), "le")
+	for _, key := range sortedKeys(histogram.values) {
+		value := histogram.values[key]
+		cumulative := uint64(0)
+		for i, bound := range histogram.buckets {
+			cumulative += value.counts[i]
+			m.sample(name+"_bucket", labels, append(slices.Clone(value.labels), strconv.FormatFloat(bound, 'g', -1, 64)), float64(cumulative))
+		}
+		m.sample(name+"_bucket", labels, append(slices.Clone(value.labels), "+Inf"), float64(value.count))
+		m.sample(name+"_sum", histogram.labels, value.labels, value.sum)
+		m.sample(name+"_count", histogram.labels, value.labels, float64(value.count))
+	}
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func formatLabels(labels []string, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		pairs[i] = label + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// serverMetrics are the metrics of the queries a server answers.
+type serverMetrics struct {
+	responses *counterVec   // by query type, RCODE and transport
+	latency   *histogramVec // from receiving a query to responding, by transport
+}
+
+func newServerMetrics() serverMetrics {
+	return serverMetrics{
+		responses: newCounterVec("type", "rcode", "transport"),
+		latency:   newHistogramVec(latencyBuckets, "transport"),
+	}
+}
+
+func transportName(source net.Addr) string {
+	if _, isUDP := source.(*net.UDPAddr); isUDP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// observed records each response to a job in the metrics and the query
+// log before sending it.
+func (s *DNSServer) observed(job queryJob, trace *queryTrace) func([]byte) {
+	transport := transportName(job.source)
+	return func(response []byte) {
+		latency := time.Since(job.received)
+		qtype, rcode := "NONE", "FORMERR"
+		message, err := ParseDNSMessage(response)
+		if err == nil {
+			if len(message.Questions) > 0 {
+				qtype = typeToString(message.Questions[0].QTYPE)
+			}
+			extended := message.Header.getRcode()
+			if opt, err := parseEDNS(message); err == nil {
+				extended |= uint16(opt.extendedRcode) << 4
+			}
+			rcode = rcodeToString(extended)
+			if s.queryLog != nil {
+				s.queryLog.record(job.source, message, extended, trace, latency)
+			}
+		}
+		s.metrics.responses.inc(qtype, rcode, transport)
+		s.metrics.latency.observe(latency.Seconds(), transport)
+		s.dnstap.clientResponse(job, response)
+		job.respond(response)
+	}
+}
+
+// writeMetrics writes every metric of the server.
+func (s *DNSServer) writeMetrics(w io.Writer) {
+	m := metricsWriter{w}
+	m.counterVec("dns_responses_total", "Responses sent, by query type, RCODE and transport.", s.metrics.responses)
+	m.histogramVec("dns_response_duration_seconds", "Time from receiving a query to responding to it.", s.metrics.latency)
+
+	stats := s.QueryStats()
+	m.single("dns_queries_received_total", "counter", "Queries received.", float64(stats.Received))
+	m.single("dns_queries_in_flight", "gauge", "Queries being handled or waiting for a worker.", float64(stats.InFlight))
+	m.single("dns_queries_queued", "gauge", "Queries waiting for a worker.", float64(stats.Queued))
+	m.single("dns_goroutines", "gauge", "Goroutines in the process, workers and background tasks included.", float64(runtime.NumGoroutine()))
+	m.header("dns_queries_rejected_total", "counter", "Queries refused or dropped without being handled, by reason.")
+	for _, drop := range []struct {
+		reason string
+		count  uint64
+	}{
+		{"queue-full", stats.QueueFull},
+		{"rate-limit", stats.RateLimited},
+		{"concurrency-limit", stats.ConcurrencyLimited},
+		{"unparseable", stats.Unparseable},
+	} {
+		m.sample("dns_queries_rejected_total", []string{"reason"}, []string{drop.reason}, float64(drop.count))
+	}
+
+	if s.limiter != nil {
+		m.header("dns_rate_limit_actions_total", "counter", "Responses over the response rate limits, by what was done with them.")
+		for _, action := range []struct {
+			name  string
+			count uint64
+		}{
+			{"dropped", s.limiter.dropped.Load()},
+			{"slipped", s.limiter.slipped.Load()},
+			{"logged", s.limiter.logged.Load()},
+		} {
+			m.sample("dns_rate_limit_actions_total", []string{"action"}, []string{action.name}, float64(action.count))
+		}
+	}
+
+	caches := []struct {
+		name, kind, help string
+		value            func(*Cache) float64
+	}{
+		{"dns_cache_hits_total", "counter", "Questions answered from the cache, by view.", func(c *Cache) float64 { return float64(c.hits.Load()) }},
+		{"dns_cache_misses_total", "counter", "Questions the cache had no fresh answer for, by view.", func(c *Cache) float64 { return float64(c.misses.Load()) }},
+		{"dns_cache_evictions_total", "counter", "Answers evicted from the full cache, by view.", func(c *Cache) float64 { return float64(c.evictions.Load()) }},
+		{"dns_cache_entries", "gauge", "Answers in the cache, stale ones included, by view.", func(c *Cache) float64 { return float64(c.len()) }},
+	}
+	for _, metric := range caches {
+		m.header(metric.name, metric.kind, metric.help)
+		for _, view := range s.views {
+			if view.cache != nil {
+				m.sample(metric.name, []string{"view"}, []string{view.Name}, metric.value(view.cache))
+			}
+		}
+	}
+
+	if s.dnstap != nil {
+		m.single("dns_dnstap_dropped_total", "counter", "Dnstap messages dropped with the buffer full or the output down.", float64(s.dnstap.dropped.Load()))
+	}
+
+	m.counterVec("dns_upstream_queries_total", "Queries forwarded to each resolver.", s.upstreams.queries)
+	m.counterVec("dns_upstream_errors_total", "Forwarded queries each resolver did not answer.", s.upstreams.errors)
+	m.histogramVec("dns_upstream_rtt_seconds", "Round trip time of the queries each resolver answered.", s.upstreams.rtt)
+}
@@ -0,0 +1,68 @@
+package mydns
+
+import (
+	"strings"
+)
+
+// Names are kept without a trailing dot, the way parseQNAME returns them,
+// with the root written as the empty string.
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+// absoluteName resolves a name from a zone file or config against an origin.
+func absoluteName(name string, origin string) string {
+	if name == "@" {
+		return origin
+	}
+	if strings.HasSuffix(name, ".") {
+		return strings.TrimSuffix(name, ".")
+	}
+	if origin == "" {
+		return name
+	}
+	return name + "." + origin
+}
+
+// isSubdomain reports whether name is at or below parent.
+func isSubdomain(name string, parent string) bool {
+	name = canonicalName(name)
+	parent = canonicalName(parent)
+	if parent == "" || name == parent {
+		return true
+	}
+	return strings.HasSuffix(name, "."+parent)
+}
+
+// matchesNamePattern reports whether a name matches a pattern: a name, a
+// wildcard such as *.example.com for the names below it, or * for every
+// name.
+func matchesNamePattern(name string, pattern string) bool {
+	name, pattern = canonicalName(name), canonicalName(pattern)
+	if pattern == "*" {
+		return true
+	}
+	if suffix, isWildcard := strings.CutPrefix(pattern, "*."); isWildcard {
+		return name != suffix && isSubdomain(name, suffix)
+	}
+	return name == pattern
+}
+
+func parentName(name string) string {
+	if index := strings.Index(name, "."); index >= 0 {
+		return name[index+1:]
+	}
+	return ""
+}
+
+func countLabels(name string) int {
+	if name == "" {
+		return 0
+	}
+	return strings.Count(name, ".") + 1
+}
@@ -23,24 +23,44 @@ func ParseDNSMessage(packet []byte) (DNSMessage, error) {
 		position = newPosition
 	}
 
-	var answers []DNSAnswer
-	for i := 0; i < int(header.ANCount); i++ {
-		answer, newPosition, err := parseDNSAnswer(packet, position)
-		if err != nil {
-			return DNSMessage{}, err
-		}
-		answers = append(answers, answer)
-		position = newPosition
+	answers, position, err := parseDNSRecords(packet, position, header.ANCount)
+	if err != nil {
+		return DNSMessage{}, err
+	}
+	authorities, position, err := parseDNSRecords(packet, position, header.NSCount)
+	if err != nil {
+		return DNSMessage{}, err
+	}
+	additionals, _, err := parseDNSRecords(packet, position, header.ARCount)
+	if err != nil {
+		return DNSMessage{}, err
 	}
 
 	message := DNSMessage{
-		Header:    header,
-		Questions: questions,
-		Answers:   answers,
+		Header:      header,
+		Questions:   questions,
+		Answers:     answers,
+		Authorities: authorities,
+		Additionals: additionals,
 	}
 	return message, nil
 }
 
+// The answer, authority and additional sections (or the prerequisite,
+// update and additional sections of an UPDATE) share the same record format.
+func parseDNSRecords(packet []byte, position uint, count uint16) ([]DNSAnswer, uint, error) {
+	var records []DNSAnswer
+	for i := 0; i < int(count); i++ {
+		record, newPosition, err := parseDNSAnswer(packet, position)
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, record)
+		position = newPosition
+	}
+	return records, position, nil
+}
+
 func parseDNSHeader(packet []byte) (DNSHeader, uint, error) {
 	var header DNSHeader
 	if err := binary.Read(bytes.NewReader(packet), binary.BigEndian, &header); err != nil {
@@ -97,10 +117,20 @@ func parseDNSAnswer(packet []byte, position uint) (DNSAnswer, uint, error) {
 	}
 	position += 2
 
-	answer.ANAME = qname
-	answer.RDATA = packet[position : position+uint(answer.RDLENGTH)]
+	if position+uint(answer.RDLENGTH) > uint(len(packet)) {
+		return DNSAnswer{}, 0, fmt.Errorf("[Parse Answer Error] RDATA length exceeds packet size")
+	}
+	rdata, err := expandRDATA(packet, answer.ATYPE, position, answer.RDLENGTH)
+	if err != nil {
+		return DNSAnswer{}, 0, fmt.Errorf("[Parse Answer Error] %w", err)
+	}
+
 	position += uint(answer.RDLENGTH)
 
+	answer.ANAME = qname
+	answer.RDATA = rdata
+	answer.RDLENGTH = uint16(len(rdata))
+
 	return answer, position, nil
 }
 
@@ -111,11 +141,17 @@ func parseQNAME(packet []byte, position uint, visitedOffsets map[uint]bool) (str
 
 	var labels []string
 	for {
+		if position >= uint(len(packet)) {
+			return "", 0, fmt.Errorf("QNAME exceeds packet size")
+		}
 		length := uint(packet[position])
 		position++
 
 		// POINTER
 		if length&0xC0 == 0xC0 {
+			if position >= uint(len(packet)) {
+				return "", 0, fmt.Errorf("QNAME pointer exceeds packet size")
+			}
 			offset := ((length & 0x3F) << 8) | uint(packet[position])
 			position++
 
@@ -129,7 +165,9 @@ func parseQNAME(packet []byte, position uint, visitedOffsets map[uint]bool) (str
 			if err != nil {
 				return "", 0, err
 			}
-			labels = append(labels, referencedName)
+			if referencedName != "" {
+				labels = append(labels, referencedName)
+			}
 			break
 		}
 
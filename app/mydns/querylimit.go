@@ -0,0 +1,293 @@
+package mydns
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultWorkers   = 128
+	defaultQueueSize = 1024
+	clientIdleTime   = time.Minute
+)
+
+// queryJob is a received packet waiting for a worker.
+type queryJob struct {
+	packet   []byte
+	local    net.Addr
+	source   net.Addr
+	respond  func([]byte)
+	done     chan struct{} // closed once handled, when the sender waits for it
+	received time.Time
+}
+
+// QueryStats counts what became of the queries the server received.
+type QueryStats struct {
+	Received           uint64 `json:"received"`
+	Handled            uint64 `json:"handled"`
+	QueueFull          uint64 `json:"queue-full"`          // dropped with every worker busy and the queue full
+	RateLimited        uint64 `json:"rate-limited"`        // over a client's queries per second
+	ConcurrencyLimited uint64 `json:"concurrency-limited"` // over a client's queries in progress
+	InFlight           int64  `json:"in-flight"`           // being handled or waiting for a worker now
+	Queued             int    `json:"queued"`              // waiting for a worker now
+	FormErr            uint64 `json:"formerr"`             // answered with FORMERR, such as malformed queries
+	ServFail           uint64 `json:"servfail"`            // answered with SERVFAIL, such as when no resolver answered
+	Unparseable        uint64 `json:"unparseable"`         // dropped without even a header to answer
+}
+
+type queryCounters struct {
+	received           atomic.Uint64
+	handled            atomic.Uint64
+	queueFull          atomic.Uint64
+	rateLimited        atomic.Uint64
+	concurrencyLimited atomic.Uint64
+	inFlight           atomic.Int64
+	formErr            atomic.Uint64
+	servFail           atomic.Uint64
+	unparseable        atomic.Uint64
+}
+
+// QueryStats returns the server's query counters.
+func (s *DNSServer) QueryStats() QueryStats {
+	return QueryStats{
+		Received:           s.counters.received.Load(),
+		Handled:            s.counters.handled.Load(),
+		QueueFull:          s.counters.queueFull.Load(),
+		RateLimited:        s.counters.rateLimited.Load(),
+		ConcurrencyLimited: s.counters.concurrencyLimited.Load(),
+		InFlight:           s.counters.inFlight.Load(),
+		Queued:             len(s.jobs),
+		FormErr:            s.counters.formErr.Load(),
+		ServFail:           s.counters.servFail.Load(),
+		Unparseable:        s.counters.unparseable.Load(),
+	}
+}
+
+// countResponses counts the FORMERR and SERVFAIL responses sent.
+func (s *DNSServer) countResponses(respond func([]byte)) func([]byte) {
+	return func(response []byte) {
+		if len(response) >= 4 {
+			switch uint16(response[3] & 0xF) {
+			case RcodeFormErr:
+				s.counters.formErr.Add(1)
+			case RcodeServFail:
+				s.counters.servFail.Add(1)
+			}
+		}
+		respond(response)
+	}
+}
+
+type limitReason int
+
+const (
+	withinLimits limitReason = iota
+	overRateLimit
+	overConcurrencyLimit
+)
+
+type clientState struct {
+	tokens   float64
+	updated  time.Time
+	inFlight int
+	limited  bool
+}
+
+// clientLimiter tracks each client address's query rate, in a token bucket
+// holding a second's worth of queries, or one query for rates below one a
+// second, and its queries in progress.
+type clientLimiter struct {
+	mu          sync.Mutex
+	clients     map[string]*clientState
+	rate        float64
+	maxInFlight int
+	exempt      *ACL
+	lastSweep   time.Time
+}
+
+func newClientLimiter(config QueryLimitConfig, groups map[string][]string) (*clientLimiter, error) {
+	if config.QueriesPerSecond < 0 || config.MaxInFlight < 0 {
+		return nil, fmt.Errorf("[Query Limit Error] limits cannot be negative")
+	}
+	if config.QueriesPerSecond == 0 && config.MaxInFlight == 0 {
+		return nil, nil
+	}
+	limiter := &clientLimiter{
+		clients:     make(map[string]*clientState),
+		rate:        config.QueriesPerSecond,
+		maxInFlight: config.MaxInFlight,
+		lastSweep:   time.Now(),
+	}
+	if len(config.Exempt) > 0 {
+		exempt, err := parseACL(config.Exempt, groups)
+		if err != nil {
+			return nil, err
+		}
+		limiter.exempt = &exempt
+	}
+	return limiter, nil
+}
+
+// admit counts a query from ip as in progress if it is within the
+// client's limits. Admitted queries are released once handled.
+func (c *clientLimiter) admit(ip net.IP) limitReason {
+	if c.exempt != nil && c.exempt.allows(ip, "") {
+		return withinLimits
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.sweep(now)
+	client, exists := c.clients[ip.String()]
+	if !exists {
+		client = &clientState{tokens: c.capacity(), updated: now}
+		c.clients[ip.String()] = client
+	}
+
+	reason := withinLimits
+	c.refill(client, now)
+	if c.rate > 0 && client.tokens < 1 {
+		reason = overRateLimit
+	}
+	if c.maxInFlight > 0 && client.inFlight >= c.maxInFlight {
+		reason = overConcurrencyLimit
+	}
+	if reason != withinLimits {
+		if !client.limited {
+			slog.Warn("Limiting queries", "client", ip)
+			client.limited = true
+		}
+		return reason
+	}
+
+	if c.rate > 0 {
+		client.tokens--
+	}
+	client.inFlight++
+	client.limited = false
+	return withinLimits
+}
+
+func (c *clientLimiter) release(ip net.IP) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client, exists := c.clients[ip.String()]; exists && client.inFlight > 0 {
+		client.inFlight--
+		c.refill(client, time.Now())
+	}
+}
+
+// capacity is the most queries a client's bucket holds.
+func (c *clientLimiter) capacity() float64 {
+	return max(c.rate, 1)
+}
+
+// refill adds the tokens a client earned since its bucket was last
+// updated, so that time spent on its queries counts too.
+func (c *clientLimiter) refill(client *clientState, now time.Time) {
+	if c.rate > 0 {
+		client.tokens = min(c.capacity(), client.tokens+now.Sub(client.updated).Seconds()*c.rate)
+	}
+	client.updated = now
+}
+
+// idleTime is how long a client must be idle before it is forgotten. A
+// forgotten client comes back with a full bucket, so this is at least the
+// time an empty one takes to fill up.
+func (c *clientLimiter) idleTime() time.Duration {
+	if c.rate == 0 {
+		return clientIdleTime
+	}
+	return max(clientIdleTime, time.Duration(c.capacity()/c.rate*float64(time.Second)))
+}
+
+// sweep forgets the clients with nothing in progress that have not sent
+// a query for a while.
+func (c *clientLimiter) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < clientIdleTime {
+		return
+	}
+	c.lastSweep = now
+	idleTime := c.idleTime()
+	for key, client := range c.clients {
+		if client.inFlight == 0 && now.Sub(client.updated) >= idleTime {
+			delete(c.clients, key)
+		}
+	}
+}
+
+// submit hands a packet to the workers. When they are all busy, UDP
+// packets wait in a bounded queue and are dropped once it is full, while
+// TCP senders wait for room, which slows the connection down. submit
+// reports whether the packet was queued.
+func (s *DNSServer) submit(job queryJob, wait bool) bool {
+	s.counters.received.Add(1)
+	job.received = time.Now()
+	if s.clients != nil {
+		switch s.clients.admit(addrIP(job.source)) {
+		case overRateLimit:
+			s.counters.rateLimited.Add(1)
+			s.rejectQuery(job)
+			return false
+		case overConcurrencyLimit:
+			s.counters.concurrencyLimited.Add(1)
+			s.rejectQuery(job)
+			return false
+		}
+	}
+
+	s.counters.inFlight.Add(1)
+	if wait {
+		s.jobs <- job
+		return true
+	}
+	select {
+	case s.jobs <- job:
+		return true
+	default:
+		s.counters.queueFull.Add(1)
+		s.finish(job)
+		return false
+	}
+}
+
+func (s *DNSServer) work() {
+	for job := range s.jobs {
+		s.dnstap.clientQuery(job)
+		trace := &queryTrace{}
+		s.handlePacket(job.packet, job.local, job.source, s.observed(job, trace), trace)
+		s.counters.handled.Add(1)
+		s.finish(job)
+	}
+}
+
+func (s *DNSServer) finish(job queryJob) {
+	s.counters.inFlight.Add(-1)
+	if s.clients != nil {
+		s.clients.release(addrIP(job.source))
+	}
+	if job.done != nil {
+		close(job.done)
+	}
+}
+
+// rejectQuery answers a query over a client's limits with REFUSED, unless
+// the server is configured to drop them.
+func (s *DNSServer) rejectQuery(job queryJob) {
+	if s.dropOverLimit {
+		return
+	}
+	message, err := ParseDNSMessage(job.packet)
+	if err != nil {
+		return
+	}
+	job.respond(PackDNSMessage(DNSMessage{
+		Header:    buildResponseHeader(message.Header, false, RcodeRefused),
+		Questions: message.Questions,
+	}))
+}
@@ -0,0 +1,180 @@
+package mydns
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultQueryLogBackups = 5
+
+// queryTrace collects how a query was answered, for the query log. Its
+// methods do nothing on a nil trace, which queries of the server's own
+// use.
+type queryTrace struct {
+	view     string
+	upstream string // the resolver that answered
+	cache    string // hit, miss or stale, when the cache was consulted
+}
+
+func (t *queryTrace) inView(view string) {
+	if t != nil {
+		t.view = view
+	}
+}
+
+func (t *queryTrace) cached(status string) {
+	if t != nil {
+		t.cache = status
+	}
+}
+
+func (t *queryTrace) forwardedTo(resolver string) {
+	if t != nil {
+		t.upstream = resolver
+	}
+}
+
+// queryLog writes a line for each response, or for a sample of them.
+type queryLog struct {
+	logger     *slog.Logger
+	sampleRate float64
+	file       *rotatingFile // nil when writing to stdout
+}
+
+func newQueryLog(config QueryLogConfig) (*queryLog, error) {
+	log := &queryLog{sampleRate: config.SampleRate}
+	if log.sampleRate == 0 {
+		log.sampleRate = 1
+	}
+	if log.sampleRate < 0 || log.sampleRate > 1 {
+		return nil, fmt.Errorf("[Log Error] the query log sample rate must be between 0 and 1")
+	}
+
+	var w io.Writer = os.Stdout
+	if config.File != "" {
+		backups := config.MaxBackups
+		if backups <= 0 {
+			backups = defaultQueryLogBackups
+		}
+		file, err := openRotatingFile(config.File, int64(config.MaxSize)<<20, backups)
+		if err != nil {
+			return nil, err
+		}
+		log.file, w = file, file
+	}
+	handler, err := newLogHandler(w, config.Format, "json", nil)
+	if err != nil {
+		return nil, err
+	}
+	log.logger = slog.New(handler)
+	return log, nil
+}
+
+// record logs the response to a query.
+func (l *queryLog) record(source net.Addr, response DNSMessage, rcode uint16, trace *queryTrace, latency time.Duration) {
+	if l.sampleRate < 1 && rand.Float64() >= l.sampleRate {
+		return
+	}
+	attributes := []any{
+		"client", source.String(),
+		"transport", transportName(source),
+	}
+	if len(response.Questions) > 0 {
+		attributes = append(attributes, "qname", response.Questions[0].QNAME, "qtype", typeToString(response.Questions[0].QTYPE))
+	}
+	attributes = append(attributes,
+		"rcode", rcodeToString(rcode),
+		"answer", answerSummary(response.Answers),
+		"view", trace.view,
+		"upstream", trace.upstream,
+		"cache", trace.cache,
+		"latency_ms", float64(latency.Microseconds())/1000,
+	)
+	l.logger.Info("query", attributes...)
+}
+
+// answerSummary describes an answer section briefly, such as
+// "CNAME www.example.com., A 192.0.2.1".
+func answerSummary(answers []DNSAnswer) string {
+	summaries := make([]string, len(answers))
+	for i, answer := range answers {
+		summaries[i] = typeToString(answer.ATYPE) + " " + rdataToString(answer.ATYPE, answer.RDATA)
+	}
+	return strings.Join(summaries, ", ")
+}
+
+func (l *queryLog) close() {
+	if l.file != nil {
+		l.file.Close()
+	}
+}
+
+// rotatingFile is a file that is renamed to path.1, and older ones to
+// path.2 and so on, once writing to it would make it larger than maxSize.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64 // no limit when 0
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("[Log Error] %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("[Log Error] %w", err)
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return fmt.Errorf("[Log Error] %w", err)
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,239 @@
+package mydns
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultResponsesPerSecond = 10
+	defaultSlip               = 2
+	defaultIPv4PrefixLength   = 24
+	defaultIPv6PrefixLength   = 56
+	rateLimitIdleTime         = time.Minute
+)
+
+type responseClass int
+
+const (
+	responseAnswer responseClass = iota
+	responseNXDomain
+	responseError
+)
+
+var responseClassNames = map[responseClass]string{
+	responseAnswer:   "answers",
+	responseNXDomain: "NXDOMAIN",
+	responseError:    "errors",
+}
+
+func classifyResponse(response []byte) responseClass {
+	if len(response) < 4 {
+		return responseError
+	}
+	switch uint16(response[3] & 0xF) {
+	case RcodeNoError:
+		return responseAnswer
+	case RcodeNXDomain:
+		return responseNXDomain
+	}
+	return responseError
+}
+
+type rateLimitKey struct {
+	network string
+	class   responseClass
+}
+
+// rateLimitBucket holds up to a second's worth of responses, or one for
+// rates below one a second, and refills at the rate of its class.
+type rateLimitBucket struct {
+	tokens  float64
+	updated time.Time
+	dropped int
+}
+
+// RateLimiter implements response rate limiting: token buckets for each
+// client network and kind of response. Responses over the limit are
+// dropped, except that every slip'th one is sent truncated so that real
+// clients behind a spoofed address can retry over TCP.
+type RateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[rateLimitKey]*rateLimitBucket
+	rates     map[responseClass]float64
+	slip      int
+	ipv4Mask  net.IPMask
+	ipv6Mask  net.IPMask
+	exempt    *ACL
+	logOnly   bool
+	lastSweep time.Time
+
+	// what was done with the responses over the limits
+	dropped atomic.Uint64
+	slipped atomic.Uint64
+	logged  atomic.Uint64
+}
+
+func NewRateLimiter(config RateLimitConfig, groups map[string][]string) (*RateLimiter, error) {
+	responses := config.ResponsesPerSecond
+	if responses == 0 {
+		responses = defaultResponsesPerSecond
+	}
+	limiter := &RateLimiter{
+		buckets: make(map[rateLimitKey]*rateLimitBucket),
+		rates: map[responseClass]float64{
+			responseAnswer:   responses,
+			responseNXDomain: config.NXDomainsPerSecond,
+			responseError:    config.ErrorsPerSecond,
+		},
+		slip:      defaultSlip,
+		logOnly:   config.LogOnly,
+		lastSweep: time.Now(),
+	}
+	for class, rate := range limiter.rates {
+		if rate < 0 {
+			return nil, fmt.Errorf("[Rate Limit Error] the limit for %s cannot be negative", responseClassNames[class])
+		}
+		if rate == 0 {
+			limiter.rates[class] = responses
+		}
+	}
+	if config.Slip != nil {
+		if *config.Slip < 0 {
+			return nil, fmt.Errorf("[Rate Limit Error] slip cannot be negative")
+		}
+		limiter.slip = *config.Slip
+	}
+
+	ipv4Length := config.IPv4PrefixLength
+	if ipv4Length == 0 {
+		ipv4Length = defaultIPv4PrefixLength
+	}
+	ipv6Length := config.IPv6PrefixLength
+	if ipv6Length == 0 {
+		ipv6Length = defaultIPv6PrefixLength
+	}
+	if ipv4Length < 0 || ipv4Length > 32 || ipv6Length < 0 || ipv6Length > 128 {
+		return nil, fmt.Errorf("[Rate Limit Error] invalid prefix lengths /%d and /%d", ipv4Length, ipv6Length)
+	}
+	limiter.ipv4Mask = net.CIDRMask(ipv4Length, 32)
+	limiter.ipv6Mask = net.CIDRMask(ipv6Length, 128)
+
+	if len(config.Exempt) > 0 {
+		exempt, err := parseACL(config.Exempt, groups)
+		if err != nil {
+			return nil, err
+		}
+		limiter.exempt = &exempt
+	}
+	return limiter, nil
+}
+
+func (r *RateLimiter) network(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ones, _ := r.ipv4Mask.Size()
+		return fmt.Sprintf("%s/%d", ip4.Mask(r.ipv4Mask), ones)
+	}
+	ones, _ := r.ipv6Mask.Size()
+	return fmt.Sprintf("%s/%d", ip.Mask(r.ipv6Mask), ones)
+}
+
+// limit decides what to send a client in place of a response: the response
+// itself, a truncated copy of it, or nothing.
+func (r *RateLimiter) limit(ip net.IP, response []byte) ([]byte, bool) {
+	if r.exempt != nil && r.exempt.allows(ip, "") {
+		return response, true
+	}
+	key := rateLimitKey{network: r.network(ip), class: classifyResponse(response)}
+	rate := r.rates[key.class]
+
+	r.mu.Lock()
+	now := time.Now()
+	r.sweep(now)
+	bucket, exists := r.buckets[key]
+	if !exists {
+		bucket = &rateLimitBucket{tokens: max(rate, 1), updated: now}
+		r.buckets[key] = bucket
+	}
+	bucket.tokens = min(max(rate, 1), bucket.tokens+now.Sub(bucket.updated).Seconds()*rate)
+	bucket.updated = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		if bucket.dropped > 0 {
+			slog.Info("Stopped rate limiting", "responses", responseClassNames[key.class], "network", key.network, "limited", bucket.dropped)
+			bucket.dropped = 0
+		}
+		r.mu.Unlock()
+		return response, true
+	}
+	bucket.dropped++
+	dropped := bucket.dropped
+	r.mu.Unlock()
+
+	if dropped == 1 {
+		slog.Warn("Rate limiting", "responses", responseClassNames[key.class], "network", key.network, "log_only", r.logOnly)
+	}
+	if r.logOnly {
+		r.logged.Add(1)
+		return response, true
+	}
+	if r.slip > 0 && dropped%r.slip == 0 {
+		if truncated := truncatedResponse(response); truncated != nil {
+			r.slipped.Add(1)
+			return truncated, true
+		}
+	}
+	r.dropped.Add(1)
+	return nil, false
+}
+
+// rateLimited applies the rate limits to the responses to a client. Only
+// UDP is limited, since TCP clients cannot spoof their address.
+func (s *DNSServer) rateLimited(source net.Addr, respond func([]byte)) func([]byte) {
+	udpSource, isUDP := source.(*net.UDPAddr)
+	if s.limiter == nil || !isUDP {
+		return respond
+	}
+	return func(response []byte) {
+		if response, allowed := s.limiter.limit(udpSource.IP, response); allowed {
+			respond(response)
+		}
+	}
+}
+
+// sweep forgets the buckets of networks that have not been sent anything
+// for long enough to be full again.
+func (r *RateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < rateLimitIdleTime {
+		return
+	}
+	r.lastSweep = now
+	for key, bucket := range r.buckets {
+		if now.Sub(bucket.updated) >= r.idleTime(key.class) {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// idleTime is how long a bucket must go unused before it is forgotten. A
+// forgotten bucket comes back full, so this is at least the time an empty
+// one takes to fill up.
+func (r *RateLimiter) idleTime(class responseClass) time.Duration {
+	rate := r.rates[class]
+	return max(rateLimitIdleTime, time.Duration(max(rate, 1)/rate*float64(time.Second)))
+}
+
+// truncatedResponse keeps only the header and question of a response and
+// sets TC, telling the client to ask again over TCP.
+func truncatedResponse(response []byte) []byte {
+	message, err := ParseDNSMessage(response)
+	if err != nil {
+		return nil
+	}
+	message.Header.Flags |= 1 << 9
+	return PackDNSMessage(DNSMessage{Header: message.Header, Questions: message.Questions})
+}
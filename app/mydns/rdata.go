@@ -0,0 +1,430 @@
+package mydns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var typeNames = map[uint16]string{
+	TypeA:     "A",
+	TypeNS:    "NS",
+	TypeCNAME: "CNAME",
+	TypeSOA:   "SOA",
+	TypePTR:   "PTR",
+	TypeHINFO: "HINFO",
+	TypeMX:    "MX",
+	TypeTXT:   "TXT",
+	TypeAAAA:  "AAAA",
+	TypeSRV:   "SRV",
+	TypeDNAME: "DNAME",
+	TypeOPT:   "OPT",
+	TypeDS:    "DS",
+	TypeIXFR:  "IXFR",
+	TypeAXFR:  "AXFR",
+	TypeANY:   "ANY",
+}
+
+var classNames = map[uint16]string{
+	ClassIN:   "IN",
+	ClassCH:   "CH",
+	ClassNONE: "NONE",
+	ClassANY:  "ANY",
+}
+
+var rcodeNames = map[uint16]string{
+	RcodeNoError:  "NOERROR",
+	RcodeFormErr:  "FORMERR",
+	RcodeServFail: "SERVFAIL",
+	RcodeNXDomain: "NXDOMAIN",
+	RcodeNotImp:   "NOTIMP",
+	RcodeRefused:  "REFUSED",
+	RcodeYXDomain: "YXDOMAIN",
+	RcodeYXRRSet:  "YXRRSET",
+	RcodeNXRRSet:  "NXRRSET",
+	RcodeNotAuth:  "NOTAUTH",
+	RcodeNotZone:  "NOTZONE",
+}
+
+func typeToString(rrtype uint16) string {
+	if name, exists := typeNames[rrtype]; exists {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", rrtype)
+}
+
+func classToString(class uint16) string {
+	if name, exists := classNames[class]; exists {
+		return name
+	}
+	return fmt.Sprintf("CLASS%d", class)
+}
+
+func rcodeToString(rcode uint16) string {
+	if name, exists := rcodeNames[rcode]; exists {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+func parseType(text string) (uint16, bool) {
+	text = strings.ToUpper(text)
+	for rrtype, name := range typeNames {
+		if name == text {
+			return rrtype, true
+		}
+	}
+	if strings.HasPrefix(text, "TYPE") {
+		if value, err := strconv.ParseUint(text[4:], 10, 16); err == nil {
+			return uint16(value), true
+		}
+	}
+	return 0, false
+}
+
+func parseClass(text string) (uint16, bool) {
+	text = strings.ToUpper(text)
+	for class, name := range classNames {
+		if name == text {
+			return class, true
+		}
+	}
+	if strings.HasPrefix(text, "CLASS") {
+		if value, err := strconv.ParseUint(text[5:], 10, 16); err == nil {
+			return uint16(value), true
+		}
+	}
+	return 0, false
+}
+
+func parseRcode(text string) (uint16, bool) {
+	text = strings.ToUpper(text)
+	for rcode, name := range rcodeNames {
+		if name == text {
+			return rcode, true
+		}
+	}
+	return 0, false
+}
+
+// Names inside RDATA may be compressed against the rest of the packet, so
+// they are expanded when parsed to keep each record self-contained.
+func expandRDATA(packet []byte, rrtype uint16, position uint, length uint16) ([]byte, error) {
+	end := position + uint(length)
+	raw := packet[position:end]
+	if length == 0 {
+		return []byte{}, nil
+	}
+
+	var prefix, suffix uint
+	var names int
+	switch rrtype {
+	case TypeNS, TypeCNAME, TypePTR, TypeDNAME:
+		names = 1
+	case TypeMX:
+		prefix, names = 2, 1
+	case TypeSRV:
+		prefix, names = 6, 1
+	case TypeSOA:
+		names, suffix = 2, 20
+	default:
+		return append([]byte{}, raw...), nil
+	}
+
+	rdata := new(bytes.Buffer)
+	if prefix > uint(len(raw)) {
+		return nil, fmt.Errorf("RDATA too short for type %s", typeToString(rrtype))
+	}
+	rdata.Write(raw[:prefix])
+	position += prefix
+	for i := 0; i < names; i++ {
+		name, newPosition, err := parseQNAME(packet[:end], position, nil)
+		if err != nil {
+			return nil, err
+		}
+		rdata.Write(encodeName(name))
+		position = newPosition
+	}
+	if position+suffix != end {
+		return nil, fmt.Errorf("RDATA length mismatch for type %s", typeToString(rrtype))
+	}
+	rdata.Write(packet[position:end])
+	return rdata.Bytes(), nil
+}
+
+// encodeName writes a name as an uncompressed label sequence.
+func encodeName(name string) []byte {
+	encoded := new(bytes.Buffer)
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			encoded.WriteByte(byte(len(label)))
+			encoded.WriteString(label)
+		}
+	}
+	encoded.WriteByte(0)
+	return encoded.Bytes()
+}
+
+// parseRDATAText converts the presentation format of a record's data, as
+// found in zone files and journals, into its wire format.
+func parseRDATAText(rrtype uint16, fields []string, origin string) ([]byte, error) {
+	if len(fields) > 0 && fields[0] == `\#` {
+		return parseGenericRDATA(fields[1:])
+	}
+
+	rdata := new(bytes.Buffer)
+	expect := func(count int) error {
+		if len(fields) != count {
+			return fmt.Errorf("%s record expects %d fields, got %d", typeToString(rrtype), count, len(fields))
+		}
+		return nil
+	}
+
+	switch rrtype {
+	case TypeA:
+		if err := expect(1); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(fields[0]).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", fields[0])
+		}
+		rdata.Write(ip)
+	case TypeAAAA:
+		if err := expect(1); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 address %q", fields[0])
+		}
+		rdata.Write(ip.To16())
+	case TypeNS, TypeCNAME, TypePTR, TypeDNAME:
+		if err := expect(1); err != nil {
+			return nil, err
+		}
+		rdata.Write(encodeName(absoluteName(fields[0], origin)))
+	case TypeMX:
+		if err := expect(2); err != nil {
+			return nil, err
+		}
+		preference, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MX preference %q", fields[0])
+		}
+		binary.Write(rdata, binary.BigEndian, uint16(preference))
+		rdata.Write(encodeName(absoluteName(fields[1], origin)))
+	case TypeSRV:
+		if err := expect(4); err != nil {
+			return nil, err
+		}
+		for _, field := range fields[:3] {
+			value, err := strconv.ParseUint(field, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SRV field %q", field)
+			}
+			binary.Write(rdata, binary.BigEndian, uint16(value))
+		}
+		rdata.Write(encodeName(absoluteName(fields[3], origin)))
+	case TypeSOA:
+		if err := expect(7); err != nil {
+			return nil, err
+		}
+		rdata.Write(encodeName(absoluteName(fields[0], origin)))
+		rdata.Write(encodeName(absoluteName(fields[1], origin)))
+		for i, field := range fields[2:] {
+			var value uint32
+			var err error
+			if i == 0 {
+				var serial uint64
+				serial, err = strconv.ParseUint(field, 10, 32)
+				value = uint32(serial)
+			} else {
+				value, err = parseTTL(field)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid SOA field %q", field)
+			}
+			binary.Write(rdata, binary.BigEndian, value)
+		}
+	case TypeTXT, TypeHINFO:
+		if rrtype == TypeHINFO {
+			if err := expect(2); err != nil {
+				return nil, err
+			}
+		}
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("TXT record expects at least one string")
+		}
+		for _, field := range fields {
+			text := unquote(field)
+			if len(text) > 255 {
+				return nil, fmt.Errorf("character string longer than 255 bytes")
+			}
+			rdata.WriteByte(byte(len(text)))
+			rdata.WriteString(text)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported record type %s, use \\# syntax", typeToString(rrtype))
+	}
+	return rdata.Bytes(), nil
+}
+
+// Records of unknown types use the RFC 3597 syntax: \# <length> <hex>
+func parseGenericRDATA(fields []string) ([]byte, error) {
+	if len(fields) < 1 {
+		return nil, fmt.Errorf("generic RDATA missing length")
+	}
+	length, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid generic RDATA length %q", fields[0])
+	}
+	rdata, err := hex.DecodeString(strings.Join(fields[1:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid generic RDATA: %w", err)
+	}
+	if len(rdata) != length {
+		return nil, fmt.Errorf("generic RDATA length mismatch")
+	}
+	return rdata, nil
+}
+
+// rdataToString renders the wire format of a record's data in presentation
+// format, falling back to the RFC 3597 syntax for anything unrecognised.
+func rdataToString(rrtype uint16, rdata []byte) string {
+	generic := fmt.Sprintf(`\# %d %x`, len(rdata), rdata)
+
+	switch rrtype {
+	case TypeA:
+		if len(rdata) == 4 {
+			return net.IP(rdata).String()
+		}
+	case TypeAAAA:
+		if len(rdata) == 16 {
+			return net.IP(rdata).String()
+		}
+	case TypeNS, TypeCNAME, TypePTR, TypeDNAME:
+		if name, _, err := parseQNAME(rdata, 0, nil); err == nil {
+			return fqdn(name)
+		}
+	case TypeMX:
+		if len(rdata) > 2 {
+			if name, _, err := parseQNAME(rdata, 2, nil); err == nil {
+				return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(rdata), fqdn(name))
+			}
+		}
+	case TypeSRV:
+		if len(rdata) > 6 {
+			if name, _, err := parseQNAME(rdata, 6, nil); err == nil {
+				return fmt.Sprintf("%d %d %d %s", binary.BigEndian.Uint16(rdata), binary.BigEndian.Uint16(rdata[2:]), binary.BigEndian.Uint16(rdata[4:]), fqdn(name))
+			}
+		}
+	case TypeSOA:
+		soa, err := parseSOA(rdata)
+		if err == nil {
+			return fmt.Sprintf("%s %s %d %d %d %d %d", fqdn(soa.MNAME), fqdn(soa.RNAME), soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minimum)
+		}
+	case TypeTXT, TypeHINFO:
+		var texts []string
+		for position := 0; position < len(rdata); {
+			length := int(rdata[position])
+			if position+1+length > len(rdata) {
+				return generic
+			}
+			texts = append(texts, quoteCharacterString(rdata[position+1:position+1+length]))
+			position += 1 + length
+		}
+		return strings.Join(texts, " ")
+	}
+	return generic
+}
+
+func recordToString(record DNSAnswer) string {
+	return fmt.Sprintf("%s %d %s %s %s", fqdn(record.ANAME), record.TTL, classToString(record.ACLASS), typeToString(record.ATYPE), rdataToString(record.ATYPE, record.RDATA))
+}
+
+type SOA struct {
+	MNAME   string // Primary name server
+	RNAME   string // Responsible mailbox
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32 // Negative caching TTL
+}
+
+func parseSOA(rdata []byte) (SOA, error) {
+	var soa SOA
+	mname, position, err := parseQNAME(rdata, 0, nil)
+	if err != nil {
+		return SOA{}, err
+	}
+	rname, position, err := parseQNAME(rdata, position, nil)
+	if err != nil {
+		return SOA{}, err
+	}
+	if int(position)+20 != len(rdata) {
+		return SOA{}, fmt.Errorf("invalid SOA RDATA length")
+	}
+	soa.MNAME = mname
+	soa.RNAME = rname
+	soa.Serial = binary.BigEndian.Uint32(rdata[position:])
+	soa.Refresh = binary.BigEndian.Uint32(rdata[position+4:])
+	soa.Retry = binary.BigEndian.Uint32(rdata[position+8:])
+	soa.Expire = binary.BigEndian.Uint32(rdata[position+12:])
+	soa.Minimum = binary.BigEndian.Uint32(rdata[position+16:])
+	return soa, nil
+}
+
+func (soa SOA) rdata() []byte {
+	rdata := new(bytes.Buffer)
+	rdata.Write(encodeName(soa.MNAME))
+	rdata.Write(encodeName(soa.RNAME))
+	binary.Write(rdata, binary.BigEndian, []uint32{soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minimum})
+	return rdata.Bytes()
+}
+
+// rdataName returns the domain name carried by NS, CNAME, PTR and DNAME
+// records, or the exchange/target of MX and SRV records.
+func rdataName(record DNSAnswer) string {
+	var position uint
+	switch record.ATYPE {
+	case TypeNS, TypeCNAME, TypePTR, TypeDNAME:
+	case TypeMX:
+		position = 2
+	case TypeSRV:
+		position = 6
+	default:
+		return ""
+	}
+	if position >= uint(len(record.RDATA)) {
+		return ""
+	}
+	name, _, err := parseQNAME(record.RDATA, position, nil)
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+func quoteCharacterString(text []byte) string {
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for _, c := range text {
+		switch {
+		case c == '"' || c == '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&quoted, "\\%03d", c)
+		default:
+			quoted.WriteByte(c)
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
@@ -0,0 +1,183 @@
+package mydns
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+type rewriteRule struct {
+	match    string // canonical name, or a wildcard such as *.example.com
+	types    map[uint16]bool
+	rename   string
+	ttl      *uint32
+	strip    map[uint16]bool
+	rcode    uint16
+	hasRcode bool
+}
+
+func parseRewriteRules(configs []RewriteConfig) ([]rewriteRule, error) {
+	var rules []rewriteRule
+	for i, config := range configs {
+		rule := rewriteRule{
+			match:  canonicalName(config.Match),
+			rename: canonicalName(config.Rename),
+			ttl:    config.TTL,
+		}
+		if rule.match == "" {
+			return nil, fmt.Errorf("[Rewrite Error] rule %d has nothing to match", i+1)
+		}
+		if strings.Contains(rule.match[1:], "*") || (strings.HasPrefix(rule.match, "*") && rule.match != "*" && !strings.HasPrefix(rule.match, "*.")) {
+			return nil, fmt.Errorf("[Rewrite Error] rule %d: %s is not a name or a wildcard", i+1, config.Match)
+		}
+		if strings.Contains(rule.rename, "*") && (!strings.HasPrefix(rule.match, "*") || !strings.HasPrefix(rule.rename, "*.") || strings.Contains(rule.rename[1:], "*")) {
+			return nil, fmt.Errorf("[Rewrite Error] rule %d: %s can only rename a wildcard to a wildcard", i+1, config.Rename)
+		}
+
+		var err error
+		if rule.types, err = parseTypeSet(config.Types); err != nil {
+			return nil, fmt.Errorf("[Rewrite Error] rule %d: %w", i+1, err)
+		}
+		if rule.strip, err = parseTypeSet(config.Strip); err != nil {
+			return nil, fmt.Errorf("[Rewrite Error] rule %d: %w", i+1, err)
+		}
+		if config.Rcode != "" {
+			if rule.rcode, rule.hasRcode = parseRcode(config.Rcode); !rule.hasRcode {
+				return nil, fmt.Errorf("[Rewrite Error] rule %d: unknown RCODE %s", i+1, config.Rcode)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseTypeSet(names []string) (map[uint16]bool, error) {
+	types := make(map[uint16]bool)
+	for _, name := range names {
+		rrtype, ok := parseType(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown type %s", name)
+		}
+		types[rrtype] = true
+	}
+	return types, nil
+}
+
+// matches reports whether a rule applies to a question, and returns the
+// part of the name matched by the rule's wildcard. "*" matches every name,
+// and *.example.com every name below example.com.
+func (r rewriteRule) matches(question DNSQuestion) (string, bool) {
+	if len(r.types) > 0 && !r.types[question.QTYPE] {
+		return "", false
+	}
+	name := canonicalName(question.QNAME)
+	suffix, isWildcard := strings.CutPrefix(r.match, "*")
+	if !isWildcard {
+		return "", name == r.match
+	}
+	if suffix == "" {
+		return name, name != ""
+	}
+	if len(name) > len(suffix) && strings.HasSuffix(name, suffix) {
+		return name[:len(name)-len(suffix)], true
+	}
+	return "", false
+}
+
+// rewritePlan combines every rule that matches a question. The first
+// rename and RCODE win, the last TTL wins, and stripped types add up.
+type rewritePlan struct {
+	rename   string
+	ttl      *uint32
+	strip    map[uint16]bool
+	rcode    uint16
+	hasRcode bool
+}
+
+func (s *DNSServer) planRewrite(question DNSQuestion) (rewritePlan, bool) {
+	plan := rewritePlan{strip: make(map[uint16]bool)}
+	matched := false
+	for _, rule := range s.rewrites {
+		wildcard, ok := rule.matches(question)
+		if !ok {
+			continue
+		}
+		matched = true
+		if plan.rename == "" && rule.rename != "" {
+			plan.rename = rule.rename
+			if suffix, isWildcard := strings.CutPrefix(rule.rename, "*"); isWildcard {
+				plan.rename = wildcard + suffix
+			}
+		}
+		if !plan.hasRcode && rule.hasRcode {
+			plan.rcode, plan.hasRcode = rule.rcode, true
+		}
+		if rule.ttl != nil {
+			plan.ttl = rule.ttl
+		}
+		for rrtype := range rule.strip {
+			plan.strip[rrtype] = true
+		}
+	}
+	return plan, matched
+}
+
+// forwardWithRewrites applies the rewrite rules around forwarding. On the
+// way out a query may be answered with an RCODE or renamed, and on the way
+// back the response is renamed to what the client asked for, stripped of
+// unwanted types and given new TTLs.
+func (s *DNSServer) forwardWithRewrites(view *View, packet []byte, message DNSMessage, source net.Addr, respond func([]byte), trace *queryTrace) {
+	if len(s.rewrites) == 0 || len(message.Questions) != 1 || message.Header.getOpcode() != OpcodeQuery {
+		s.forwardWithPolicy(view, packet, message, source, respond, trace)
+		return
+	}
+	question := message.Questions[0]
+	plan, matched := s.planRewrite(question)
+	if !matched {
+		s.forwardWithPolicy(view, packet, message, source, respond, trace)
+		return
+	}
+
+	if plan.hasRcode {
+		slog.Debug("Answered a query by a rewrite rule", "qname", question.QNAME, "rcode", rcodeToString(plan.rcode))
+		respond(errorResponse(message, plan.rcode, EDEBlocked, "answered by a rewrite rule"))
+		return
+	}
+	if plan.rename != "" {
+		slog.Debug("Rewrote a query", "qname", question.QNAME, "rename", plan.rename)
+		message.Questions = []DNSQuestion{{QNAME: plan.rename, QTYPE: question.QTYPE, QCLASS: question.QCLASS}}
+		packet = PackDNSMessage(message)
+	}
+
+	s.forwardWithPolicy(view, packet, message, source, func(response []byte) {
+		respond(plan.apply(response, question))
+	}, trace)
+}
+
+func (p rewritePlan) apply(packet []byte, question DNSQuestion) []byte {
+	response, err := ParseDNSMessage(packet)
+	if err != nil {
+		return packet
+	}
+	if p.rename != "" && len(response.Questions) == 1 {
+		response.Questions = []DNSQuestion{question}
+	}
+	for _, section := range []*[]DNSAnswer{&response.Answers, &response.Authorities, &response.Additionals} {
+		var kept []DNSAnswer
+		for _, record := range *section {
+			if p.strip[record.ATYPE] {
+				continue
+			}
+			if p.rename != "" && canonicalName(record.ANAME) == p.rename {
+				record.ANAME = question.QNAME
+			}
+			if p.ttl != nil && record.ATYPE != TypeOPT {
+				record.TTL = *p.ttl
+			}
+			kept = append(kept, record)
+		}
+		*section = kept
+	}
+	return PackDNSMessage(response)
+}
@@ -0,0 +1,585 @@
+package mydns
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const rpzFilePollInterval = 5 * time.Second
+
+type rpzAction int
+
+const (
+	rpzLocalData rpzAction = iota
+	rpzNXDomain
+	rpzNoData
+	rpzPassthru
+	rpzDrop
+	rpzTCPOnly
+)
+
+// rpzRule is the policy at one trigger. The action is chosen by a CNAME
+// to one of the special targets, and any other records at the trigger are
+// local data to answer with instead.
+type rpzRule struct {
+	action  rpzAction
+	records []DNSAnswer
+}
+
+type rpzAddressRule struct {
+	network *net.IPNet
+	rule    *rpzRule
+}
+
+// rpzTriggers are the policies of one zone, sorted by the kind of trigger.
+// Owners are relative to the policy zone's origin, so a QNAME trigger for
+// ads.example.com in rpz.local is ads.example.com.rpz.local.
+type rpzTriggers struct {
+	qnames   map[string]*rpzRule // the query name, or a name in its CNAME chain
+	nsdnames map[string]*rpzRule // <name>.rpz-nsdname, a name server of the domain
+	ips      []rpzAddressRule    // <prefix>.<reversed address>.rpz-ip, an address in the answer
+	nsips    []rpzAddressRule    // <prefix>.<reversed address>.rpz-nsip, a name server address
+	soa      []DNSAnswer         // the zone's SOA, for the authority section of NXDOMAIN and NODATA
+}
+
+// needAnswer reports whether any of the triggers can only be matched
+// against the resolver's answer, which QNAME triggers can through CNAMEs.
+func (t *rpzTriggers) needAnswer() bool {
+	return len(t.qnames) > 0 || len(t.nsdnames) > 0 || len(t.ips) > 0 || len(t.nsips) > 0
+}
+
+func buildTriggers(origin string, records map[string][]DNSAnswer) *rpzTriggers {
+	triggers := &rpzTriggers{qnames: make(map[string]*rpzRule), nsdnames: make(map[string]*rpzRule)}
+	for owner, rrs := range records {
+		if owner == origin {
+			continue
+		}
+		relative := strings.TrimSuffix(owner, "."+origin)
+		rule := policyRule(rrs)
+
+		if address, isIP := strings.CutSuffix(relative, ".rpz-ip"); isIP {
+			network, err := parseRPZAddress(address)
+			if err != nil {
+				slog.Warn("Skipped an invalid policy", "owner", owner, "err", err)
+				continue
+			}
+			triggers.ips = append(triggers.ips, rpzAddressRule{network, rule})
+		} else if address, isNSIP := strings.CutSuffix(relative, ".rpz-nsip"); isNSIP {
+			network, err := parseRPZAddress(address)
+			if err != nil {
+				slog.Warn("Skipped an invalid policy", "owner", owner, "err", err)
+				continue
+			}
+			triggers.nsips = append(triggers.nsips, rpzAddressRule{network, rule})
+		} else if name, isNSDNAME := strings.CutSuffix(relative, ".rpz-nsdname"); isNSDNAME {
+			triggers.nsdnames[name] = rule
+		} else if strings.HasSuffix(relative, ".rpz-client-ip") {
+			slog.Warn("Skipped a client IP trigger, which is not supported", "owner", owner)
+		} else {
+			triggers.qnames[relative] = rule
+		}
+	}
+	return triggers
+}
+
+// policyRule reads the action from the records at a trigger:
+//
+//	CNAME .              NXDOMAIN
+//	CNAME *.             NODATA
+//	CNAME rpz-passthru.  answer as if there were no policy
+//	CNAME rpz-drop.      do not respond at all
+//	CNAME rpz-tcp-only.  truncate UDP responses so the client retries over TCP
+//	anything else        answer with these records
+func policyRule(records []DNSAnswer) *rpzRule {
+	for _, record := range records {
+		if record.ATYPE != TypeCNAME {
+			continue
+		}
+		switch canonicalName(rdataName(record)) {
+		case "":
+			return &rpzRule{action: rpzNXDomain}
+		case "*":
+			return &rpzRule{action: rpzNoData}
+		case "rpz-passthru":
+			return &rpzRule{action: rpzPassthru}
+		case "rpz-drop":
+			return &rpzRule{action: rpzDrop}
+		case "rpz-tcp-only":
+			return &rpzRule{action: rpzTCPOnly}
+		}
+	}
+	return &rpzRule{action: rpzLocalData, records: records}
+}
+
+// parseRPZAddress parses the owner of an IP trigger, which is the prefix
+// length followed by the address with its labels reversed. IPv6 addresses
+// use "zz" for the run of zeros that "::" stands for, so 2001:db8::1/128
+// is 128.1.zz.db8.2001.
+func parseRPZAddress(name string) (*net.IPNet, error) {
+	labels := strings.Split(name, ".")
+	prefix, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix length %q", labels[0])
+	}
+	parts := labels[1:]
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+
+	var ip net.IP
+	bits := 32
+	if len(parts) == 4 {
+		ip = net.ParseIP(strings.Join(parts, ".")).To4()
+	} else {
+		bits = 128
+		for i, part := range parts {
+			if part != "zz" {
+				continue
+			}
+			parts[i] = ""
+			if i == 0 || i == len(parts)-1 {
+				parts[i] = ":"
+			}
+		}
+		ip = net.ParseIP(strings.Join(parts, ":"))
+	}
+	if ip == nil || prefix < 1 || prefix > bits {
+		return nil, fmt.Errorf("invalid address trigger %q", name)
+	}
+	mask := net.CIDRMask(prefix, bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+// matchName finds the rule for a name, preferring an exact match and then
+// the wildcard closest to the name. A wildcard such as *.example.com only
+// matches names below example.com, not example.com itself.
+func matchName(rules map[string]*rpzRule, name string) (*rpzRule, string) {
+	name = canonicalName(name)
+	if rule, exists := rules[name]; exists {
+		return rule, name
+	}
+	for ancestor := parentName(name); ; ancestor = parentName(ancestor) {
+		wildcard := "*." + ancestor
+		if ancestor == "" {
+			wildcard = "*"
+		}
+		if rule, exists := rules[wildcard]; exists {
+			return rule, wildcard
+		}
+		if ancestor == "" {
+			return nil, ""
+		}
+	}
+}
+
+// matchAddress finds the rule with the longest prefix containing ip.
+func matchAddress(rules []rpzAddressRule, ip net.IP) (*rpzRule, *net.IPNet) {
+	var best *rpzAddressRule
+	bestLength := -1
+	for i := range rules {
+		if !rules[i].network.Contains(ip) {
+			continue
+		}
+		if length, _ := rules[i].network.Mask.Size(); length > bestLength {
+			best = &rules[i]
+			bestLength = length
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	return best.rule, best.network
+}
+
+// PolicyZone is a response policy zone (RPZ), reloaded when its file
+// changes or its serial on the primary server increases.
+type PolicyZone struct {
+	config     RPZConfig
+	origin     string
+	key        *TSIGKey
+	refresh    time.Duration
+	mu         sync.RWMutex
+	triggers   *rpzTriggers
+	serial     uint32
+	soaRefresh uint32
+	modTime    time.Time
+	disabled   atomic.Bool // turned off through the admin API
+}
+
+func NewPolicyZone(config RPZConfig, keys map[string]*TSIGKey) (*PolicyZone, error) {
+	if (config.File == "") == (config.Primary == "") {
+		return nil, fmt.Errorf("[RPZ Error] policy zone %s needs either a file or a primary", config.Name)
+	}
+	policy := &PolicyZone{config: config, origin: canonicalName(config.Name)}
+	if config.Key != "" {
+		key, exists := keys[canonicalName(config.Key)]
+		if !exists {
+			return nil, fmt.Errorf("[RPZ Error] policy zone %s uses unknown key %s", config.Name, config.Key)
+		}
+		policy.key = key
+	}
+	if err := policy.load(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case config.Refresh != "":
+		refresh, err := time.ParseDuration(config.Refresh)
+		if err != nil || refresh <= 0 {
+			return nil, fmt.Errorf("[RPZ Error] invalid refresh interval %q", config.Refresh)
+		}
+		policy.refresh = refresh
+	case config.File != "":
+		policy.refresh = rpzFilePollInterval
+	default:
+		policy.refresh = time.Duration(max(policy.soaRefresh, 60)) * time.Second
+	}
+	return policy, nil
+}
+
+func (p *PolicyZone) load() error {
+	var records []DNSAnswer
+	var modTime time.Time
+	var err error
+	if p.config.File != "" {
+		modTime = fileModTime(p.config.File)
+		records, err = LoadZoneFile(p.config.File, p.origin)
+	} else {
+		records, err = transferZone(p.config.Primary, p.origin, p.key)
+	}
+	if err != nil {
+		return err
+	}
+
+	zone, err := NewZone(p.origin, records)
+	if err != nil {
+		return err
+	}
+	soa, _ := zone.soa()
+	parsed, err := parseSOA(soa.RDATA)
+	if err != nil {
+		return fmt.Errorf("[RPZ Error] %w", err)
+	}
+	triggers := buildTriggers(zone.Origin, zone.records)
+	triggers.soa = zone.negativeSOA()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.triggers = triggers
+	p.serial = parsed.Serial
+	p.soaRefresh = parsed.Refresh
+	p.modTime = modTime
+	slog.Info("Loaded a response policy zone", "zone", fqdn(p.origin), "serial", parsed.Serial)
+	return nil
+}
+
+func (p *PolicyZone) current() *rpzTriggers {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.triggers
+}
+
+// watch reloads the zone whenever the file or the primary has a new
+// version of it.
+func (p *PolicyZone) watch() {
+	for range time.Tick(p.refresh) {
+		if !p.changed() {
+			continue
+		}
+		if err := p.load(); err != nil {
+			slog.Error("Failed to reload a response policy zone", "zone", fqdn(p.origin), "err", err)
+		}
+	}
+}
+
+func (p *PolicyZone) changed() bool {
+	p.mu.RLock()
+	serial, modTime := p.serial, p.modTime
+	p.mu.RUnlock()
+
+	if p.config.File != "" {
+		return !fileModTime(p.config.File).Equal(modTime)
+	}
+	primarySerial, err := primarySerial(p.config.Primary, p.origin)
+	if err != nil {
+		slog.Warn("Failed to check a response policy zone for changes", "zone", fqdn(p.origin), "err", err)
+		return false
+	}
+	return serialGreater(primarySerial, serial)
+}
+
+// rpzHit is a policy that matched a query.
+type rpzHit struct {
+	zone    string
+	trigger string
+	rule    *rpzRule
+	soa     []DNSAnswer
+}
+
+// forwardWithPolicy forwards a query and rewrites the answer according to
+// the response policy zones, checking every trigger of a zone before moving
+// on to the next zone in priority order. A QNAME trigger for the query name
+// is applied before forwarding, so the upstream never sees a rewritten
+// name, unless a zone of higher priority has triggers that need the answer.
+func (s *DNSServer) forwardWithPolicy(view *View, packet []byte, message DNSMessage, source net.Addr, respond func([]byte), trace *queryTrace) {
+	if len(s.policies) == 0 || len(message.Questions) != 1 || message.Header.getOpcode() != OpcodeQuery {
+		response, err := view.forward(packet, trace)
+		if err != nil {
+			response = forwardFailure(message, err)
+		}
+		respond(response)
+		return
+	}
+	question := message.Questions[0]
+
+	hit, decided := s.qnamePolicy(question.QNAME)
+	if decided {
+		if response, handled := s.policyResponse(view, message, source, hit); handled {
+			if response != nil {
+				respond(response)
+			}
+			return
+		}
+	}
+
+	response, err := view.forward(packet, trace)
+	if err != nil {
+		// Without an answer only the query name can match, so a QNAME
+		// trigger waiting on the zones ahead of it still applies
+		if hit != nil {
+			if rewritten, handled := s.policyResponse(view, message, source, hit); handled {
+				if rewritten != nil {
+					respond(rewritten)
+				}
+				return
+			}
+		}
+		respond(forwardFailure(message, err))
+		return
+	}
+	if !decided {
+		if answer, err := ParseDNSMessage(response); err == nil {
+			hit = s.responsePolicy(view, question.QNAME, answer)
+		}
+	}
+	if hit != nil {
+		if rewritten, handled := s.policyResponse(view, message, source, hit); handled {
+			if rewritten != nil {
+				respond(rewritten)
+			}
+			return
+		}
+	}
+	respond(response)
+}
+
+// qnamePolicy finds the first zone with a QNAME trigger for the query
+// name. It reports whether that hit decides the query on its own, which it
+// does when no zone ahead of it has triggers that need the answer.
+func (s *DNSServer) qnamePolicy(qname string) (*rpzHit, bool) {
+	needAnswer := false
+	for _, policy := range s.policies {
+		if policy.disabled.Load() {
+			continue
+		}
+		triggers := policy.current()
+		if rule, owner := matchName(triggers.qnames, qname); rule != nil {
+			return &rpzHit{zone: policy.origin, trigger: "QNAME " + owner, rule: rule, soa: triggers.soa}, !needAnswer
+		}
+		needAnswer = needAnswer || triggers.needAnswer()
+	}
+	return nil, false
+}
+
+// responsePolicy checks a query and the resolver's answer against each
+// zone's triggers, in the order QNAME (for the query name and the names
+// its CNAMEs lead to), IP, NSDNAME and NSIP.
+func (s *DNSServer) responsePolicy(view *View, qname string, response DNSMessage) *rpzHit {
+	names := []string{qname}
+	var addresses []net.IP
+	for _, answer := range response.Answers {
+		switch answer.ATYPE {
+		case TypeCNAME:
+			names = append(names, rdataName(answer))
+		case TypeA, TypeAAAA:
+			addresses = append(addresses, net.IP(answer.RDATA))
+		}
+	}
+
+	// The name servers are only looked up if some zone has triggers for them
+	var nameservers []string
+	var nameserverAddresses []net.IP
+	lookedUp := false
+	lookup := func() {
+		if !lookedUp {
+			nameservers, nameserverAddresses = view.nameservers(qname, response)
+			lookedUp = true
+		}
+	}
+
+	for _, policy := range s.policies {
+		if policy.disabled.Load() {
+			continue
+		}
+		triggers := policy.current()
+		hit := func(trigger string, rule *rpzRule) *rpzHit {
+			return &rpzHit{zone: policy.origin, trigger: trigger, rule: rule, soa: triggers.soa}
+		}
+
+		for _, name := range names {
+			if rule, owner := matchName(triggers.qnames, name); rule != nil {
+				return hit("QNAME "+owner, rule)
+			}
+		}
+		for _, address := range addresses {
+			if rule, network := matchAddress(triggers.ips, address); rule != nil {
+				return hit("IP "+network.String(), rule)
+			}
+		}
+		if len(triggers.nsdnames) > 0 || len(triggers.nsips) > 0 {
+			lookup()
+		}
+		for _, nameserver := range nameservers {
+			if rule, owner := matchName(triggers.nsdnames, nameserver); rule != nil {
+				return hit("NSDNAME "+owner, rule)
+			}
+		}
+		for _, address := range nameserverAddresses {
+			if rule, network := matchAddress(triggers.nsips, address); rule != nil {
+				return hit("NSIP "+network.String(), rule)
+			}
+		}
+	}
+	return nil
+}
+
+// nameservers returns the names and addresses of the name servers for the
+// domain of qname. A forwarder never talks to them itself, so they are
+// taken from the authority and additional sections when the upstream
+// includes them, and otherwise looked up through the resolver.
+func (v *View) nameservers(qname string, response DNSMessage) ([]string, []net.IP) {
+	var names []string
+	for _, record := range response.Authorities {
+		if record.ATYPE == TypeNS {
+			names = append(names, rdataName(record))
+		}
+	}
+	for name := canonicalName(qname); len(names) == 0 && name != ""; name = parentName(name) {
+		reply, ok := v.lookupForward(name, TypeNS)
+		if !ok {
+			break
+		}
+		for _, record := range reply.Answers {
+			if record.ATYPE == TypeNS && canonicalName(record.ANAME) == name {
+				names = append(names, rdataName(record))
+			}
+		}
+		response = reply
+	}
+
+	var addresses []net.IP
+	for _, name := range names {
+		glue := false
+		for _, record := range response.Additionals {
+			if (record.ATYPE == TypeA || record.ATYPE == TypeAAAA) && canonicalName(record.ANAME) == canonicalName(name) {
+				addresses = append(addresses, net.IP(record.RDATA))
+				glue = true
+			}
+		}
+		if glue {
+			continue
+		}
+		for _, qtype := range []uint16{TypeA, TypeAAAA} {
+			reply, ok := v.lookupForward(name, qtype)
+			if !ok {
+				continue
+			}
+			for _, record := range reply.Answers {
+				if record.ATYPE == qtype {
+					addresses = append(addresses, net.IP(record.RDATA))
+				}
+			}
+		}
+	}
+	return names, addresses
+}
+
+// policyResponse builds the response a policy calls for. It reports false
+// when the query should be answered as if there were no policy, and
+// returns a nil response when the query should be dropped.
+func (s *DNSServer) policyResponse(view *View, message DNSMessage, source net.Addr, hit *rpzHit) ([]byte, bool) {
+	question := message.Questions[0]
+	response := DNSMessage{Questions: message.Questions}
+
+	switch hit.rule.action {
+	case rpzPassthru:
+		return nil, false
+	case rpzDrop:
+		slog.Debug("Dropped a query by response policy", "zone", fqdn(hit.zone), "qname", question.QNAME, "trigger", hit.trigger)
+		return nil, true
+	case rpzTCPOnly:
+		if _, isTCP := source.(*net.TCPAddr); isTCP {
+			return nil, false
+		}
+		response.Header = buildResponseHeader(message.Header, false, RcodeNoError)
+		response.Header.Flags |= 1 << 9 // TC
+	case rpzNXDomain:
+		response.Header = buildResponseHeader(message.Header, false, RcodeNXDomain)
+		response.Authorities = hit.soa
+		addEDE(&response, EDEBlocked, "blocked by response policy zone "+fqdn(hit.zone))
+	case rpzNoData:
+		response.Header = buildResponseHeader(message.Header, false, RcodeNoError)
+		response.Authorities = hit.soa
+		addEDE(&response, EDEBlocked, "blocked by response policy zone "+fqdn(hit.zone))
+	case rpzLocalData:
+		response.Header = buildResponseHeader(message.Header, false, RcodeNoError)
+		response.Answers = view.localData(hit.rule, question)
+		addEDE(&response, EDEForgedAnswer, "rewritten by response policy zone "+fqdn(hit.zone))
+	}
+	slog.Debug("Rewrote an answer by response policy", "zone", fqdn(hit.zone), "qname", question.QNAME, "trigger", hit.trigger)
+	return PackDNSMessage(response), true
+}
+
+// localData answers from the records at a trigger, under the query name.
+// A CNAME is followed through the resolver, and a CNAME to *.example.com
+// redirects to the query name with example.com appended.
+func (v *View) localData(rule *rpzRule, question DNSQuestion) []DNSAnswer {
+	var answers []DNSAnswer
+	for _, record := range rule.records {
+		if record.ATYPE == question.QTYPE || question.QTYPE == TypeANY {
+			answers = append(answers, record)
+		}
+	}
+
+	target := ""
+	if len(answers) == 0 {
+		for _, record := range rule.records {
+			if record.ATYPE != TypeCNAME {
+				continue
+			}
+			target = rdataName(record)
+			if suffix, isWildcard := strings.CutPrefix(target, "*."); isWildcard {
+				target = question.QNAME + "." + suffix
+				record.RDATA = encodeName(target)
+			}
+			answers = append(answers, record)
+			break
+		}
+	}
+
+	for i := range answers {
+		answers[i].ANAME = question.QNAME
+	}
+	if target != "" {
+		if reply, ok := v.lookupForward(target, question.QTYPE); ok {
+			answers = append(answers, reply.Answers...)
+		}
+	}
+	return answers
+}
@@ -2,92 +2,466 @@ package mydns
 
 import (
 	"fmt"
+	"log/slog"
 	"net"
 	"time"
 )
 
+type DNSServer struct {
+	config    Config
+	views     []*View
+	tsigKeys  map[string]*TSIGKey
+	hosts     *HostsBackend
+	blocklist *Blocklist
+	policies  []*PolicyZone
+	rewrites  []rewriteRule
+	limiter   *RateLimiter
+	cookies   *ServerCookies
+
+	workers       int
+	jobs          chan queryJob
+	clients       *clientLimiter
+	dropOverLimit bool
+	counters      queryCounters
+	metrics       serverMetrics
+	queryLog      *queryLog
+	dnstap        *dnstapWriter
+	upstreams     *upstreamTracker
+	adminToken    string
+	started       time.Time
+}
+
+func NewDNSServer(config Config) (*DNSServer, error) {
+	views, err := loadViews(config)
+	if err != nil {
+		return nil, err
+	}
+	tsigKeys, err := parseTSIGKeys(config.Keys)
+	if err != nil {
+		return nil, err
+	}
+	rewrites, err := parseRewriteRules(config.Rewrites)
+	if err != nil {
+		return nil, err
+	}
+	server := &DNSServer{
+		config:    config,
+		views:     views,
+		tsigKeys:  tsigKeys,
+		rewrites:  rewrites,
+		metrics:   newServerMetrics(),
+		upstreams: newUpstreamTracker(),
+	}
+	for _, view := range views {
+		view.upstreams = server.upstreams
+	}
+	if err := server.setQueryLimits(config.QueryLimits, config.ACLs); err != nil {
+		return nil, err
+	}
+	if !config.Cookies.Disabled {
+		server.cookies, err = NewServerCookies(config.Cookies)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.RateLimit != nil {
+		server.limiter, err = NewRateLimiter(*config.RateLimit, config.ACLs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(config.HostsFiles) > 0 {
+		server.hosts, err = NewHostsBackend(config.HostsFiles)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.Blocklist != nil {
+		server.blocklist, err = NewBlocklist(*config.Blocklist)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, rpzConfig := range config.RPZ {
+		policy, err := NewPolicyZone(rpzConfig, tsigKeys)
+		if err != nil {
+			return nil, err
+		}
+		server.policies = append(server.policies, policy)
+	}
+	if config.Admin != nil {
+		server.adminToken, err = loadAdminToken(*config.Admin)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.QueryLog != nil {
+		server.queryLog, err = newQueryLog(*config.QueryLog)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.Dnstap != nil {
+		server.dnstap, err = newDnstapWriter(*config.Dnstap)
+		if err != nil {
+			return nil, err
+		}
+		for _, view := range views {
+			view.dnstap = server.dnstap
+		}
+	}
+	return server, nil
+}
+
 func StartDNSServer(resolver string) {
+	StartDNSServerWithConfig(Config{Resolver: resolver})
+}
+
+func StartDNSServerWithConfig(config Config) {
+	server, err := NewDNSServer(config)
+	if err != nil {
+		slog.Error("Failed to load the configuration", "err", err)
+		return
+	}
+	server.Serve()
+}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:2053")
+// Serve starts the server on its configured addresses and its background
+// work, and answers queries until the UDP listener fails.
+func (s *DNSServer) Serve() {
+	udpAddr, err := net.ResolveUDPAddr("udp", s.config.listenAddress())
 	if err != nil {
-		fmt.Println("Failed to resolve UDP address:", err)
+		slog.Error("Failed to resolve the listen address", "err", err)
 		return
 	}
 
+	resolver := s.config.Resolver
 	err = testResolver(resolver)
 	if err != nil {
-		fmt.Print("[Failed to connect to resolver at ", resolver, "]\n")
-		fmt.Println(err)
+		slog.Error("Failed to connect to the resolver", "resolver", resolver, "err", err)
+		return
+	}
+
+	tcpListener, err := net.Listen("tcp", s.config.listenAddress())
+	if err != nil {
+		slog.Error("Failed to start the DNS server", "err", err)
 		return
 	}
+	s.started = time.Now()
+	for range s.workers {
+		go s.work()
+	}
+	go s.serveTCP(tcpListener)
+	if s.hosts != nil {
+		go s.hosts.watch()
+	}
+	if s.blocklist != nil {
+		go s.blocklist.watch()
+	}
+	for _, policy := range s.policies {
+		go policy.watch()
+	}
+	if s.cookies != nil {
+		go s.cookies.watch()
+	}
+	for _, view := range s.views {
+		if view.cache != nil && view.cache.file != "" {
+			go view.cache.autosave()
+		}
+	}
+	if s.config.Admin != nil {
+		go s.serveAdmin()
+	}
+	if s.dnstap != nil {
+		go s.dnstap.run()
+	}
+	for _, address := range s.config.AlsoListen {
+		go func() {
+			if err := s.listen(address); err != nil {
+				slog.Error("Failed to listen", "address", address, "err", err)
+			}
+		}()
+	}
 
-	err = listenAndRespond(udpAddr, resolver)
+	err = s.listenAndRespond(udpAddr)
 	if err != nil {
-		fmt.Println("[Failed to start DNS server]")
-		fmt.Println(err)
+		slog.Error("Failed to start the DNS server", "err", err)
 		return
 	}
 }
 
-func listenAndRespond(udpAddr *net.UDPAddr, resolver string) error {
+func (s *DNSServer) setQueryLimits(config QueryLimitConfig, groups map[string][]string) error {
+	s.workers = config.Workers
+	if s.workers <= 0 {
+		s.workers = defaultWorkers
+	}
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	s.jobs = make(chan queryJob, queueSize)
+
+	switch config.Action {
+	case "", "refuse":
+	case "drop":
+		s.dropOverLimit = true
+	default:
+		return fmt.Errorf("[Query Limit Error] unknown action %q, expected refuse or drop", config.Action)
+	}
+	var err error
+	s.clients, err = newClientLimiter(config, groups)
+	return err
+}
+
+// Shutdown saves what has to outlive the server, which is the caches that
+// have files, and closes the query log and the dnstap output.
+func (s *DNSServer) Shutdown() {
+	if s.queryLog != nil {
+		defer s.queryLog.close()
+	}
+	defer s.dnstap.close()
+	for _, view := range s.views {
+		if view.cache != nil && view.cache.file != "" {
+			if err := view.cache.save(); err != nil {
+				slog.Error("Failed to save the cache", "view", view.Name, "err", err)
+			}
+		}
+	}
+}
+
+// listen serves UDP and TCP on an additional address.
+func (s *DNSServer) listen(address string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	tcpListener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	go s.serveTCP(tcpListener)
+	return s.listenAndRespond(udpAddr)
+}
+
+func (s *DNSServer) listenAndRespond(udpAddr *net.UDPAddr) error {
+	resolver := s.config.Resolver
 	udpConn, err := net.ListenUDP("udp", udpAddr)
 	if err != nil {
 		return err
 	}
 	if resolver != "" {
-		fmt.Print("[DNS server that will forward to ", resolver, " listening on ", udpAddr, "]\n")
+		slog.Info("DNS server listening", "address", udpAddr, "resolver", resolver)
 	} else {
-		fmt.Print("[DNS server listening on ", udpAddr, "]\n")
+		slog.Info("DNS server listening", "address", udpAddr)
 	}
 	defer udpConn.Close()
 
-	buf := make([]byte, 512)
+	buf := make([]byte, maxUDPMessageSize)
 	for {
 
 		size, source, err := udpConn.ReadFromUDP(buf)
 		if err != nil {
-			fmt.Println("Error receiving data:", err)
+			slog.Error("Failed to receive a query", "err", err)
 			break
 		}
 		packet := make([]byte, size)
 		copy(packet, buf[:size])
 
-		go func(packet []byte, source *net.UDPAddr) {
-			fmt.Printf("Received %d bytes from %s\n", len(packet), source)
-
-			var response []byte
-			if resolver != "" {
-				fmt.Printf("Forwarding query to resolver: %s\n", resolver)
-				response, err = forwardQueryToResolver(packet, resolver)
-				if err != nil {
-					fmt.Printf("Failed to forward query to resolver: %v\n", err)
-					return
-				}
-			} else {
-
-				recievedMessage, err := ParseDNSMessage(packet)
-				if err != nil {
-					fmt.Printf("Failed to parse DNS query from %s\n", source)
-					fmt.Println(err)
-					return
-				}
-				for _, question := range recievedMessage.Questions {
-					fmt.Printf("Parsed DNS request from %s for %s\n", source, question.QNAME)
-				}
-
-				response = BuildDNSResponse(recievedMessage)
-			}
-			_, err = udpConn.WriteToUDP(response, source)
+		slog.Debug("Received a query", "client", source, "bytes", len(packet))
+		respond := func(response []byte) {
+			_, err := udpConn.WriteToUDP(response, source)
 			if err != nil {
-				fmt.Println("Failed to send response:", err)
+				slog.Warn("Failed to send a response", "client", source, "err", err)
+				return
 			}
-			fmt.Printf("Sent response to %s\n", source)
-		}(packet, source)
+			slog.Debug("Sent a response", "client", source, "bytes", len(response))
+		}
+		if !s.submit(queryJob{packet: packet, local: udpConn.LocalAddr(), source: source, respond: respond}, false) {
+			slog.Debug("Did not handle a query over its limits or with every worker busy", "client", source)
+		}
 	}
 	return nil
 }
 
+// handlePacket passes each response for a packet to respond. Most requests
+// get a single response, zone transfers get several, and some get none.
+// local is the address the packet arrived at, which can choose the view.
+func (s *DNSServer) handlePacket(packet []byte, local net.Addr, source net.Addr, respond func([]byte), trace *queryTrace) {
+	respond = s.countResponses(respond)
+	recievedMessage, err := ParseDNSMessage(packet)
+	if err != nil {
+		slog.Debug("Failed to parse a query", "client", source, "err", err)
+		if response, ok := malformedQueryResponse(packet); ok {
+			s.rateLimited(source, respond)(response)
+		} else {
+			slog.Debug("Dropped an unparseable packet", "client", source)
+			s.counters.unparseable.Add(1)
+		}
+		return
+	}
+	for _, question := range recievedMessage.Questions {
+		slog.Debug("Parsed a query", "client", source, "qname", question.QNAME, "qtype", typeToString(question.QTYPE))
+	}
+
+	opt, err := parseEDNS(recievedMessage)
+	var cookie dnsCookie
+	var hasCookie bool
+	if err == nil {
+		cookie, hasCookie, err = parseCookie(opt)
+	}
+	if err != nil {
+		slog.Debug("Malformed EDNS in a query", "client", source, "err", err)
+		s.rateLimited(source, respond)(PackDNSMessage(DNSMessage{
+			Header:    buildResponseHeader(recievedMessage.Header, false, RcodeFormErr),
+			Questions: recievedMessage.Questions,
+		}))
+		return
+	}
+	validCookie := hasCookie && s.cookies != nil && s.cookies.valid(cookie, addrIP(source), time.Now())
+	if !validCookie {
+		respond = s.rateLimited(source, respond)
+	}
+
+	tsig, tsigError := s.verifyTSIG(packet, recievedMessage)
+	switch tsigError {
+	case RcodeNoError:
+	case RcodeFormErr:
+		respond(PackDNSMessage(DNSMessage{
+			Header:    buildResponseHeader(recievedMessage.Header, false, RcodeFormErr),
+			Questions: recievedMessage.Questions,
+		}))
+		return
+	default:
+		slog.Warn("TSIG verification failed", "client", source, "error", tsigError)
+		respond(tsigErrorResponse(recievedMessage, tsig))
+		return
+	}
+	if tsig != nil {
+		packet, recievedMessage = withoutTSIG(packet, recievedMessage)
+		unsigned := respond
+		respond = func(response []byte) {
+			unsigned(tsig.sign(response))
+		}
+	}
+	respond = withTruncation(respond, opt, source, tsig.size())
+	respond = s.withEDNS(respond, opt, source)
+
+	if opt.present && opt.version > 0 {
+		respond(extendedRcodeResponse(recievedMessage, RcodeBadVers))
+		return
+	}
+	// Clients that have not yet learned a server cookie are told to
+	// retry with the one in the response
+	if _, isUDP := source.(*net.UDPAddr); isUDP && hasCookie && !validCookie && s.cookies != nil && s.cookies.require {
+		slog.Debug("Answered a query without a valid server cookie with BADCOOKIE", "client", source)
+		respond(extendedRcodeResponse(recievedMessage, RcodeBadCookie))
+		return
+	}
+
+	view := s.selectView(local, source, tsig.keyName())
+	s.dispatch(view, packet, recievedMessage, source, tsig.keyName(), respond, trace)
+}
+
+// dispatch routes a verified message to the part of the server handling it.
+func (s *DNSServer) dispatch(view *View, packet []byte, message DNSMessage, source net.Addr, keyName string, respond func([]byte), trace *queryTrace) {
+	trace.inView(view.Name)
+	recursionAvailable := view.recursionAvailable(source, keyName)
+	respond = withRecursionAvailable(respond, recursionAvailable)
+
+	if message.Header.getOpcode() == OpcodeUpdate {
+		respond(view.handleUpdate(message, addrIP(source), keyName))
+		return
+	}
+
+	if message.Header.getOpcode() == OpcodeQuery && !supportedClasses(message) {
+		respond(errorResponse(message, RcodeRefused, EDENotSupported, "only class IN is served"))
+		return
+	}
+
+	if len(message.Questions) == 1 && message.Questions[0].QTYPE == TypeAXFR {
+		view.handleTransfer(message, source, keyName, respond)
+		return
+	}
+
+	if !view.allowQuery.allows(addrIP(source), keyName) {
+		slog.Debug("Refused a client not allowed to query", "client", source, "view", view.Name)
+		respond(errorResponse(message, RcodeRefused, EDEProhibited, "queries are not allowed from this client"))
+		return
+	}
+
+	if response, ok := view.answerFromZones(message); ok {
+		respond(response)
+		return
+	}
+
+	if response, ok := s.answerFromHosts(message); ok {
+		respond(response)
+		return
+	}
+
+	// Clients not allowed recursion only get answers from local data
+	if len(view.forwarders) > 0 && !recursionAvailable {
+		slog.Debug("Refused recursion", "client", source, "view", view.Name)
+		respond(errorResponse(message, RcodeRefused, EDEProhibited, "recursion is not allowed for this client"))
+		return
+	}
+
+	// Local data is answered as configured, and the blocklist filters
+	// everything else before it reaches the resolver.
+	if response, ok := s.answerBlocked(message); ok {
+		respond(response)
+		return
+	}
+
+	if recursionAvailable {
+		s.forwardWithRewrites(view, packet, message, source, respond, trace)
+		return
+	}
+
+	// With data of its own the server only answers for that data, and the
+	// placeholder answers are kept for when it has none at all.
+	if s.hosts != nil || !view.zones.isEmpty() {
+		respond(errorResponse(message, RcodeRefused, EDENotAuthoritative, "not authoritative for the name and not forwarding"))
+		return
+	}
+	respond(BuildDNSResponse(message))
+}
+
+// withRecursionAvailable sets the RA flag of every response, forwarded
+// ones included, to whether the client may have its queries forwarded.
+func withRecursionAvailable(respond func([]byte), available bool) func([]byte) {
+	return func(response []byte) {
+		if len(response) >= 4 {
+			if available {
+				response[3] |= 0x80
+			} else {
+				response[3] &^= 0x80
+			}
+		}
+		respond(response)
+	}
+}
+
+// forwardQueryToResolver sends a query to a resolver with the server's
+// own DNS cookies, retrying once if the resolver asks for a new one.
 func forwardQueryToResolver(query []byte, resolver string) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		withCookie, clientCookie := upstreamCookies.attach(query, resolver)
+		response, err := exchangeUDP(withCookie, resolver)
+		if err != nil || clientCookie == nil {
+			return response, err
+		}
+		badCookie, err := upstreamCookies.learn(response, resolver, clientCookie)
+		if err != nil {
+			return nil, err
+		}
+		if !badCookie || attempt > 0 {
+			return response, nil
+		}
+	}
+}
+
+func exchangeUDP(query []byte, resolver string) ([]byte, error) {
 	conn, err := net.Dial("udp", resolver)
 	if err != nil {
 		return nil, err
@@ -95,17 +469,17 @@ func forwardQueryToResolver(query []byte, resolver string) ([]byte, error) {
 	defer conn.Close()
 
 	timeout := 5 * time.Second
-    err = conn.SetDeadline(time.Now().Add(timeout))
-    if err != nil {
-        return nil, fmt.Errorf("failed to set deadline: %v", err)
-    }
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to set deadline: %v", err)
+	}
 
 	_, err = conn.Write(query)
 	if err != nil {
 		return nil, err
 	}
 
-	response := make([]byte, 512)
+	response := make([]byte, maxUDPMessageSize)
 	n, err := conn.Read(response)
 	if err != nil {
 		return nil, err
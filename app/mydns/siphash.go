@@ -0,0 +1,61 @@
+package mydns
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// sipHash24 is SipHash-2-4 with a 128 bit key, the hash RFC 9018 uses for
+// server cookies.
+func sipHash24(key [16]byte, message []byte) uint64 {
+	k0 := binary.LittleEndian.Uint64(key[:8])
+	k1 := binary.LittleEndian.Uint64(key[8:])
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	length := len(message)
+	for len(message) >= 8 {
+		m := binary.LittleEndian.Uint64(message)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+		message = message[8:]
+	}
+
+	// The last block holds the remaining bytes and the length of the
+	// message in its top byte
+	var last [8]byte
+	copy(last[:], message)
+	last[7] = byte(length)
+	m := binary.LittleEndian.Uint64(last[:])
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+
+	v2 ^= 0xff
+	for range 4 {
+		round()
+	}
+	return v0 ^ v1 ^ v2 ^ v3
+}
@@ -0,0 +1,80 @@
+package mydns
+
+import (
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+const tcpIdleTimeout = 10 * time.Second
+
+// serveTCP accepts DNS over TCP (RFC 7766), where each message is prefixed
+// with its length as a 2-byte integer.
+func (s *DNSServer) serveTCP(listener net.Listener) {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			slog.Error("Failed to accept a TCP connection", "err", err)
+			return
+		}
+		go s.handleTCPConnection(conn)
+	}
+}
+
+func (s *DNSServer) handleTCPConnection(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+
+		packet, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		slog.Debug("Received a query over TCP", "client", conn.RemoteAddr(), "bytes", len(packet))
+
+		// Messages on a connection are answered in order, each waiting
+		// for a worker
+		done := make(chan struct{})
+		queued := s.submit(queryJob{packet: packet, local: conn.LocalAddr(), source: conn.RemoteAddr(), done: done, respond: func(response []byte) {
+			if err := writeTCPMessage(conn, response); err != nil {
+				slog.Warn("Failed to send a response", "client", conn.RemoteAddr(), "err", err)
+			}
+		}}, true)
+		if queued {
+			<-done
+		}
+	}
+}
+
+func readTCPMessage(conn net.Conn) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(conn, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+func writeTCPMessage(conn net.Conn, message []byte) error {
+	framed := make([]byte, 2+len(message))
+	binary.BigEndian.PutUint16(framed, uint16(len(message)))
+	copy(framed[2:], message)
+	_, err := conn.Write(framed)
+	return err
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
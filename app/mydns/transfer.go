@@ -0,0 +1,146 @@
+package mydns
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+const (
+	transferRecordsPerMessage = 100
+	transferTimeout           = 30 * time.Second
+)
+
+// handleTransfer serves a full zone transfer (RFC 5936) over TCP. The zone
+// is sent as a sequence of messages that starts and ends with the SOA, and
+// each message is passed to respond separately so TSIG can sign them in
+// turn.
+func (v *View) handleTransfer(message DNSMessage, source net.Addr, keyName string, respond func([]byte)) {
+	question := message.Questions[0]
+	zone := v.zones.zone(question.QNAME)
+	if zone == nil {
+		respond(errorResponse(message, RcodeNotAuth, EDENotAuthoritative, "not authoritative for "+fqdn(question.QNAME)))
+		return
+	}
+	if _, isTCP := source.(*net.TCPAddr); !isTCP {
+		respond(errorResponse(message, RcodeRefused, EDENotSupported, "zone transfers are only served over TCP"))
+		return
+	}
+	if !zone.allowTransfer.allows(addrIP(source), keyName) {
+		slog.Warn("Refused a zone transfer", "zone", fqdn(zone.Origin), "client", source)
+		respond(errorResponse(message, RcodeRefused, EDEProhibited, "zone transfers are not allowed for this client"))
+		return
+	}
+
+	records := zone.allRecords()
+	records = append(records, records[0])
+	slog.Info("Transferring a zone", "zone", fqdn(zone.Origin), "client", source, "records", len(records))
+
+	for start := 0; start < len(records); start += transferRecordsPerMessage {
+		end := min(start+transferRecordsPerMessage, len(records))
+		response := DNSMessage{
+			Header:  buildResponseHeader(message.Header, true, RcodeNoError),
+			Answers: records[start:end],
+		}
+		if start == 0 {
+			response.Questions = message.Questions
+		}
+		respond(PackDNSMessage(response))
+	}
+}
+
+// transferZone fetches a zone from a primary server with AXFR over TCP,
+// signing the request with key when one is given. It returns the records
+// of the zone with the SOA first and without the closing SOA.
+func transferZone(primary string, origin string, key *TSIGKey) ([]DNSAnswer, error) {
+	conn, err := net.DialTimeout("tcp", primary, transferTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("[Transfer Error] %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(transferTimeout))
+
+	id := uint16(rand.Uint32())
+	request := PackDNSMessage(DNSMessage{
+		Header:    DNSHeader{ID: id},
+		Questions: []DNSQuestion{{QNAME: origin, QTYPE: TypeAXFR, QCLASS: ClassIN}},
+	})
+	var tsig *tsigContext
+	if key != nil {
+		request, tsig = key.signRequest(request)
+	}
+	if err := writeTCPMessage(conn, request); err != nil {
+		return nil, fmt.Errorf("[Transfer Error] %w", err)
+	}
+
+	var records []DNSAnswer
+	for {
+		packet, err := readTCPMessage(conn)
+		if err != nil {
+			return nil, fmt.Errorf("[Transfer Error] %s from %s: %w", fqdn(origin), primary, err)
+		}
+		message, err := ParseDNSMessage(packet)
+		if err != nil {
+			return nil, fmt.Errorf("[Transfer Error] %w", err)
+		}
+		if message.Header.ID != id {
+			return nil, fmt.Errorf("[Transfer Error] response ID %d does not match the request", message.Header.ID)
+		}
+		if rcode := message.Header.getRcode(); rcode != RcodeNoError {
+			return nil, fmt.Errorf("[Transfer Error] %s refused the transfer of %s with RCODE %d", primary, fqdn(origin), rcode)
+		}
+		signed := false
+		if tsig != nil {
+			if signed, err = tsig.verifyResponse(packet); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, record := range message.Answers {
+			isSOA := record.ATYPE == TypeSOA && canonicalName(record.ANAME) == canonicalName(origin)
+			if len(records) == 0 && !isSOA {
+				return nil, fmt.Errorf("[Transfer Error] the transfer of %s does not start with its SOA", fqdn(origin))
+			}
+			if len(records) > 0 && isSOA {
+				if tsig != nil && !signed {
+					return nil, fmt.Errorf("[TSIG Error] the last message of the transfer is not signed")
+				}
+				return records, nil
+			}
+			records = append(records, record)
+		}
+	}
+}
+
+// primarySerial asks a primary server for the serial of a zone, so the
+// zone is only transferred again when it has changed.
+func primarySerial(primary string, origin string) (uint32, error) {
+	id := uint16(rand.Uint32())
+	query := PackDNSMessage(DNSMessage{
+		Header:    DNSHeader{ID: id},
+		Questions: []DNSQuestion{{QNAME: origin, QTYPE: TypeSOA, QCLASS: ClassIN}},
+	})
+	response, err := forwardQueryToResolver(query, primary)
+	if err != nil {
+		return 0, fmt.Errorf("[Transfer Error] %w", err)
+	}
+	message, err := ParseDNSMessage(response)
+	if err != nil {
+		return 0, fmt.Errorf("[Transfer Error] %w", err)
+	}
+	if message.Header.ID != id {
+		return 0, fmt.Errorf("[Transfer Error] response ID %d does not match the request", message.Header.ID)
+	}
+	for _, answer := range message.Answers {
+		if answer.ATYPE == TypeSOA && canonicalName(answer.ANAME) == canonicalName(origin) {
+			soa, err := parseSOA(answer.RDATA)
+			if err != nil {
+				return 0, fmt.Errorf("[Transfer Error] %w", err)
+			}
+			return soa.Serial, nil
+		}
+	}
+	return 0, fmt.Errorf("[Transfer Error] %s did not return the SOA of %s", primary, fqdn(origin))
+}
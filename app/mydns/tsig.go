@@ -0,0 +1,443 @@
+package mydns
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+const (
+	TypeTSIG uint16 = 250
+
+	// TSIG error codes, carried in the TSIG record of a NOTAUTH response
+	RcodeBadSig   uint16 = 16
+	RcodeBadKey   uint16 = 17
+	RcodeBadTime  uint16 = 18
+	RcodeBadTrunc uint16 = 22
+
+	defaultTSIGFudge = 300
+)
+
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha256": sha256.New,
+	"hmac-sha384": sha512.New384,
+	"hmac-sha512": sha512.New,
+}
+
+type TSIGKey struct {
+	Name      string
+	Algorithm string
+	secret    []byte
+	hash      func() hash.Hash
+}
+
+func parseTSIGKeys(configs []KeyConfig) (map[string]*TSIGKey, error) {
+	keys := make(map[string]*TSIGKey)
+	for _, config := range configs {
+		algorithm := canonicalName(config.Algorithm)
+		if algorithm == "" {
+			algorithm = "hmac-sha256"
+		}
+		newHash, supported := tsigAlgorithms[algorithm]
+		if !supported {
+			return nil, fmt.Errorf("[TSIG Error] key %s uses unsupported algorithm %s", config.Name, config.Algorithm)
+		}
+		secret, err := base64.StdEncoding.DecodeString(config.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("[TSIG Error] key %s has an invalid secret: %w", config.Name, err)
+		}
+		name := canonicalName(config.Name)
+		keys[name] = &TSIGKey{Name: name, Algorithm: algorithm, secret: secret, hash: newHash}
+	}
+	return keys, nil
+}
+
+func (k *TSIGKey) mac(data []byte) []byte {
+	h := hmac.New(k.hash, k.secret)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// TSIG holds the fields of a TSIG record's RDATA (RFC 8945 section 4.2).
+type TSIG struct {
+	Algorithm  string
+	TimeSigned uint64 // 48 bit seconds since the epoch
+	Fudge      uint16
+	MAC        []byte
+	OriginalID uint16
+	Error      uint16
+	OtherData  []byte
+}
+
+func parseTSIG(rdata []byte) (TSIG, error) {
+	var tsig TSIG
+	algorithm, position, err := parseQNAME(rdata, 0, nil)
+	if err != nil {
+		return TSIG{}, err
+	}
+	tsig.Algorithm = canonicalName(algorithm)
+
+	read := func(length uint) ([]byte, error) {
+		if position+length > uint(len(rdata)) {
+			return nil, fmt.Errorf("TSIG RDATA too short")
+		}
+		field := rdata[position : position+length]
+		position += length
+		return field, nil
+	}
+
+	timers, err := read(8)
+	if err != nil {
+		return TSIG{}, err
+	}
+	tsig.TimeSigned = uint64(binary.BigEndian.Uint16(timers))<<32 | uint64(binary.BigEndian.Uint32(timers[2:]))
+	tsig.Fudge = binary.BigEndian.Uint16(timers[6:])
+
+	macSize, err := read(2)
+	if err != nil {
+		return TSIG{}, err
+	}
+	if tsig.MAC, err = read(uint(binary.BigEndian.Uint16(macSize))); err != nil {
+		return TSIG{}, err
+	}
+
+	fields, err := read(6)
+	if err != nil {
+		return TSIG{}, err
+	}
+	tsig.OriginalID = binary.BigEndian.Uint16(fields)
+	tsig.Error = binary.BigEndian.Uint16(fields[2:])
+	if tsig.OtherData, err = read(uint(binary.BigEndian.Uint16(fields[4:]))); err != nil {
+		return TSIG{}, err
+	}
+	if position != uint(len(rdata)) {
+		return TSIG{}, fmt.Errorf("TSIG RDATA has trailing data")
+	}
+	return tsig, nil
+}
+
+func (t TSIG) rdata() []byte {
+	rdata := new(bytes.Buffer)
+	rdata.Write(encodeName(t.Algorithm))
+	rdata.Write(t.timers())
+	binary.Write(rdata, binary.BigEndian, uint16(len(t.MAC)))
+	rdata.Write(t.MAC)
+	binary.Write(rdata, binary.BigEndian, t.OriginalID)
+	binary.Write(rdata, binary.BigEndian, t.Error)
+	binary.Write(rdata, binary.BigEndian, uint16(len(t.OtherData)))
+	rdata.Write(t.OtherData)
+	return rdata.Bytes()
+}
+
+func (t TSIG) timers() []byte {
+	timers := make([]byte, 8)
+	binary.BigEndian.PutUint16(timers, uint16(t.TimeSigned>>32))
+	binary.BigEndian.PutUint32(timers[2:], uint32(t.TimeSigned))
+	binary.BigEndian.PutUint16(timers[6:], t.Fudge)
+	return timers
+}
+
+// variables are the TSIG fields covered by the MAC (RFC 8945 section 4.3.3).
+func (t TSIG) variables(keyName string) []byte {
+	variables := new(bytes.Buffer)
+	variables.Write(encodeName(strings.ToLower(keyName)))
+	binary.Write(variables, binary.BigEndian, ClassANY)
+	binary.Write(variables, binary.BigEndian, uint32(0))
+	variables.Write(encodeName(t.Algorithm))
+	variables.Write(t.timers())
+	binary.Write(variables, binary.BigEndian, t.Error)
+	binary.Write(variables, binary.BigEndian, uint16(len(t.OtherData)))
+	variables.Write(t.OtherData)
+	return variables.Bytes()
+}
+
+// tsigContext tracks a verified request so that the responses to it can be
+// signed, chaining each MAC to the previous one across multi-message
+// responses such as AXFR.
+type tsigContext struct {
+	key      *TSIGKey
+	priorMAC []byte
+	signed   int
+	error    uint16
+	unsigned []byte // responses received since the last signed one
+	skipped  int    // how many responses unsigned holds
+}
+
+func (c *tsigContext) keyName() string {
+	if c == nil || c.error != RcodeNoError {
+		return ""
+	}
+	return c.key.Name
+}
+
+// size is the most that signing adds to a response, which has to be left
+// free when truncating it.
+func (c *tsigContext) size() int {
+	if c == nil {
+		return 0
+	}
+	tsig := TSIG{Algorithm: c.key.Algorithm, MAC: make([]byte, c.key.hash().Size()), OtherData: make([]byte, 6)}
+	return len(encodeName(c.key.Name)) + 10 + len(tsig.rdata())
+}
+
+// verifyTSIG checks the TSIG record of a request. It returns a nil context
+// for unsigned requests, and an error code when the signature is not valid.
+func (s *DNSServer) verifyTSIG(packet []byte, message DNSMessage) (*tsigContext, uint16) {
+	if len(message.Additionals) == 0 {
+		return nil, RcodeNoError
+	}
+	for _, record := range message.Additionals[:len(message.Additionals)-1] {
+		if record.ATYPE == TypeTSIG {
+			return nil, RcodeFormErr
+		}
+	}
+	record := message.Additionals[len(message.Additionals)-1]
+	if record.ATYPE != TypeTSIG {
+		return nil, RcodeNoError
+	}
+	if record.ACLASS != ClassANY || record.TTL != 0 {
+		return nil, RcodeFormErr
+	}
+	tsig, err := parseTSIG(record.RDATA)
+	if err != nil {
+		return nil, RcodeFormErr
+	}
+
+	key, exists := s.tsigKeys[canonicalName(record.ANAME)]
+	if !exists || key.Algorithm != tsig.Algorithm {
+		key = &TSIGKey{Name: canonicalName(record.ANAME), Algorithm: tsig.Algorithm}
+		return &tsigContext{key: key, error: RcodeBadKey}, RcodeBadKey
+	}
+
+	unsigned, err := stripTSIG(packet, tsig.OriginalID)
+	if err != nil {
+		return nil, RcodeFormErr
+	}
+	expected := key.mac(append(unsigned, tsig.variables(record.ANAME)...))
+
+	// Truncated MACs are accepted down to half the digest, and never
+	// below 10 bytes (RFC 8945 section 5.2.2.1).
+	minimum := max(len(expected)/2, 10)
+	if len(tsig.MAC) > len(expected) || len(tsig.MAC) == 0 {
+		return nil, RcodeFormErr
+	}
+	if !hmac.Equal(tsig.MAC, expected[:len(tsig.MAC)]) {
+		return &tsigContext{key: key, error: RcodeBadSig}, RcodeBadSig
+	}
+	if len(tsig.MAC) < minimum {
+		return &tsigContext{key: key, priorMAC: tsig.MAC, error: RcodeBadTrunc}, RcodeBadTrunc
+	}
+
+	context := &tsigContext{key: key, priorMAC: tsig.MAC}
+	now := uint64(time.Now().Unix())
+	if now > tsig.TimeSigned+uint64(tsig.Fudge) || tsig.TimeSigned > now+uint64(tsig.Fudge) {
+		context.error = RcodeBadTime
+		return context, RcodeBadTime
+	}
+	return context, RcodeNoError
+}
+
+// sign appends a TSIG record to a response. The first response to a request
+// covers the request MAC and all TSIG variables, while later messages of a
+// multi-message response cover the prior MAC and the timers only.
+func (c *tsigContext) sign(response []byte) []byte {
+	now := uint64(time.Now().Unix())
+	tsig := TSIG{
+		Algorithm:  c.key.Algorithm,
+		TimeSigned: now,
+		Fudge:      defaultTSIGFudge,
+		OriginalID: binary.BigEndian.Uint16(response),
+		Error:      c.error,
+	}
+
+	switch c.error {
+	case RcodeBadKey, RcodeBadSig:
+		// The request could not be authenticated, so neither can the response
+	default:
+		if c.error == RcodeBadTime {
+			tsig.OtherData = make([]byte, 6)
+			binary.BigEndian.PutUint16(tsig.OtherData, uint16(now>>32))
+			binary.BigEndian.PutUint32(tsig.OtherData[2:], uint32(now))
+		}
+		digest := new(bytes.Buffer)
+		binary.Write(digest, binary.BigEndian, uint16(len(c.priorMAC)))
+		digest.Write(c.priorMAC)
+		digest.Write(response)
+		if c.signed == 0 {
+			digest.Write(tsig.variables(c.key.Name))
+		} else {
+			digest.Write(tsig.timers())
+		}
+		tsig.MAC = c.key.mac(digest.Bytes())
+		c.priorMAC = tsig.MAC
+	}
+	c.signed++
+
+	return appendRecord(response, DNSAnswer{
+		ANAME:  c.key.Name,
+		ATYPE:  TypeTSIG,
+		ACLASS: ClassANY,
+		TTL:    0,
+		RDATA:  tsig.rdata(),
+	})
+}
+
+// signRequest appends a TSIG record to a request sent by the server, such
+// as a zone transfer, and returns a context for verifying the responses.
+func (k *TSIGKey) signRequest(request []byte) ([]byte, *tsigContext) {
+	tsig := TSIG{
+		Algorithm:  k.Algorithm,
+		TimeSigned: uint64(time.Now().Unix()),
+		Fudge:      defaultTSIGFudge,
+		OriginalID: binary.BigEndian.Uint16(request),
+	}
+	tsig.MAC = k.mac(append(append([]byte{}, request...), tsig.variables(k.Name)...))
+
+	signed := appendRecord(request, DNSAnswer{
+		ANAME:  k.Name,
+		ATYPE:  TypeTSIG,
+		ACLASS: ClassANY,
+		TTL:    0,
+		RDATA:  tsig.rdata(),
+	})
+	return signed, &tsigContext{key: k, priorMAC: tsig.MAC}
+}
+
+// verifyResponse checks one response to a signed request and reports
+// whether it carried a TSIG record. The messages of a multi-message
+// response may leave up to 99 in a row unsigned, and those are covered by
+// the next signed one (RFC 8945 section 5.3.1).
+func (c *tsigContext) verifyResponse(packet []byte) (bool, error) {
+	message, err := ParseDNSMessage(packet)
+	if err != nil {
+		return false, err
+	}
+	count := len(message.Additionals)
+	if count == 0 || message.Additionals[count-1].ATYPE != TypeTSIG {
+		if c.signed == 0 {
+			return false, fmt.Errorf("[TSIG Error] the response is not signed")
+		}
+		if c.skipped >= 99 {
+			return false, fmt.Errorf("[TSIG Error] too many unsigned messages in the response")
+		}
+		c.unsigned = append(c.unsigned, packet...)
+		c.skipped++
+		return false, nil
+	}
+
+	record := message.Additionals[count-1]
+	tsig, err := parseTSIG(record.RDATA)
+	if err != nil {
+		return false, fmt.Errorf("[TSIG Error] %w", err)
+	}
+	if canonicalName(record.ANAME) != c.key.Name || tsig.Algorithm != c.key.Algorithm {
+		return false, fmt.Errorf("[TSIG Error] the response is signed with a different key")
+	}
+	if tsig.Error != RcodeNoError {
+		return false, fmt.Errorf("[TSIG Error] the server returned TSIG error %d", tsig.Error)
+	}
+	unsigned, err := stripTSIG(packet, tsig.OriginalID)
+	if err != nil {
+		return false, fmt.Errorf("[TSIG Error] %w", err)
+	}
+
+	digest := new(bytes.Buffer)
+	binary.Write(digest, binary.BigEndian, uint16(len(c.priorMAC)))
+	digest.Write(c.priorMAC)
+	digest.Write(c.unsigned)
+	digest.Write(unsigned)
+	if c.signed == 0 {
+		digest.Write(tsig.variables(record.ANAME))
+	} else {
+		digest.Write(tsig.timers())
+	}
+	expected := c.key.mac(digest.Bytes())
+	if len(tsig.MAC) < max(len(expected)/2, 10) || len(tsig.MAC) > len(expected) || !hmac.Equal(tsig.MAC, expected[:len(tsig.MAC)]) {
+		return false, fmt.Errorf("[TSIG Error] the response has an invalid MAC")
+	}
+	now := uint64(time.Now().Unix())
+	if now > tsig.TimeSigned+uint64(tsig.Fudge) || tsig.TimeSigned > now+uint64(tsig.Fudge) {
+		return false, fmt.Errorf("[TSIG Error] the response was signed outside the fudge window")
+	}
+
+	c.priorMAC = tsig.MAC
+	c.unsigned = nil
+	c.skipped = 0
+	c.signed++
+	return true, nil
+}
+
+// appendRecord adds an uncompressed record to the end of a packed message
+// and increments ARCOUNT.
+func appendRecord(packet []byte, record DNSAnswer) []byte {
+	signed := bytes.NewBuffer(append([]byte{}, packet...))
+	writeRecord(signed, record, map[string]uint{})
+	binary.BigEndian.PutUint16(signed.Bytes()[10:], binary.BigEndian.Uint16(packet[10:])+1)
+	return signed.Bytes()
+}
+
+// stripTSIG returns the packet as it was before the TSIG record was added,
+// with ARCOUNT decremented and the original ID restored.
+func stripTSIG(packet []byte, originalID uint16) ([]byte, error) {
+	offset, err := lastRecordOffset(packet)
+	if err != nil {
+		return nil, err
+	}
+	unsigned := append([]byte{}, packet[:offset]...)
+	binary.BigEndian.PutUint16(unsigned, originalID)
+	binary.BigEndian.PutUint16(unsigned[10:], binary.BigEndian.Uint16(packet[10:])-1)
+	return unsigned, nil
+}
+
+// lastRecordOffset finds where the final record of the additional section
+// starts by walking the sections the same way ParseDNSMessage does.
+func lastRecordOffset(packet []byte) (uint, error) {
+	header, position, err := parseDNSHeader(packet)
+	if err != nil {
+		return 0, err
+	}
+	if header.ARCount == 0 {
+		return 0, fmt.Errorf("message has no additional records")
+	}
+	for i := 0; i < int(header.QDCount); i++ {
+		if _, position, err = parseDNSQuestion(packet, position); err != nil {
+			return 0, err
+		}
+	}
+	records := header.ANCount + header.NSCount + header.ARCount - 1
+	if _, position, err = parseDNSRecords(packet, position, records); err != nil {
+		return 0, err
+	}
+	return position, nil
+}
+
+// withoutTSIG removes a verified TSIG record so the rest of the message can
+// be handled, or forwarded, as if it had never been signed.
+func withoutTSIG(packet []byte, message DNSMessage) ([]byte, DNSMessage) {
+	if len(message.Additionals) == 0 || message.Additionals[len(message.Additionals)-1].ATYPE != TypeTSIG {
+		return packet, message
+	}
+	message.Additionals = message.Additionals[:len(message.Additionals)-1]
+	message.Header.ARCount--
+	if unsigned, err := stripTSIG(packet, message.Header.ID); err == nil {
+		packet = unsigned
+	}
+	return packet, message
+}
+
+// tsigErrorResponse answers a request whose signature could not be
+// verified with NOTAUTH and the TSIG error.
+func tsigErrorResponse(message DNSMessage, context *tsigContext) []byte {
+	response := DNSMessage{
+		Header:    buildResponseHeader(message.Header, false, RcodeNotAuth),
+		Questions: message.Questions,
+	}
+	return context.sign(PackDNSMessage(response))
+}
@@ -0,0 +1,313 @@
+package mydns
+
+import (
+	"log/slog"
+	"net"
+	"sort"
+)
+
+// handleUpdate processes a dynamic update (RFC 2136). The zone section is
+// carried in Questions, the prerequisites in Answers and the updates in
+// Authorities, exactly as ParseDNSMessage reads them.
+func (v *View) handleUpdate(message DNSMessage, source net.IP, keyName string) []byte {
+	rcode := v.processUpdate(message, source, keyName)
+	if rcode != RcodeNoError {
+		slog.Warn("Rejected an update", "client", source, "rcode", rcodeToString(rcode))
+	}
+
+	response := DNSMessage{
+		Header:    buildResponseHeader(message.Header, false, rcode),
+		Questions: message.Questions,
+	}
+	switch rcode {
+	case RcodeRefused:
+		addEDE(&response, EDEProhibited, "updates are not allowed for this client")
+	case RcodeNotAuth:
+		addEDE(&response, EDENotAuthoritative, "not authoritative for the zone")
+	}
+	return PackDNSMessage(response)
+}
+
+func (v *View) processUpdate(message DNSMessage, source net.IP, keyName string) uint16 {
+	if len(message.Questions) != 1 || message.Questions[0].QTYPE != TypeSOA {
+		return RcodeFormErr
+	}
+	zoneSection := message.Questions[0]
+
+	if zoneSection.QCLASS != ClassIN {
+		return RcodeNotAuth
+	}
+
+	// Prerequisites are evaluated and updates applied under one lock so the
+	// whole message is atomic with respect to queries, other updates and
+	// reloads of the zone.
+	zone := v.zones.lockZone(zoneSection.QNAME)
+	if zone == nil {
+		return RcodeNotAuth
+	}
+	defer zone.mu.Unlock()
+	if !zone.allowUpdate.allows(source, keyName) {
+		return RcodeRefused
+	}
+
+	if rcode := checkPrerequisites(zone.records, zone.Origin, zoneSection.QCLASS, message.Answers); rcode != RcodeNoError {
+		return rcode
+	}
+	if rcode := prescanUpdates(zone.Origin, zoneSection.QCLASS, message.Authorities); rcode != RcodeNoError {
+		return rcode
+	}
+
+	records := cloneRecords(zone.records)
+	applyUpdates(records, zone.Origin, zoneSection.QCLASS, message.Authorities)
+
+	deleted, added := diffRecords(zone.records, records)
+	if len(deleted) == 0 && len(added) == 0 {
+		return RcodeNoError
+	}
+
+	oldSerial := serialOf(zone.records, zone.Origin)
+	newSerial := serialOf(records, zone.Origin)
+	if newSerial == oldSerial {
+		newSerial = oldSerial + 1
+		setSerial(records, zone.Origin, newSerial)
+		deleted, added = diffRecords(zone.records, records)
+	}
+
+	entry := journalEntry{OldSerial: oldSerial, NewSerial: newSerial, Deleted: deleted, Added: added}
+	if err := zone.appendJournal(entry); err != nil {
+		slog.Error("Failed to write the journal", "zone", fqdn(zone.Origin), "err", err)
+		return RcodeServFail
+	}
+	zone.setRecords(records)
+	slog.Info("Applied an update", "zone", fqdn(zone.Origin), "client", source, "serial", newSerial)
+	return RcodeNoError
+}
+
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+}
+
+// checkPrerequisites evaluates the prerequisite section (RFC 2136 3.2).
+func checkPrerequisites(records map[string][]DNSAnswer, origin string, zoneClass uint16, prerequisites []DNSAnswer) uint16 {
+	expected := make(map[rrsetKey][]DNSAnswer)
+	for _, rr := range prerequisites {
+		if rr.TTL != 0 {
+			return RcodeFormErr
+		}
+		if !isSubdomain(rr.ANAME, origin) {
+			return RcodeNotZone
+		}
+		name := canonicalName(rr.ANAME)
+
+		switch rr.ACLASS {
+		case ClassANY:
+			if len(rr.RDATA) != 0 {
+				return RcodeFormErr
+			}
+			if rr.ATYPE == TypeANY {
+				if len(records[name]) == 0 {
+					return RcodeNXDomain
+				}
+			} else if len(findRRSet(records, name, rr.ATYPE)) == 0 {
+				return RcodeNXRRSet
+			}
+		case ClassNONE:
+			if len(rr.RDATA) != 0 {
+				return RcodeFormErr
+			}
+			if rr.ATYPE == TypeANY {
+				if len(records[name]) > 0 {
+					return RcodeYXDomain
+				}
+			} else if len(findRRSet(records, name, rr.ATYPE)) > 0 {
+				return RcodeYXRRSet
+			}
+		case zoneClass:
+			key := rrsetKey{name, rr.ATYPE}
+			expected[key] = append(expected[key], rr)
+		default:
+			return RcodeFormErr
+		}
+	}
+
+	// Value dependent prerequisites must match the whole RRset.
+	for key, rrset := range expected {
+		if !sameRRSet(findRRSet(records, key.name, key.rrtype), rrset) {
+			return RcodeNXRRSet
+		}
+	}
+	return RcodeNoError
+}
+
+func sameRRSet(a []DNSAnswer, b []DNSAnswer) bool {
+	contains := func(set []DNSAnswer, record DNSAnswer) bool {
+		for _, candidate := range set {
+			if sameRecord(candidate, record) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, record := range a {
+		if !contains(b, record) {
+			return false
+		}
+	}
+	for _, record := range b {
+		if !contains(a, record) {
+			return false
+		}
+	}
+	return true
+}
+
+// prescanUpdates validates the update section before anything is applied
+// (RFC 2136 3.4.1.3), so that applying can never fail half way.
+func prescanUpdates(origin string, zoneClass uint16, updates []DNSAnswer) uint16 {
+	for _, rr := range updates {
+		if !isSubdomain(rr.ANAME, origin) {
+			return RcodeNotZone
+		}
+		switch rr.ACLASS {
+		case zoneClass:
+			if isMetaType(rr.ATYPE) {
+				return RcodeFormErr
+			}
+		case ClassANY:
+			if rr.TTL != 0 || len(rr.RDATA) != 0 || (isMetaType(rr.ATYPE) && rr.ATYPE != TypeANY) {
+				return RcodeFormErr
+			}
+		case ClassNONE:
+			if rr.TTL != 0 || isMetaType(rr.ATYPE) {
+				return RcodeFormErr
+			}
+		default:
+			return RcodeFormErr
+		}
+	}
+	return RcodeNoError
+}
+
+// applyUpdates applies the update section (RFC 2136 3.4.2).
+func applyUpdates(records map[string][]DNSAnswer, origin string, zoneClass uint16, updates []DNSAnswer) {
+	for _, rr := range updates {
+		name := canonicalName(rr.ANAME)
+		atApex := name == origin
+
+		switch rr.ACLASS {
+		case zoneClass:
+			existing := records[name]
+			if rr.ATYPE == TypeCNAME && hasTypeOtherThan(existing, TypeCNAME) {
+				continue
+			}
+			if rr.ATYPE != TypeCNAME && len(findRRSet(records, name, TypeCNAME)) > 0 {
+				continue
+			}
+			if rr.ATYPE == TypeSOA {
+				if !atApex {
+					continue
+				}
+				current, err := parseSOA(findRRSet(records, name, TypeSOA)[0].RDATA)
+				updated, updatedErr := parseSOA(rr.RDATA)
+				if err != nil || updatedErr != nil || !serialGreater(updated.Serial, current.Serial) {
+					continue
+				}
+			}
+			if rr.ATYPE == TypeSOA || rr.ATYPE == TypeCNAME {
+				removeRecords(records, name, func(record DNSAnswer) bool {
+					return record.ATYPE == rr.ATYPE
+				})
+			}
+			addRecord(records, rr)
+
+		case ClassANY:
+			removeRecords(records, name, func(record DNSAnswer) bool {
+				if atApex && (record.ATYPE == TypeSOA || record.ATYPE == TypeNS) {
+					return false
+				}
+				return rr.ATYPE == TypeANY || record.ATYPE == rr.ATYPE
+			})
+
+		case ClassNONE:
+			if atApex && rr.ATYPE == TypeSOA {
+				continue
+			}
+			target := rr
+			target.ACLASS = zoneClass
+			if atApex && rr.ATYPE == TypeNS {
+				nameservers := findRRSet(records, name, TypeNS)
+				if len(nameservers) == 1 && sameRecord(nameservers[0], target) {
+					continue
+				}
+			}
+			removeRecords(records, name, func(record DNSAnswer) bool {
+				return sameRecord(record, target)
+			})
+		}
+	}
+}
+
+func hasTypeOtherThan(records []DNSAnswer, rrtype uint16) bool {
+	for _, record := range records {
+		if record.ATYPE != rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+// Meta and query types (RFC 6895 section 3.1) cannot be stored in a zone.
+func isMetaType(rrtype uint16) bool {
+	return rrtype == TypeOPT || (rrtype >= 128 && rrtype <= 255)
+}
+
+// serialGreater compares serial numbers using RFC 1982 arithmetic.
+func serialGreater(a uint32, b uint32) bool {
+	return a != b && a-b < 1<<31
+}
+
+func setSerial(records map[string][]DNSAnswer, origin string, serial uint32) {
+	for i, record := range records[origin] {
+		if record.ATYPE != TypeSOA {
+			continue
+		}
+		soa, err := parseSOA(record.RDATA)
+		if err != nil {
+			return
+		}
+		soa.Serial = serial
+		records[origin][i].RDATA = soa.rdata()
+		records[origin][i].RDLENGTH = uint16(len(records[origin][i].RDATA))
+	}
+}
+
+// diffRecords lists the records removed from and added to a zone, where a
+// changed TTL counts as both.
+func diffRecords(before map[string][]DNSAnswer, after map[string][]DNSAnswer) ([]DNSAnswer, []DNSAnswer) {
+	missing := func(from map[string][]DNSAnswer, in map[string][]DNSAnswer) []DNSAnswer {
+		var names []string
+		for name := range from {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var records []DNSAnswer
+		for _, name := range names {
+			for _, record := range from[name] {
+				found := false
+				for _, candidate := range in[name] {
+					if sameRecord(candidate, record) && candidate.TTL == record.TTL {
+						found = true
+						break
+					}
+				}
+				if !found {
+					records = append(records, record)
+				}
+			}
+		}
+		return records
+	}
+	return missing(before, after), missing(after, before)
+}
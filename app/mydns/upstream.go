@@ -0,0 +1,71 @@
+package mydns
+
+import (
+	"sync"
+	"time"
+)
+
+// upstreamStatus is what is known of how a resolver has been answering.
+type upstreamStatus struct {
+	Queries     uint64     `json:"queries"`
+	Failures    uint64     `json:"failures"`
+	LastRTT     float64    `json:"last-rtt-ms"`
+	LastError   string     `json:"last-error,omitempty"`
+	LastSuccess *time.Time `json:"last-success,omitempty"`
+	LastFailure *time.Time `json:"last-failure,omitempty"`
+}
+
+// upstreamTracker records the outcome of every query a server forwards to
+// each resolver, for the admin API to report their health and metrics.
+type upstreamTracker struct {
+	mu       sync.Mutex
+	statuses map[string]*upstreamStatus
+	queries  *counterVec
+	errors   *counterVec
+	rtt      *histogramVec
+}
+
+func newUpstreamTracker() *upstreamTracker {
+	return &upstreamTracker{
+		statuses: make(map[string]*upstreamStatus),
+		queries:  newCounterVec("resolver"),
+		errors:   newCounterVec("resolver"),
+		rtt:      newHistogramVec(latencyBuckets, "resolver"),
+	}
+}
+
+func (t *upstreamTracker) record(resolver string, rtt time.Duration, err error) {
+	t.queries.inc(resolver)
+	if err != nil {
+		t.errors.inc(resolver)
+	} else {
+		t.rtt.observe(rtt.Seconds(), resolver)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status, exists := t.statuses[resolver]
+	if !exists {
+		status = &upstreamStatus{}
+		t.statuses[resolver] = status
+	}
+	now := time.Now()
+	status.Queries++
+	if err != nil {
+		status.Failures++
+		status.LastError = err.Error()
+		status.LastFailure = &now
+		return
+	}
+	status.LastRTT = float64(rtt.Microseconds()) / 1000
+	status.LastSuccess = &now
+}
+
+func (t *upstreamTracker) status(resolver string) upstreamStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if status, exists := t.statuses[resolver]; exists {
+		return *status
+	}
+	return upstreamStatus{}
+}
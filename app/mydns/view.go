@@ -0,0 +1,275 @@
+package mydns
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+const defaultViewName = "default"
+
+// View is the data one group of clients sees: its own zones, the
+// resolvers it forwards to and a cache of their answers. Views are chosen
+// by the client's address or TSIG key and the address the query arrived
+// at, so internal clients can get different answers from everyone else.
+type View struct {
+	Name              string
+	matchClients      *ACL // nil matches every client
+	matchDestinations *ACL // nil matches every listening address
+	allowQuery        ACL
+	allowRecursion    ACL
+	zones             *ZoneStore
+	forwarders        []string
+	cache             *Cache
+	dnstap            *dnstapWriter
+	upstreams         *upstreamTracker
+}
+
+var (
+	defaultAllowQuery     = []string{"any"}
+	defaultAllowRecursion = []string{"localhost", "localnets"}
+)
+
+// newView builds a view, taking the access lists it does not set from the
+// top level of the configuration.
+func newView(viewConfig ViewConfig, config Config) (*View, error) {
+	zoneStore, err := loadZones(viewConfig.Zones, config.ACLs)
+	if err != nil {
+		return nil, err
+	}
+	view := &View{Name: viewConfig.Name, zones: zoneStore, forwarders: viewConfig.Forwarders}
+	if view.matchClients, err = parseViewMatch(viewConfig.MatchClients, config.ACLs); err != nil {
+		return nil, err
+	}
+	if view.matchDestinations, err = parseViewMatch(viewConfig.MatchDestinations, config.ACLs); err != nil {
+		return nil, err
+	}
+	allowQuery := firstNonEmpty(viewConfig.AllowQuery, config.AllowQuery, defaultAllowQuery)
+	if view.allowQuery, err = parseACL(allowQuery, config.ACLs); err != nil {
+		return nil, err
+	}
+	allowRecursion := firstNonEmpty(viewConfig.AllowRecursion, config.AllowRecursion, defaultAllowRecursion)
+	if view.allowRecursion, err = parseACL(allowRecursion, config.ACLs); err != nil {
+		return nil, err
+	}
+
+	cache := viewConfig.Cache
+	if cache == nil || !cache.Disabled {
+		if cache == nil {
+			cache = &CacheConfig{}
+		}
+		if view.cache, err = NewCache(*cache); err != nil {
+			return nil, err
+		}
+	}
+	return view, nil
+}
+
+func firstNonEmpty(lists ...[]string) []string {
+	for _, list := range lists {
+		if len(list) > 0 {
+			return list
+		}
+	}
+	return nil
+}
+
+// loadViews returns the configured views in order, followed by the default
+// view built from the top level of the configuration, which matches every
+// client.
+func loadViews(config Config) ([]*View, error) {
+	if err := parseACLGroups(config.ACLs); err != nil {
+		return nil, err
+	}
+
+	var views []*View
+	names := map[string]bool{defaultViewName: true}
+	for _, viewConfig := range config.Views {
+		if names[viewConfig.Name] {
+			return nil, fmt.Errorf("[View Error] view %q is defined more than once", viewConfig.Name)
+		}
+		names[viewConfig.Name] = true
+
+		view, err := newView(viewConfig, config)
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, view)
+	}
+
+	var forwarders []string
+	if config.Resolver != "" {
+		forwarders = []string{config.Resolver}
+	}
+	defaultView, err := newView(ViewConfig{
+		Name:       defaultViewName,
+		Zones:      config.Zones,
+		Forwarders: forwarders,
+		Cache:      config.Cache,
+	}, config)
+	if err != nil {
+		return nil, err
+	}
+	return append(views, defaultView), nil
+}
+
+func parseViewMatch(entries []string, groups map[string][]string) (*ACL, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	acl, err := parseACL(entries, groups)
+	if err != nil {
+		return nil, err
+	}
+	return &acl, nil
+}
+
+func (v *View) matches(local net.Addr, source net.Addr, keyName string) bool {
+	if v.matchClients != nil && !v.matchClients.allows(addrIP(source), keyName) {
+		return false
+	}
+	if v.matchDestinations != nil && !v.matchDestinations.allows(addrIP(local), "") {
+		return false
+	}
+	return true
+}
+
+// recursionAvailable reports whether the view forwards queries for a
+// client, which decides the RA flag of the responses it gets.
+func (v *View) recursionAvailable(source net.Addr, keyName string) bool {
+	return len(v.forwarders) > 0 && v.allowRecursion.allows(addrIP(source), keyName)
+}
+
+// selectView returns the first view matching a request. The default view
+// is last and matches everything.
+func (s *DNSServer) selectView(local net.Addr, source net.Addr, keyName string) *View {
+	for _, view := range s.views {
+		if view.matches(local, source, keyName) {
+			return view
+		}
+	}
+	return s.views[len(s.views)-1]
+}
+
+// forward sends a query to the view's forwarders in turn until one of them
+// answers. Questions answered before are served from the cache while their
+// TTLs last, and after that, if no forwarder answers, from what the cache
+// kept of them. The error is that of the last forwarder when none answers.
+func (v *View) forward(packet []byte, trace *queryTrace) ([]byte, error) {
+	query, err := ParseDNSMessage(packet)
+	cacheable := err == nil && v.cache != nil && len(query.Questions) == 1 && query.Header.getOpcode() == OpcodeQuery
+	if cacheable {
+		if cached, found, prefetch := v.cache.lookup(query.Questions[0]); found {
+			slog.Debug("Answered from the cache", "qname", query.Questions[0].QNAME, "view", v.Name)
+			trace.cached("hit")
+			if prefetch {
+				slog.Debug("Prefetching an answer before it expires", "qname", query.Questions[0].QNAME)
+				go v.forwardUpstream(packet, query, true)
+			}
+			return cachedResponse(query, cached), nil
+		}
+		trace.cached("miss")
+		if stale, found := v.cache.lookupStale(query.Questions[0]); found {
+			return v.forwardOrStale(packet, query, stale, trace), nil
+		}
+	}
+	response, resolver, err := v.forwardUpstream(packet, query, cacheable)
+	trace.forwardedTo(resolver)
+	return response, err
+}
+
+// forwardUpstream returns the first answer of the forwarders along with the
+// forwarder that gave it.
+func (v *View) forwardUpstream(packet []byte, query DNSMessage, cacheable bool) ([]byte, string, error) {
+	lastErr := fmt.Errorf("no resolver to forward to")
+	for _, resolver := range v.forwarders {
+		slog.Debug("Forwarding a query", "resolver", resolver)
+		start := time.Now()
+		v.dnstap.forwarderQuery(resolver, packet, start)
+		response, err := forwardQueryToResolver(packet, resolver)
+		v.upstreams.record(resolver, time.Since(start), err)
+		if err != nil {
+			slog.Warn("Failed to forward a query", "resolver", resolver, "err", err)
+			lastErr = fmt.Errorf("resolver %s did not answer: %w", resolver, err)
+			continue
+		}
+		v.dnstap.forwarderResponse(resolver, response, start)
+		if cacheable {
+			if parsed, err := ParseDNSMessage(response); err == nil && parsed.Header.ID == query.Header.ID {
+				v.cache.store(query.Questions[0], parsed)
+			}
+		}
+		return response, resolver, nil
+	}
+	return nil, "", lastErr
+}
+
+// forwardOrStale forwards a query whose answer has expired from the cache,
+// and falls back to the stale answer if the forwarders fail or answer
+// SERVFAIL, or take longer than the stale client timeout. A forward that
+// is still running then refreshes the cache when it completes.
+func (v *View) forwardOrStale(packet []byte, query DNSMessage, stale DNSMessage, trace *queryTrace) []byte {
+	type result struct {
+		response []byte
+		resolver string
+		err      error
+	}
+	results := make(chan result, 1)
+	go func() {
+		response, resolver, err := v.forwardUpstream(packet, query, true)
+		results <- result{response, resolver, err}
+	}()
+	var timeout <-chan time.Time
+	if v.cache.staleClientTimeout > 0 {
+		timeout = time.After(v.cache.staleClientTimeout)
+	}
+
+	question := query.Questions[0]
+	select {
+	case result := <-results:
+		if result.err == nil && (len(result.response) < 4 || uint16(result.response[3]&0xF) != RcodeServFail) {
+			trace.forwardedTo(result.resolver)
+			return result.response
+		}
+		slog.Info("Serving a stale answer, as the resolvers failed", "qname", question.QNAME)
+	case <-timeout:
+		slog.Info("Serving a stale answer while waiting for the resolvers", "qname", question.QNAME)
+	}
+
+	trace.cached("stale")
+	code := EDEStaleAnswer
+	if stale.Header.getRcode() == RcodeNXDomain {
+		code = EDEStaleNXDomainAnswer
+	}
+	addEDE(&stale, code, "")
+	return cachedResponse(query, stale)
+}
+
+// cachedResponse fits a cached response to the query it answers.
+func cachedResponse(query DNSMessage, cached DNSMessage) []byte {
+	cached.Header.ID = query.Header.ID
+	cached.Header.Flags = cached.Header.Flags&^(1<<8) | query.Header.getRecusionDesired()<<8
+	cached.Questions = query.Questions
+	return PackDNSMessage(cached)
+}
+
+// lookupForward sends a query of the server's own to the forwarders, such
+// as for the name servers of a domain when checking response policies.
+func (v *View) lookupForward(name string, qtype uint16) (DNSMessage, bool) {
+	id := uint16(rand.Uint32())
+	query := PackDNSMessage(DNSMessage{
+		Header:    DNSHeader{ID: id, Flags: 1 << 8}, // RD
+		Questions: []DNSQuestion{{QNAME: name, QTYPE: qtype, QCLASS: ClassIN}},
+	})
+	response, err := v.forward(query, nil)
+	if err != nil {
+		return DNSMessage{}, false
+	}
+	message, err := ParseDNSMessage(response)
+	if err != nil || message.Header.ID != id {
+		return DNSMessage{}, false
+	}
+	return message, true
+}
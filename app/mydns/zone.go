@@ -0,0 +1,328 @@
+package mydns
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Zone holds the authoritative data for one origin in memory.
+type Zone struct {
+	Origin        string
+	mu            sync.RWMutex
+	records       map[string][]DNSAnswer // keyed by canonical owner name
+	ancestors     map[string]bool        // names with descendants, kept in step with records
+	journal       string
+	allowUpdate   ACL
+	allowTransfer ACL
+}
+
+func NewZone(origin string, records []DNSAnswer) (*Zone, error) {
+	zone := &Zone{
+		Origin:  canonicalName(origin),
+		records: make(map[string][]DNSAnswer),
+	}
+	for _, record := range records {
+		if !isSubdomain(record.ANAME, zone.Origin) {
+			return nil, fmt.Errorf("[Zone Error] %s is outside of zone %s", record.ANAME, fqdn(zone.Origin))
+		}
+		addRecord(zone.records, record)
+	}
+	zone.setRecords(zone.records)
+	if _, exists := zone.soa(); !exists {
+		return nil, fmt.Errorf("[Zone Error] zone %s has no SOA record at its apex", fqdn(zone.Origin))
+	}
+	return zone, nil
+}
+
+// lookup returns the records of the given type owned by name.
+func (z *Zone) lookup(name string, rrtype uint16) []DNSAnswer {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return findRRSet(z.records, name, rrtype)
+}
+
+func (z *Zone) soa() (DNSAnswer, bool) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	soa := findRRSet(z.records, z.Origin, TypeSOA)
+	if len(soa) == 0 {
+		return DNSAnswer{}, false
+	}
+	return soa[0], true
+}
+
+// negativeSOA returns the SOA record to place in the authority section of
+// NXDOMAIN and NODATA responses, with the TTL capped by the SOA minimum.
+// The caller must hold the zone lock.
+func (z *Zone) negativeSOA() []DNSAnswer {
+	soa := findRRSet(z.records, z.Origin, TypeSOA)
+	if len(soa) == 0 {
+		return nil
+	}
+	record := soa[0]
+	if fields, err := parseSOA(record.RDATA); err == nil && fields.Minimum < record.TTL {
+		record.TTL = fields.Minimum
+	}
+	return []DNSAnswer{record}
+}
+
+// nameInUse reports whether a name owns records or is an empty
+// non-terminal, a name with no records of its own but with descendants.
+// The caller must hold the zone lock.
+func (z *Zone) nameInUse(name string) bool {
+	name = canonicalName(name)
+	return len(z.records[name]) > 0 || z.ancestors[name]
+}
+
+// setRecords replaces the zone's records and rebuilds the index of names
+// with descendants, so lookups need not scan every owner. The caller must
+// hold the zone lock.
+func (z *Zone) setRecords(records map[string][]DNSAnswer) {
+	ancestors := make(map[string]bool)
+	for owner := range records {
+		for name := parentName(owner); name != "" && !ancestors[name]; name = parentName(name) {
+			ancestors[name] = true
+		}
+	}
+	z.records = records
+	z.ancestors = ancestors
+}
+
+func findRRSet(records map[string][]DNSAnswer, name string, rrtype uint16) []DNSAnswer {
+	var rrset []DNSAnswer
+	for _, record := range records[canonicalName(name)] {
+		if record.ATYPE == rrtype || rrtype == TypeANY {
+			rrset = append(rrset, record)
+		}
+	}
+	return rrset
+}
+
+// addRecord adds a record to the set, replacing an identical one so that
+// a re-added record only refreshes its TTL.
+func addRecord(records map[string][]DNSAnswer, record DNSAnswer) {
+	key := canonicalName(record.ANAME)
+	record.RDLENGTH = uint16(len(record.RDATA))
+	for i, existing := range records[key] {
+		if sameRecord(existing, record) {
+			records[key][i] = record
+			return
+		}
+	}
+	records[key] = append(records[key], record)
+}
+
+func removeRecords(records map[string][]DNSAnswer, name string, match func(DNSAnswer) bool) []DNSAnswer {
+	key := canonicalName(name)
+	var kept, removed []DNSAnswer
+	for _, record := range records[key] {
+		if match(record) {
+			removed = append(removed, record)
+		} else {
+			kept = append(kept, record)
+		}
+	}
+	if len(kept) == 0 {
+		delete(records, key)
+	} else {
+		records[key] = kept
+	}
+	return removed
+}
+
+// sameRecord compares records ignoring their TTL, as RRset semantics do.
+func sameRecord(a DNSAnswer, b DNSAnswer) bool {
+	return canonicalName(a.ANAME) == canonicalName(b.ANAME) &&
+		a.ATYPE == b.ATYPE &&
+		a.ACLASS == b.ACLASS &&
+		sameRDATA(a.ATYPE, a.RDATA, b.RDATA)
+}
+
+// Names embedded in RDATA compare case-insensitively.
+func sameRDATA(rrtype uint16, a []byte, b []byte) bool {
+	switch rrtype {
+	case TypeNS, TypeCNAME, TypePTR, TypeDNAME, TypeMX, TypeSRV, TypeSOA:
+		return strings.EqualFold(rdataToString(rrtype, a), rdataToString(rrtype, b))
+	}
+	return bytes.Equal(a, b)
+}
+
+func cloneRecords(records map[string][]DNSAnswer) map[string][]DNSAnswer {
+	clone := make(map[string][]DNSAnswer, len(records))
+	for name, rrs := range records {
+		clone[name] = append([]DNSAnswer(nil), rrs...)
+	}
+	return clone
+}
+
+// ZoneStore holds every zone the server is authoritative for.
+type ZoneStore struct {
+	mu      sync.RWMutex
+	zones   map[string]*Zone
+	configs []ZoneConfig // to reload the zones from
+	groups  map[string][]string
+}
+
+func NewZoneStore() *ZoneStore {
+	return &ZoneStore{zones: make(map[string]*Zone)}
+}
+
+func (s *ZoneStore) AddZone(zone *Zone) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.zones[zone.Origin] = zone
+}
+
+// zone returns the zone with exactly the given origin.
+func (s *ZoneStore) zone(origin string) *Zone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.zones[canonicalName(origin)]
+}
+
+// lockZone returns the zone with exactly the given origin with its lock
+// held, trying again if a reload replaced it while waiting for the lock.
+func (s *ZoneStore) lockZone(origin string) *Zone {
+	for {
+		zone := s.zone(origin)
+		if zone == nil {
+			return nil
+		}
+		zone.mu.Lock()
+		if s.zone(origin) == zone {
+			return zone
+		}
+		zone.mu.Unlock()
+	}
+}
+
+// findZone returns the most specific zone containing name.
+func (s *ZoneStore) findZone(name string) *Zone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	name = canonicalName(name)
+	for {
+		if zone, exists := s.zones[name]; exists {
+			return zone
+		}
+		if name == "" {
+			return nil
+		}
+		name = parentName(name)
+	}
+}
+
+// origins returns the origins of the zones, in order.
+func (s *ZoneStore) origins() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	origins := []string{}
+	for origin := range s.zones {
+		origins = append(origins, fqdn(origin))
+	}
+	sort.Strings(origins)
+	return origins
+}
+
+func (s *ZoneStore) isEmpty() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.zones) == 0
+}
+
+// loadZones reads each configured zone file and replays its journal. The
+// zones' ACLs may include the named groups.
+func loadZones(configs []ZoneConfig, groups map[string][]string) (*ZoneStore, error) {
+	store := NewZoneStore()
+	store.configs, store.groups = configs, groups
+	for _, config := range configs {
+		zone, err := loadZone(config, groups)
+		if err != nil {
+			return nil, err
+		}
+		store.AddZone(zone)
+	}
+	return store, nil
+}
+
+func loadZone(config ZoneConfig, groups map[string][]string) (*Zone, error) {
+	records, err := LoadZoneFile(config.File, config.Name)
+	if err != nil {
+		return nil, err
+	}
+	zone, err := NewZone(config.Name, records)
+	if err != nil {
+		return nil, err
+	}
+	zone.allowUpdate, err = parseACL(config.AllowUpdate, groups)
+	if err != nil {
+		return nil, err
+	}
+	zone.allowTransfer, err = parseACL(config.AllowTransfer, groups)
+	if err != nil {
+		return nil, err
+	}
+	zone.journal = config.Journal
+	if err := zone.replayJournal(); err != nil {
+		return nil, err
+	}
+	return zone, nil
+}
+
+// reload reads the zone with the given origin from its file and journal
+// again, or every zone when the origin is empty, and returns the origins
+// it reloaded. A zone that fails to load keeps its current data.
+func (s *ZoneStore) reload(origin string) ([]string, error) {
+	var reloaded []string
+	for _, config := range s.configs {
+		if origin != "" && canonicalName(config.Name) != canonicalName(origin) {
+			continue
+		}
+		zone, err := s.reloadZone(config)
+		if err != nil {
+			return reloaded, err
+		}
+		reloaded = append(reloaded, zone.Origin)
+	}
+	return reloaded, nil
+}
+
+// reloadZone loads a zone again and swaps it in while holding the lock of
+// the zone it replaces, so no update is applied to the old zone after its
+// journal has been read.
+func (s *ZoneStore) reloadZone(config ZoneConfig) (*Zone, error) {
+	if current := s.lockZone(config.Name); current != nil {
+		defer current.mu.Unlock()
+	}
+	zone, err := loadZone(config, s.groups)
+	if err != nil {
+		return nil, err
+	}
+	s.AddZone(zone)
+	return zone, nil
+}
+
+// allRecords returns every record in the zone, with the SOA first.
+func (z *Zone) allRecords() []DNSAnswer {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	var names []string
+	for name := range z.records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	all := findRRSet(z.records, z.Origin, TypeSOA)
+	for _, name := range names {
+		for _, record := range z.records[name] {
+			if record.ATYPE != TypeSOA {
+				all = append(all, record)
+			}
+		}
+	}
+	return all
+}
@@ -0,0 +1,267 @@
+package mydns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const defaultZoneTTL = 3600
+
+// LoadZoneFile reads a master file (RFC 1035 section 5) for the given origin.
+func LoadZoneFile(path string, origin string) ([]DNSAnswer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("[Zone File Error] %w", err)
+	}
+	defer file.Close()
+
+	records, err := parseZoneFile(file, origin)
+	if err != nil {
+		return nil, fmt.Errorf("[Zone File Error] %s: %w", path, err)
+	}
+	return records, nil
+}
+
+func parseZoneFile(r io.Reader, origin string) ([]DNSAnswer, error) {
+	origin = canonicalName(origin)
+	ttl := uint32(defaultZoneTTL)
+	owner := origin
+
+	var records []DNSAnswer
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	var pending []string
+	var pendingIndented bool
+	depth := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		tokens, opened, err := tokenizeZoneLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if depth == 0 {
+			pendingIndented = len(line) > 0 && (line[0] == ' ' || line[0] == '\t')
+		}
+		pending = append(pending, tokens...)
+		depth += opened
+		if depth < 0 {
+			return nil, fmt.Errorf("line %d: unbalanced parentheses", lineNumber)
+		}
+		if depth > 0 || len(pending) == 0 {
+			continue
+		}
+
+		tokens = pending
+		pending = nil
+
+		switch strings.ToUpper(tokens[0]) {
+		case "$ORIGIN":
+			if len(tokens) != 2 {
+				return nil, fmt.Errorf("line %d: $ORIGIN expects one name", lineNumber)
+			}
+			origin = canonicalName(absoluteName(tokens[1], origin))
+			continue
+		case "$TTL":
+			if len(tokens) != 2 {
+				return nil, fmt.Errorf("line %d: $TTL expects one value", lineNumber)
+			}
+			if ttl, err = parseTTL(tokens[1]); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			continue
+		case "$INCLUDE", "$GENERATE":
+			return nil, fmt.Errorf("line %d: %s is not supported", lineNumber, tokens[0])
+		}
+
+		if !pendingIndented {
+			owner = absoluteName(tokens[0], origin)
+			tokens = tokens[1:]
+		}
+		record, err := parseRecordFields(owner, tokens, ttl, origin)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced parentheses at end of file")
+	}
+	return records, nil
+}
+
+// parseRecordFields parses "[ttl] [class] type rdata..." where the TTL and
+// class may appear in either order.
+func parseRecordFields(owner string, tokens []string, defaultTTL uint32, origin string) (DNSAnswer, error) {
+	record := DNSAnswer{ANAME: owner, ACLASS: ClassIN, TTL: defaultTTL}
+	for len(tokens) > 0 {
+		if class, ok := parseClass(tokens[0]); ok {
+			record.ACLASS = class
+			tokens = tokens[1:]
+			continue
+		}
+		if ttl, err := parseTTL(tokens[0]); err == nil {
+			record.TTL = ttl
+			tokens = tokens[1:]
+			continue
+		}
+		break
+	}
+	if len(tokens) == 0 {
+		return DNSAnswer{}, fmt.Errorf("missing record type")
+	}
+	rrtype, ok := parseType(tokens[0])
+	if !ok {
+		return DNSAnswer{}, fmt.Errorf("unknown record type %q", tokens[0])
+	}
+	record.ATYPE = rrtype
+
+	rdata, err := parseRDATAText(rrtype, tokens[1:], origin)
+	if err != nil {
+		return DNSAnswer{}, err
+	}
+	record.RDATA = rdata
+	record.RDLENGTH = uint16(len(rdata))
+	return record, nil
+}
+
+// parseRecordText parses a single record with an absolute owner name, as
+// written by recordToString.
+func parseRecordText(line string) (DNSAnswer, error) {
+	tokens, opened, err := tokenizeZoneLine(line)
+	if err != nil {
+		return DNSAnswer{}, err
+	}
+	if opened != 0 || len(tokens) < 2 {
+		return DNSAnswer{}, fmt.Errorf("invalid record %q", line)
+	}
+	return parseRecordFields(absoluteName(tokens[0], ""), tokens[1:], defaultZoneTTL, "")
+}
+
+// tokenizeZoneLine splits a line into whitespace separated tokens, keeping
+// quoted strings intact, dropping comments, and reporting the change in
+// parenthesis depth.
+func tokenizeZoneLine(line string) ([]string, int, error) {
+	var tokens []string
+	var current strings.Builder
+	inQuotes := false
+	depth := 0
+
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && i+1 < len(line):
+			current.WriteByte(c)
+			current.WriteByte(line[i+1])
+			i++
+		case c == '"':
+			current.WriteByte(c)
+			if inQuotes {
+				flush()
+			}
+			inQuotes = !inQuotes
+		case inQuotes:
+			current.WriteByte(c)
+		case c == ';':
+			flush()
+			return tokens, depth, nil
+		case c == '(':
+			flush()
+			depth++
+		case c == ')':
+			flush()
+			depth--
+		case unicode.IsSpace(rune(c)):
+			flush()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	if inQuotes {
+		return nil, 0, fmt.Errorf("unterminated quoted string")
+	}
+	flush()
+	return tokens, depth, nil
+}
+
+// parseTTL accepts plain seconds or BIND style durations such as 1h30m.
+func parseTTL(text string) (uint32, error) {
+	if value, err := strconv.ParseUint(text, 10, 32); err == nil {
+		return uint32(value), nil
+	}
+
+	var total uint64
+	var number uint64
+	digits := false
+	for _, c := range strings.ToLower(text) {
+		if c >= '0' && c <= '9' {
+			number = number*10 + uint64(c-'0')
+			digits = true
+			continue
+		}
+		if !digits {
+			return 0, fmt.Errorf("invalid TTL %q", text)
+		}
+		switch c {
+		case 's':
+		case 'm':
+			number *= 60
+		case 'h':
+			number *= 3600
+		case 'd':
+			number *= 86400
+		case 'w':
+			number *= 604800
+		default:
+			return 0, fmt.Errorf("invalid TTL %q", text)
+		}
+		total += number
+		number = 0
+		digits = false
+	}
+	if digits || total > 0xFFFFFFFF {
+		return 0, fmt.Errorf("invalid TTL %q", text)
+	}
+	return uint32(total), nil
+}
+
+// unquote strips the quotes from a character string and resolves escapes.
+func unquote(text string) string {
+	if len(text) >= 2 && text[0] == '"' && text[len(text)-1] == '"' {
+		text = text[1 : len(text)-1]
+	}
+	var result strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+1 < len(text) {
+			if i+3 < len(text) && isDigit(text[i+1]) && isDigit(text[i+2]) && isDigit(text[i+3]) {
+				value, _ := strconv.Atoi(text[i+1 : i+4])
+				result.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+			i++
+		}
+		result.WriteByte(text[i])
+	}
+	return result.String()
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,89 @@
+package server_response_test
+
+import (
+	"encoding/base64"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+const aclLocalZone = `$ORIGIN local.test.
+$TTL 300
+@	IN	SOA	ns1 admin 1 3600 900 604800 60
+	IN	NS	ns1
+ns1	IN	A	192.0.2.1
+www	IN	A	192.0.2.20
+`
+
+func TestAccessControlLists(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"upstream": viewUpstreamZone, "local": aclLocalZone}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("Failed to write zone file: %v", err)
+		}
+	}
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen: "127.0.0.1:2064",
+		Zones:  []mydns.ZoneConfig{{Name: "cached.test", File: filepath.Join(dir, "upstream")}},
+	})
+	time.Sleep(1 * time.Second)
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen:   "127.0.0.1:2065",
+		Resolver: "127.0.0.1:2064",
+		Keys:     []mydns.KeyConfig{{Name: "acl-key", Secret: base64.StdEncoding.EncodeToString(tsigTestSecret)}},
+		Zones:    []mydns.ZoneConfig{{Name: "local.test", File: filepath.Join(dir, "local")}},
+		ACLs: map[string][]string{
+			"trusted": {"key:acl-key"},
+			"clients": {"127.0.0.1", "trusted"},
+		},
+		AllowQuery:     []string{"clients"},
+		AllowRecursion: []string{"trusted"},
+	})
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2065")
+	defer conn.Close()
+
+	// Clients without recursion are answered from the server's own zones
+	response, _ := sendMessageAndParseResponse(t, conn, buildQuery(0x0701, "www.local.test", 1))
+	if len(response.Answers) != 1 || net.IP(response.Answers[0].RDATA).String() != "192.0.2.20" {
+		t.Errorf("Expected an answer of 192.0.2.20, got %v", response.Answers)
+	}
+	if response.Header.Flags&(1<<7) != 0 {
+		t.Errorf("Expected RA to be clear for a client without recursion")
+	}
+
+	// but not forwarded for
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0702, "www.cached.test", 1))
+	if rcode := response.Header.Flags & 0xF; rcode != 5 {
+		t.Errorf("RCODE mismatch: got %d, expected 5 (REFUSED)", rcode)
+	}
+
+	// Requests signed with a key in the trusted group are forwarded
+	signed, _ := signQuery(buildQuery(0x0703, "www.cached.test", 1), "acl-key", tsigTestSecret, time.Now())
+	response, _ = sendMessageAndParseResponse(t, conn, signed)
+	if len(response.Answers) != 1 || net.IP(response.Answers[0].RDATA).String() != "192.0.2.80" {
+		t.Errorf("Expected the forwarded answer 192.0.2.80, got %v", response.Answers)
+	}
+	if response.Header.Flags&(1<<7) == 0 {
+		t.Errorf("Expected RA to be set for a client allowed recursion")
+	}
+
+	// Addresses outside allow-query are refused even for local data
+	other, err := net.DialUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.2")}, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2065})
+	if err != nil {
+		t.Fatalf("Failed to connect from 127.0.0.2: %v", err)
+	}
+	defer other.Close()
+	response, _ = sendMessageAndParseResponse(t, other, buildQuery(0x0704, "www.local.test", 1))
+	if rcode := response.Header.Flags & 0xF; rcode != 5 {
+		t.Errorf("RCODE mismatch: got %d, expected 5 (REFUSED)", rcode)
+	}
+}
@@ -0,0 +1,134 @@
+package server_response_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+const adminTestZone = `$ORIGIN admin.zone.test.
+$TTL 300
+@	IN	SOA	ns1 admin %d 3600 900 604800 60
+	IN	NS	ns1
+ns1	IN	A	192.0.2.1
+www	IN	A	%s
+`
+
+func TestAdminAPI(t *testing.T) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2089})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	var answered atomic.Int32
+	go serveTestUpstream(upstream, 300, nil, &answered)
+
+	dir := t.TempDir()
+	zoneFile := filepath.Join(dir, "admin.zone.test")
+	if err := os.WriteFile(zoneFile, fmt.Appendf(nil, adminTestZone, 1, "192.0.2.10"), 0644); err != nil {
+		t.Fatalf("Failed to write zone file: %v", err)
+	}
+	blocklistFile := filepath.Join(dir, "blocklist")
+	if err := os.WriteFile(blocklistFile, []byte("blocked.admin.test\n"), 0644); err != nil {
+		t.Fatalf("Failed to write blocklist: %v", err)
+	}
+
+	// Without a token the admin API only listens on loopback
+	if _, err := mydns.NewDNSServer(mydns.Config{Admin: &mydns.AdminConfig{Listen: "0.0.0.0:2091"}}); err == nil {
+		t.Errorf("Expected the admin API to need a token to listen on every address")
+	}
+
+	const token = "admin-test-token"
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen:    "127.0.0.1:2090",
+		Resolver:  "127.0.0.1:2089",
+		Zones:     []mydns.ZoneConfig{{Name: "admin.zone.test", File: zoneFile}},
+		Keys:      []mydns.KeyConfig{{Name: "admin-key", Secret: "c2VjcmV0"}},
+		Blocklist: &mydns.BlocklistConfig{Files: []string{blocklistFile}},
+		Admin:     &mydns.AdminConfig{Listen: "127.0.0.1:2091", Token: token},
+	})
+	time.Sleep(1 * time.Second)
+
+	response, err := http.Get("http://127.0.0.1:2091/status")
+	if err != nil {
+		t.Fatalf("Failed to call the admin API: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without the token, got %s", response.Status)
+	}
+
+	var status struct {
+		Views []struct {
+			Name  string   `json:"name"`
+			Zones []string `json:"zones"`
+		} `json:"views"`
+	}
+	adminCallWithToken(t, "GET", "http://127.0.0.1:2091/status", token, "", &status)
+	if len(status.Views) != 1 || status.Views[0].Name != "default" || len(status.Views[0].Zones) != 1 || status.Views[0].Zones[0] != "admin.zone.test." {
+		t.Errorf("Expected the default view with admin.zone.test, got %+v", status.Views)
+	}
+
+	var config mydns.Config
+	adminCallWithToken(t, "GET", "http://127.0.0.1:2091/config", token, "", &config)
+	if len(config.Keys) != 1 || config.Keys[0].Secret == "c2VjcmV0" || config.Admin == nil || config.Admin.Token == token {
+		t.Errorf("Expected the secrets to be redacted, got keys %+v and admin %+v", config.Keys, config.Admin)
+	}
+
+	conn := dialServer(t, "127.0.0.1:2090")
+	defer conn.Close()
+
+	// Reloading picks up the changed zone file
+	if err := os.WriteFile(zoneFile, fmt.Appendf(nil, adminTestZone, 2, "192.0.2.20"), 0644); err != nil {
+		t.Fatalf("Failed to write zone file: %v", err)
+	}
+	var reloaded map[string][]string
+	adminCallWithToken(t, "POST", "http://127.0.0.1:2091/zones/reload?zone=admin.zone.test", token, "", &reloaded)
+	if len(reloaded["reloaded"]) != 1 {
+		t.Errorf("Expected one reloaded zone, got %v", reloaded)
+	}
+	dnsResponse, _ := sendMessageAndParseResponse(t, conn, buildQuery(0x1101, "www.admin.zone.test", 1))
+	if len(dnsResponse.Answers) != 1 || net.IP(dnsResponse.Answers[0].RDATA).String() != "192.0.2.20" {
+		t.Errorf("Expected the reloaded address 192.0.2.20, got %v", dnsResponse.Answers)
+	}
+
+	// A disabled blocklist lets its names be forwarded
+	dnsResponse, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x1102, "blocked.admin.test", 1))
+	if rcode := dnsResponse.Header.Flags & 0xF; rcode != 3 {
+		t.Errorf("RCODE mismatch: got %d, expected 3 (NXDOMAIN)", rcode)
+	}
+	var toggled struct {
+		Enabled bool `json:"enabled"`
+	}
+	adminCallWithToken(t, "PUT", "http://127.0.0.1:2091/blocklists/blocklist", token, `{"enabled": false}`, &toggled)
+	if toggled.Enabled {
+		t.Errorf("Expected the blocklist to be disabled")
+	}
+	dnsResponse, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x1103, "blocked.admin.test", 1))
+	if len(dnsResponse.Answers) != 1 || net.IP(dnsResponse.Answers[0].RDATA).String() != "192.0.2.100" {
+		t.Errorf("Expected the forwarded address 192.0.2.100, got %v", dnsResponse.Answers)
+	}
+
+	var upstreams []struct {
+		Resolver string `json:"resolver"`
+		Healthy  bool   `json:"healthy"`
+		Queries  uint64 `json:"queries"`
+	}
+	adminCallWithToken(t, "GET", "http://127.0.0.1:2091/upstreams", token, "", &upstreams)
+	if len(upstreams) != 1 || upstreams[0].Resolver != "127.0.0.1:2089" || !upstreams[0].Healthy || upstreams[0].Queries != 1 {
+		t.Errorf("Expected a healthy resolver with one forwarded query, got %+v", upstreams)
+	}
+
+	var queries mydns.QueryStats
+	adminCallWithToken(t, "GET", "http://127.0.0.1:2091/queries", token, "", &queries)
+	if queries.Received != 3 {
+		t.Errorf("Expected 3 queries received, got %+v", queries)
+	}
+}
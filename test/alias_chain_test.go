@@ -0,0 +1,156 @@
+package server_response_test
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+var chainTestZone = `$ORIGIN chain.test.
+$TTL 300
+@		IN	SOA	ns1 admin 1 3600 900 604800 60
+		IN	NS	ns1
+ns1		IN	A	192.0.2.1
+first		IN	CNAME	second
+second		IN	CNAME	third
+third		IN	A	192.0.2.3
+external	IN	CNAME	www.second.test.
+delegated	IN	CNAME	www.sub.second.test.
+loop1		IN	CNAME	loop2
+loop2		IN	CNAME	loop1
+` + longChain(10) + `
+old		IN	DNAME	new.chain.test.
+www.new		IN	A	192.0.2.4
+short		IN	DNAME	` + strings.Repeat("a", 50) + "." + strings.Repeat("b", 50) + "." + strings.Repeat("c", 50) + `.chain.test.
+`
+
+const chainSecondZone = `$ORIGIN second.test.
+$TTL 300
+@	IN	SOA	ns1 admin 1 3600 900 604800 60
+	IN	NS	ns1
+ns1	IN	A	192.0.2.1
+www	IN	A	192.0.2.5
+sub	IN	NS	ns.elsewhere.example.
+`
+
+// longChain returns a chain of CNAMEs from hop0 to an address at hopN.
+func longChain(hops int) string {
+	var chain strings.Builder
+	for i := 0; i < hops; i++ {
+		fmt.Fprintf(&chain, "hop%d\tIN\tCNAME\thop%d\n", i, i+1)
+	}
+	fmt.Fprintf(&chain, "hop%d\tIN\tA\t192.0.2.9\n", hops)
+	return chain.String()
+}
+
+func TestAliasChains(t *testing.T) {
+	dir := t.TempDir()
+	chainFile := filepath.Join(dir, "chain.test.zone")
+	if err := os.WriteFile(chainFile, []byte(chainTestZone), 0644); err != nil {
+		t.Fatalf("Failed to write zone file: %v", err)
+	}
+	secondFile := filepath.Join(dir, "second.test.zone")
+	if err := os.WriteFile(secondFile, []byte(chainSecondZone), 0644); err != nil {
+		t.Fatalf("Failed to write zone file: %v", err)
+	}
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen: "127.0.0.1:2101",
+		Zones: []mydns.ZoneConfig{
+			{Name: "chain.test", File: chainFile},
+			{Name: "second.test", File: secondFile},
+		},
+	})
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2101")
+	defer conn.Close()
+
+	// A chain within the zone is followed to the address
+	response, _ := sendMessageAndParseResponse(t, conn, buildQuery(0x1101, "first.chain.test", 1))
+	expectChain(t, response, []string{"first.chain.test", "second.chain.test", "third.chain.test"}, "192.0.2.3")
+	if response.Header.Flags&0x0400 == 0 {
+		t.Errorf("Expected the in-zone chain to be authoritative")
+	}
+
+	// A chain into another zone we serve is followed there
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x1102, "external.chain.test", 1))
+	expectChain(t, response, []string{"external.chain.test", "www.second.test"}, "192.0.2.5")
+
+	// A chain that ends in a referral is not authoritative
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x1103, "delegated.chain.test", 1))
+	if response.Header.Flags&0x0400 != 0 {
+		t.Errorf("Expected AA to be cleared when the chain ends in a referral")
+	}
+	if len(response.Answers) != 1 || response.Answers[0].ATYPE != 5 {
+		t.Errorf("Expected the CNAME in the answer section, got %v", response.Answers)
+	}
+	if len(response.Authorities) != 1 || response.Authorities[0].ATYPE != 2 || response.Authorities[0].ANAME != "sub.second.test" {
+		t.Errorf("Expected the NS record of sub.second.test in the authority section, got %v", response.Authorities)
+	}
+
+	// A loop stops when it returns to a name already visited
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x1104, "loop1.chain.test", 1))
+	if rcode := response.Header.Flags & 0xF; rcode != 0 || len(response.Answers) != 2 {
+		t.Errorf("Expected NOERROR with the 2 CNAMEs of the loop, got RCODE %d with %d answers", rcode, len(response.Answers))
+	}
+
+	// Long chains stop at the length cap without reaching the address
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x1105, "hop0.chain.test", 1))
+	if len(response.Answers) != 9 {
+		t.Errorf("Expected the chain to stop after 9 CNAMEs, got %d answers", len(response.Answers))
+	}
+	for _, answer := range response.Answers {
+		if answer.ATYPE != 5 {
+			t.Errorf("Expected only CNAMEs in the capped chain, got type %d for %s", answer.ATYPE, answer.ANAME)
+		}
+	}
+
+	// Names below a DNAME get the DNAME, a synthesized CNAME, and the target
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x1106, "www.old.chain.test", 1))
+	if len(response.Answers) != 3 {
+		t.Fatalf("Expected a DNAME, a CNAME and an A record, got %v", response.Answers)
+	}
+	if response.Answers[0].ATYPE != 39 || response.Answers[0].ANAME != "old.chain.test" {
+		t.Errorf("Expected the DNAME owned by old.chain.test first, got type %d owned by %s", response.Answers[0].ATYPE, response.Answers[0].ANAME)
+	}
+	expectChain(t, mydns.DNSMessage{Answers: response.Answers[1:]}, []string{"www.old.chain.test", "www.new.chain.test"}, "192.0.2.4")
+
+	// A substituted name longer than 255 octets is YXDOMAIN
+	longName := strings.Repeat("x", 50) + "." + strings.Repeat("y", 50) + ".short.chain.test"
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x1107, longName, 1))
+	if rcode := response.Header.Flags & 0xF; rcode != 6 {
+		t.Errorf("RCODE mismatch: got %d, expected 6 (YXDOMAIN)", rcode)
+	}
+	if len(response.Answers) != 1 || response.Answers[0].ATYPE != 39 {
+		t.Errorf("Expected only the DNAME in the answer section, got %v", response.Answers)
+	}
+}
+
+// expectChain checks that the answers are CNAMEs owned by the names in
+// order, followed by an A record for the last name.
+func expectChain(t *testing.T, response mydns.DNSMessage, names []string, address string) {
+	t.Helper()
+	if len(response.Answers) != len(names) {
+		t.Fatalf("Expected %d answers, got %v", len(names), response.Answers)
+	}
+	for i, name := range names {
+		answer := response.Answers[i]
+		expectedType := uint16(5)
+		if i == len(names)-1 {
+			expectedType = 1
+		}
+		if answer.ANAME != name || answer.ATYPE != expectedType {
+			t.Errorf("Answer %d: got type %d owned by %s, expected type %d owned by %s", i, answer.ATYPE, answer.ANAME, expectedType, name)
+		}
+	}
+	if last := response.Answers[len(names)-1]; net.IP(last.RDATA).String() != address {
+		t.Errorf("Expected the chain to end at %s, got %s", address, net.IP(last.RDATA))
+	}
+}
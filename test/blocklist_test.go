@@ -0,0 +1,69 @@
+package server_response_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+const testBlocklist = `! Title: test list
+# comment
+0.0.0.0 tracker.example.com
+plain.example.com
+||ads.example.net^
+@@||good.ads.example.net^
+*.metrics.example.org
+/^ad[0-9]+\./
+`
+
+func TestBlocklistFiltering(t *testing.T) {
+	dir := t.TempDir()
+	blocklistFile := filepath.Join(dir, "blocklist.txt")
+	allowlistFile := filepath.Join(dir, "allowlist.txt")
+	if err := os.WriteFile(blocklistFile, []byte(testBlocklist), 0644); err != nil {
+		t.Fatalf("Failed to write blocklist: %v", err)
+	}
+	if err := os.WriteFile(allowlistFile, []byte("ad7.example.com\n"), 0644); err != nil {
+		t.Fatalf("Failed to write allowlist: %v", err)
+	}
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen: "127.0.0.1:2057",
+		Blocklist: &mydns.BlocklistConfig{
+			Files:     []string{blocklistFile},
+			Allowlist: []string{allowlistFile},
+			Response:  "192.0.2.53",
+		},
+	})
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2057")
+	defer conn.Close()
+
+	blocked := []string{"tracker.example.com", "Plain.Example.com", "ads.example.net", "deep.ads.example.net", "x.metrics.example.org", "ad12.example.com"}
+	for i, name := range blocked {
+		response, _ := sendMessageAndParseResponse(t, conn, buildQuery(uint16(0x0300+i), name, 1))
+		if len(response.Answers) != 1 || net.IP(response.Answers[0].RDATA).String() != "192.0.2.53" {
+			t.Errorf("Expected %s to be blocked with 192.0.2.53, got %v", name, response.Answers)
+		}
+	}
+
+	// Exceptions, allowlisted and unlisted names get the placeholder answer
+	allowed := []string{"good.ads.example.net", "ad7.example.com", "www.example.com", "metrics.example.org", "sub.tracker.example.com"}
+	for i, name := range allowed {
+		response, _ := sendMessageAndParseResponse(t, conn, buildQuery(uint16(0x0310+i), name, 1))
+		if len(response.Answers) != 1 || net.IP(response.Answers[0].RDATA).String() != "0.0.0.0" {
+			t.Errorf("Expected %s not to be blocked, got %v", name, response.Answers)
+		}
+	}
+
+	// Blocked names have no records of other types
+	response, _ := sendMessageAndParseResponse(t, conn, buildQuery(0x0320, "ads.example.net", 28))
+	if rcode := response.Header.Flags & 0xF; rcode != 0 || len(response.Answers) != 0 {
+		t.Errorf("Expected NODATA for a blocked AAAA query, got RCODE %d with %d answers", rcode, len(response.Answers))
+	}
+}
@@ -0,0 +1,109 @@
+package server_response_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+type cachedAnswer struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	TTL     uint32   `json:"ttl"`
+	Hits    int      `json:"hits"`
+	Records []string `json:"records"`
+}
+
+func adminCall(t *testing.T, method string, url string, body string, result any) {
+	t.Helper()
+	adminCallWithToken(t, method, url, "", body, result)
+}
+
+func adminCallWithToken(t *testing.T, method string, url string, token string, body string, result any) {
+	t.Helper()
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Failed to call the admin API: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 from %s %s, got %s", method, url, response.Status)
+	}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		t.Fatalf("Failed to decode the response: %v", err)
+	}
+}
+
+func TestCacheAdmin(t *testing.T) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2086})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	var answered atomic.Int32
+	go serveTestUpstream(upstream, 300, nil, &answered)
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen:   "127.0.0.1:2087",
+		Resolver: "127.0.0.1:2086",
+		Admin:    &mydns.AdminConfig{Listen: "127.0.0.1:2088"},
+	})
+	time.Sleep(1 * time.Second)
+	answered.Store(0)
+
+	conn := dialServer(t, "127.0.0.1:2087")
+	defer conn.Close()
+	sendMessageAndParseResponse(t, conn, buildQuery(0x1001, "www.admin.test", 1))
+	sendMessageAndParseResponse(t, conn, buildQuery(0x1002, "www.admin.test", 1))
+	sendMessageAndParseResponse(t, conn, buildQuery(0x1003, "other.test", 1))
+
+	// Listing by wildcard shows only the names below it, with their hits
+	var entries []cachedAnswer
+	adminCall(t, "GET", "http://127.0.0.1:2088/cache?name=*.admin.test", "", &entries)
+	if len(entries) != 1 || entries[0].Name != "www.admin.test." || entries[0].Type != "A" || entries[0].Hits != 1 || entries[0].TTL > 300 {
+		t.Fatalf("Expected www.admin.test with one hit, got %+v", entries)
+	}
+
+	// Seeded records are answered without asking the resolver
+	var seeded map[string]int
+	adminCall(t, "POST", "http://127.0.0.1:2088/cache", `{"records": ["seeded.admin.test. 600 IN A 192.0.2.60"]}`, &seeded)
+	if seeded["seeded"] != 1 {
+		t.Errorf("Expected one seeded answer, got %v", seeded)
+	}
+	response, _ := sendMessageAndParseResponse(t, conn, buildQuery(0x1004, "seeded.admin.test", 1))
+	if len(response.Answers) != 1 || net.IP(response.Answers[0].RDATA).String() != "192.0.2.60" {
+		t.Errorf("Expected the seeded address 192.0.2.60, got %v", response.Answers)
+	}
+	if count := answered.Load(); count != 2 {
+		t.Errorf("Expected 2 upstream queries, got %d", count)
+	}
+
+	// Flushing a subtree leaves the other names cached
+	var flushed map[string]int
+	adminCall(t, "DELETE", "http://127.0.0.1:2088/cache?name=admin.test&subtree=true", "", &flushed)
+	if flushed["flushed"] != 2 {
+		t.Errorf("Expected 2 flushed answers, got %v", flushed)
+	}
+	adminCall(t, "GET", "http://127.0.0.1:2088/cache", "", &entries)
+	if len(entries) != 1 || entries[0].Name != "other.test." {
+		t.Errorf("Expected only other.test to be cached, got %+v", entries)
+	}
+
+	adminCall(t, "DELETE", "http://127.0.0.1:2088/cache", "", &flushed)
+	if flushed["flushed"] != 1 {
+		t.Errorf("Expected the last answer to be flushed, got %v", flushed)
+	}
+}
@@ -0,0 +1,87 @@
+package server_response_test
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+func TestCachePersistence(t *testing.T) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2083})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	var answered atomic.Int32
+	go serveTestUpstream(upstream, 300, nil, &answered)
+
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	first, err := mydns.NewDNSServer(mydns.Config{
+		Listen:   "127.0.0.1:2084",
+		Resolver: "127.0.0.1:2083",
+		Cache:    &mydns.CacheConfig{File: cacheFile},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	go first.Serve()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2084")
+	defer conn.Close()
+	sendMessageAndParseResponse(t, conn, buildQuery(0x0f01, "saved.cache.test", 1))
+	sendMessageAndParseResponse(t, conn, buildQuery(0x0f03, "other.cache.test", 1))
+	first.Shutdown()
+
+	// An entry that cannot be read is skipped without losing the others
+	data, err := os.ReadFile(cacheFile)
+	if err != nil {
+		t.Fatalf("Failed to read the cache file: %v", err)
+	}
+	var saved map[string]any
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("Failed to parse the cache file: %v", err)
+	}
+	entries := saved["entries"].([]any)
+	bad := map[string]any{"name": "bad.cache.test", "type": 1, "class": 1, "stored": time.Now(), "expires": time.Now().Add(time.Hour), "response": []byte{1, 2, 3}}
+	saved["entries"] = []any{entries[0], bad, entries[1]}
+	if data, err = json.Marshal(saved); err != nil {
+		t.Fatalf("Failed to encode the cache file: %v", err)
+	}
+	if err := os.WriteFile(cacheFile, data, 0644); err != nil {
+		t.Fatalf("Failed to write the cache file: %v", err)
+	}
+
+	// A server started later with the same file answers from the restored
+	// cache, with TTLs that counted down in between
+	time.Sleep(1100 * time.Millisecond)
+	second, err := mydns.NewDNSServer(mydns.Config{
+		Listen:   "127.0.0.1:2085",
+		Resolver: "127.0.0.1:2083",
+		Cache:    &mydns.CacheConfig{File: cacheFile},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	go second.Serve()
+	time.Sleep(1 * time.Second)
+	answered.Store(0)
+
+	restored := dialServer(t, "127.0.0.1:2085")
+	defer restored.Close()
+	for i, name := range []string{"saved.cache.test", "other.cache.test"} {
+		response, _ := sendMessageAndParseResponse(t, restored, buildQuery(0x0f04+uint16(i), name, 1))
+		if len(response.Answers) != 1 || response.Answers[0].TTL >= 300 {
+			t.Errorf("Expected a restored answer for %s with a TTL below 300, got %v", name, response.Answers)
+		}
+	}
+	if count := answered.Load(); count != 0 {
+		t.Errorf("Expected no upstream queries, got %d", count)
+	}
+}
@@ -0,0 +1,169 @@
+package server_response_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+var (
+	testClientCookie   = []byte("clientck")
+	testUpstreamCookie = []byte("upstream-cookie!")
+)
+
+func TestDNSCookies(t *testing.T) {
+	// An upstream that records the cookies it is sent and returns its own
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2073})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	received := make(chan []byte, 10)
+	go serveCookieUpstream(upstream, received)
+
+	zero := 0
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen:    "127.0.0.1:2071",
+		RateLimit: &mydns.RateLimitConfig{ResponsesPerSecond: 1, Slip: &zero},
+	})
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen:  "127.0.0.1:2072",
+		Cookies: mydns.CookieConfig{Require: true},
+	})
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen:   "127.0.0.1:2074",
+		Resolver: "127.0.0.1:2073",
+	})
+	time.Sleep(1 * time.Second)
+
+	// A client cookie alone gets a server cookie back
+	conn := dialServer(t, "127.0.0.1:2071")
+	defer conn.Close()
+	response, _ := sendMessageAndParseResponse(t, conn, withCookie(buildQuery(0x0a01, "codecrafters.io", 1), testClientCookie))
+	cookie := findCookie(response)
+	if len(cookie) != 24 || !bytes.Equal(cookie[:8], testClientCookie) || cookie[8] != 1 {
+		t.Fatalf("Expected the client cookie and a version 1 server cookie, got %x", cookie)
+	}
+
+	// Over the rate limit, only queries with a valid server cookie are answered
+	if _, received := queryWithTimeout(t, conn, withCookie(buildQuery(0x0a02, "codecrafters.io", 1), testClientCookie)); received {
+		t.Errorf("Expected the query without a server cookie to be dropped")
+	}
+	if _, received := queryWithTimeout(t, conn, withCookie(buildQuery(0x0a03, "codecrafters.io", 1), cookie)); !received {
+		t.Errorf("Expected the query with a valid server cookie to be answered")
+	}
+
+	// When cookies are required, clients without a server cookie get BADCOOKIE
+	required := dialServer(t, "127.0.0.1:2072")
+	defer required.Close()
+	response, _ = sendMessageAndParseResponse(t, required, withCookie(buildQuery(0x0a04, "codecrafters.io", 1), testClientCookie))
+	if rcode := extendedRcode(response); rcode != 23 || len(response.Answers) != 0 {
+		t.Fatalf("Expected BADCOOKIE without answers, got RCODE %d with %v", rcode, response.Answers)
+	}
+	response, _ = sendMessageAndParseResponse(t, required, withCookie(buildQuery(0x0a05, "codecrafters.io", 1), findCookie(response)))
+	if rcode := extendedRcode(response); rcode != 0 || len(response.Answers) != 1 {
+		t.Errorf("Expected an answer with the server cookie, got RCODE %d with %v", rcode, response.Answers)
+	}
+	response, _ = sendMessageAndParseResponse(t, required, withCookie(buildQuery(0x0a06, "codecrafters.io", 1), []byte("short")))
+	if rcode := extendedRcode(response); rcode != 1 {
+		t.Errorf("Expected FORMERR for a malformed cookie, got RCODE %d", rcode)
+	}
+
+	// Forwarded queries carry the server's own cookies, and clients get
+	// theirs, or no OPT record if they sent none
+	forwarding := dialServer(t, "127.0.0.1:2074")
+	defer forwarding.Close()
+	response, _ = sendMessageAndParseResponse(t, forwarding, withCookie(buildQuery(0x0a07, "www.upstream.test", 1), testClientCookie))
+	if cookie := findCookie(response); len(cookie) != 24 || !bytes.Equal(cookie[:8], testClientCookie) {
+		t.Errorf("Expected the forwarding server's cookie for the client, got %x", cookie)
+	}
+	response, _ = sendMessageAndParseResponse(t, forwarding, buildQuery(0x0a08, "other.upstream.test", 1))
+	if len(response.Additionals) != 0 {
+		t.Errorf("Expected no OPT record for a query without one, got %v", response.Additionals)
+	}
+
+	sent := [][]byte{<-received, <-received, <-received}
+	if len(sent[0]) != 8 {
+		t.Errorf("Expected the first query upstream to have only a client cookie, got %x", sent[0])
+	}
+	for _, cookie := range sent[1:] {
+		if len(cookie) != 24 || !bytes.Equal(cookie[:8], sent[0]) || !bytes.Equal(cookie[8:], testUpstreamCookie) {
+			t.Errorf("Expected the upstream's server cookie to be sent back, got %x", cookie)
+		}
+	}
+}
+
+func serveCookieUpstream(conn *net.UDPConn, received chan<- []byte) {
+	packet := make([]byte, 4096)
+	for {
+		n, source, err := conn.ReadFromUDP(packet)
+		if err != nil {
+			return
+		}
+		query, err := mydns.ParseDNSMessage(packet[:n])
+		if err != nil {
+			continue
+		}
+		cookie := findCookie(query)
+		received <- cookie
+		response := mydns.DNSMessage{
+			Header:    mydns.DNSHeader{ID: query.Header.ID, Flags: 1<<15 | 1<<8 | 1<<7},
+			Questions: query.Questions,
+			Answers: []mydns.DNSAnswer{{
+				ANAME: query.Questions[0].QNAME, ATYPE: 1, ACLASS: 1, TTL: 60, RDATA: net.ParseIP("192.0.2.90").To4(),
+			}},
+		}
+		if cookie != nil {
+			response.Additionals = []mydns.DNSAnswer{cookieOPT(append(append([]byte{}, cookie[:8]...), testUpstreamCookie...))}
+		}
+		conn.WriteToUDP(mydns.PackDNSMessage(response), source)
+	}
+}
+
+func cookieOPT(cookie []byte) mydns.DNSAnswer {
+	rdata := binary.BigEndian.AppendUint16(nil, 10)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(cookie)))
+	return mydns.DNSAnswer{ATYPE: 41, ACLASS: 1232, RDATA: append(rdata, cookie...)}
+}
+
+// withCookie adds an OPT record with a COOKIE option to a query.
+func withCookie(query []byte, cookie []byte) []byte {
+	message, _ := mydns.ParseDNSMessage(query)
+	message.Additionals = append(message.Additionals, cookieOPT(cookie))
+	return mydns.PackDNSMessage(message)
+}
+
+func findCookie(message mydns.DNSMessage) []byte {
+	return findOption(message, 10)
+}
+
+// findOption returns the data of an EDNS option in a message's OPT record.
+func findOption(message mydns.DNSMessage, option uint16) []byte {
+	for _, record := range message.Additionals {
+		if record.ATYPE != 41 {
+			continue
+		}
+		for rdata := record.RDATA; len(rdata) >= 4; {
+			code, length := binary.BigEndian.Uint16(rdata), binary.BigEndian.Uint16(rdata[2:])
+			if code == option {
+				return rdata[4 : 4+length]
+			}
+			rdata = rdata[4+length:]
+		}
+	}
+	return nil
+}
+
+func extendedRcode(message mydns.DNSMessage) uint16 {
+	rcode := message.Header.Flags & 0xF
+	for _, record := range message.Additionals {
+		if record.ATYPE == 41 {
+			rcode |= uint16(record.TTL>>24) << 4
+		}
+	}
+	return rcode
+}
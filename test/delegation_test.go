@@ -0,0 +1,84 @@
+package server_response_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+const delegationTestZone = `$ORIGIN parent.test.
+$TTL 300
+@		IN	SOA	ns1 admin 1 3600 900 604800 60
+		IN	NS	ns1
+ns1		IN	A	192.0.2.1
+child		IN	NS	ns1.child
+child		IN	NS	ns.other.example.
+child		IN	DS	\# 4 01020304
+ns1.child	IN	A	192.0.2.53
+ns1.child	IN	AAAA	2001:db8::53
+`
+
+func TestDelegation(t *testing.T) {
+	zoneFile := filepath.Join(t.TempDir(), "parent.test.zone")
+	if err := os.WriteFile(zoneFile, []byte(delegationTestZone), 0644); err != nil {
+		t.Fatalf("Failed to write zone file: %v", err)
+	}
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen: "127.0.0.1:2100",
+		Zones:  []mydns.ZoneConfig{{Name: "parent.test", File: zoneFile}},
+	})
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2100")
+	defer conn.Close()
+
+	// Names in the parent zone are answered authoritatively
+	response, _ := sendMessageAndParseResponse(t, conn, buildQuery(0x1001, "ns1.parent.test", 1))
+	if response.Header.Flags&0x0400 == 0 || len(response.Answers) != 1 {
+		t.Errorf("Expected an authoritative answer for ns1.parent.test, got flags %x with %d answers", response.Header.Flags, len(response.Answers))
+	}
+
+	// Names below the cut are referred to the child's name servers
+	for _, name := range []string{"child.parent.test", "www.child.parent.test"} {
+		response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x1002, name, 1))
+		if response.Header.Flags&0x0400 != 0 {
+			t.Errorf("Expected AA to be cleared on the referral for %s", name)
+		}
+		if rcode := response.Header.Flags & 0xF; rcode != 0 || len(response.Answers) != 0 {
+			t.Errorf("Expected an empty NOERROR referral for %s, got RCODE %d with %d answers", name, rcode, len(response.Answers))
+		}
+		if len(response.Authorities) != 2 {
+			t.Fatalf("Expected the 2 NS records of the cut in the authority section for %s, got %v", name, response.Authorities)
+		}
+		for _, authority := range response.Authorities {
+			if authority.ATYPE != 2 || authority.ANAME != "child.parent.test" {
+				t.Errorf("Expected NS records owned by child.parent.test, got type %d owned by %s", authority.ATYPE, authority.ANAME)
+			}
+		}
+
+		// Only the name server inside the zone gets glue
+		glue := map[uint16]bool{}
+		for _, additional := range response.Additionals {
+			if additional.ANAME != "ns1.child.parent.test" {
+				t.Errorf("Unexpected glue for %s", additional.ANAME)
+			}
+			glue[additional.ATYPE] = true
+		}
+		if len(response.Additionals) != 2 || !glue[1] || !glue[28] {
+			t.Errorf("Expected A and AAAA glue for ns1.child.parent.test, got %v", response.Additionals)
+		}
+	}
+
+	// The DS records of the cut are answered by the parent
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x1003, "child.parent.test", 43))
+	if response.Header.Flags&0x0400 == 0 {
+		t.Errorf("Expected the DS answer to be authoritative")
+	}
+	if len(response.Answers) != 1 || response.Answers[0].ATYPE != 43 || len(response.Authorities) != 0 {
+		t.Errorf("Expected the DS record in the answer section and no referral, got %v and %v", response.Answers, response.Authorities)
+	}
+}
@@ -0,0 +1,181 @@
+package server_response_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+// readFrame reads a Frame Streams frame, returning the type of control
+// frames and the payload of data frames.
+func readFrame(t *testing.T, r io.Reader) (uint32, []byte) {
+	t.Helper()
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		t.Fatalf("Failed to read a frame: %v", err)
+	}
+	control := length == 0
+	if control {
+		binary.Read(r, binary.BigEndian, &length)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		t.Fatalf("Failed to read a frame: %v", err)
+	}
+	if control {
+		if !bytes.Contains(frame, []byte("protobuf:dnstap.Dnstap")) && binary.BigEndian.Uint32(frame) != 3 {
+			t.Errorf("Expected the dnstap content type in control frame %d", binary.BigEndian.Uint32(frame))
+		}
+		return binary.BigEndian.Uint32(frame), nil
+	}
+	return 0, frame
+}
+
+func writeControlFrame(w io.Writer, controlType uint32) {
+	control := binary.BigEndian.AppendUint32(nil, controlType)
+	control = binary.BigEndian.AppendUint32(control, 1)
+	control = binary.BigEndian.AppendUint32(control, uint32(len("protobuf:dnstap.Dnstap")))
+	control = append(control, "protobuf:dnstap.Dnstap"...)
+	frame := binary.BigEndian.AppendUint32(nil, 0)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(control)))
+	w.Write(append(frame, control...))
+}
+
+// protobufFields decodes the varint and length-delimited fields of a
+// protocol buffer message, skipping fixed32 ones.
+func protobufFields(t *testing.T, b []byte) map[uint64][]byte {
+	t.Helper()
+	fields := make(map[uint64][]byte)
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		b = b[n:]
+		switch key & 7 {
+		case 0:
+			value, n := binary.Uvarint(b)
+			fields[key>>3] = binary.AppendUvarint(nil, value)
+			b = b[n:]
+		case 2:
+			length, n := binary.Uvarint(b)
+			fields[key>>3] = b[n : n+int(length)]
+			b = b[n+int(length):]
+		case 5:
+			b = b[4:]
+		default:
+			t.Fatalf("Unexpected wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+// dnstapMessageType returns the type of the Message in a Dnstap frame.
+func dnstapMessageType(t *testing.T, frame []byte) uint64 {
+	t.Helper()
+	dnstap := protobufFields(t, frame)
+	if string(dnstap[1]) != "dnstap-test" {
+		t.Errorf("Expected the identity dnstap-test, got %q", dnstap[1])
+	}
+	messageType, _ := binary.Uvarint(protobufFields(t, dnstap[14])[1])
+	return messageType
+}
+
+func TestDnstapFile(t *testing.T) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2097})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	go serveTestUpstream(upstream, 300, nil, nil)
+
+	tapFile := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	server, err := mydns.NewDNSServer(mydns.Config{
+		Listen:   "127.0.0.1:2098",
+		Resolver: "127.0.0.1:2097",
+		Dnstap:   &mydns.DnstapConfig{File: tapFile, Identity: "dnstap-test"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	go server.Serve()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2098")
+	defer conn.Close()
+	sendMessageAndParseResponse(t, conn, buildQuery(0x1401, "www.dnstap.test", 1))
+	sendMessageAndParseResponse(t, conn, buildQuery(0x1402, "www.dnstap.test", 1))
+	server.Shutdown()
+
+	data, err := os.ReadFile(tapFile)
+	if err != nil {
+		t.Fatalf("Failed to read the dnstap file: %v", err)
+	}
+	r := bytes.NewReader(data)
+	if control, _ := readFrame(t, r); control != 2 {
+		t.Fatalf("Expected a START frame, got %d", control)
+	}
+	var types []uint64
+	for {
+		control, frame := readFrame(t, r)
+		if control == 3 {
+			break
+		}
+		types = append(types, dnstapMessageType(t, frame))
+	}
+
+	// The first query is forwarded and the second answered from the cache
+	expected := []uint64{5, 7, 8, 6, 5, 6}
+	if !slices.Equal(types, expected) {
+		t.Errorf("Expected messages %v, got %v", expected, types)
+	}
+}
+
+func TestDnstapSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "dnstap.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	server, err := mydns.NewDNSServer(mydns.Config{
+		Listen: "127.0.0.1:2099",
+		Dnstap: &mydns.DnstapConfig{Socket: socket, Identity: "dnstap-test"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	go server.Serve()
+
+	reader, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer reader.Close()
+	reader.SetDeadline(time.Now().Add(5 * time.Second))
+	if control, _ := readFrame(t, reader); control != 4 {
+		t.Fatalf("Expected a READY frame, got %d", control)
+	}
+	writeControlFrame(reader, 1) // ACCEPT
+	if control, _ := readFrame(t, reader); control != 2 {
+		t.Fatalf("Expected a START frame, got %d", control)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	conn := dialServer(t, "127.0.0.1:2099")
+	defer conn.Close()
+	sendMessageAndParseResponse(t, conn, buildQuery(0x1403, "www.dnstap.test", 1))
+
+	for _, expected := range []uint64{5, 6} {
+		_, frame := readFrame(t, reader)
+		if messageType := dnstapMessageType(t, frame); messageType != expected {
+			t.Errorf("Expected message type %d, got %d", expected, messageType)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package server_response_test
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+const updateTestZone = `$ORIGIN update.test.
+$TTL 300
+@	IN	SOA	ns1 admin (
+		2024010101 ; serial
+		3600 900 604800 60 )
+	IN	NS	ns1
+ns1	IN	A	192.0.2.1
+`
+
+func TestDynamicUpdate(t *testing.T) {
+	dir := t.TempDir()
+	zoneFile := filepath.Join(dir, "update.test.zone")
+	journal := filepath.Join(dir, "update.test.jnl")
+	if err := os.WriteFile(zoneFile, []byte(updateTestZone), 0644); err != nil {
+		t.Fatalf("Failed to write zone file: %v", err)
+	}
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen: "127.0.0.1:2054",
+		Zones: []mydns.ZoneConfig{
+			{Name: "update.test", File: zoneFile, Journal: journal, AllowUpdate: []string{"127.0.0.1"}},
+		},
+	})
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2054")
+	defer conn.Close()
+
+	// The name does not exist before the update
+	response, _ := sendMessageAndParseResponse(t, conn, buildQuery(0x0001, "host.update.test", 1))
+	if rcode := response.Header.Flags & 0xF; rcode != 3 {
+		t.Errorf("RCODE mismatch: got %d, expected 3 (NXDOMAIN)", rcode)
+	}
+
+	// Add host.update.test only if the name is not already in use
+	update := mydns.DNSMessage{
+		Header:    mydns.DNSHeader{ID: 0x0002, Flags: 5 << 11},
+		Questions: []mydns.DNSQuestion{{QNAME: "update.test", QTYPE: 6, QCLASS: 1}},
+		Answers: []mydns.DNSAnswer{
+			{ANAME: "host.update.test", ATYPE: 255, ACLASS: 254},
+		},
+		Authorities: []mydns.DNSAnswer{
+			{ANAME: "host.update.test", ATYPE: 1, ACLASS: 1, TTL: 120, RDATA: []byte{192, 0, 2, 10}},
+		},
+	}
+	response, _ = sendMessageAndParseResponse(t, conn, mydns.PackDNSMessage(update))
+	if response.Header.Flags != 0xA800 { // QR=1, OPCODE=UPDATE, RCODE=0
+		t.Errorf("Flags mismatch: got %x, expected %x", response.Header.Flags, 0xA800)
+	}
+
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0003, "host.update.test", 1))
+	if response.Header.Flags&0x0400 == 0 {
+		t.Errorf("Expected an authoritative answer")
+	}
+	if len(response.Answers) != 1 || net.IP(response.Answers[0].RDATA).String() != "192.0.2.10" {
+		t.Fatalf("Expected host.update.test to resolve to 192.0.2.10, got %v", response.Answers)
+	}
+	if response.Answers[0].TTL != 120 {
+		t.Errorf("TTL mismatch: got %d, expected 120", response.Answers[0].TTL)
+	}
+
+	// The same prerequisite now fails
+	update.Header.ID = 0x0004
+	response, _ = sendMessageAndParseResponse(t, conn, mydns.PackDNSMessage(update))
+	if rcode := response.Header.Flags & 0xF; rcode != 6 {
+		t.Errorf("RCODE mismatch: got %d, expected 6 (YXDOMAIN)", rcode)
+	}
+
+	// The serial was bumped and the change journaled
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0005, "update.test", 6))
+	if len(response.Answers) != 1 {
+		t.Fatalf("Expected 1 SOA record, got %d", len(response.Answers))
+	}
+	soa := response.Answers[0].RDATA
+	if serial := binary.BigEndian.Uint32(soa[len(soa)-20:]); serial != 2024010102 {
+		t.Errorf("Serial mismatch: got %d, expected 2024010102", serial)
+	}
+	contents, err := os.ReadFile(journal)
+	if err != nil {
+		t.Fatalf("Failed to read journal: %v", err)
+	}
+	if !strings.Contains(string(contents), "add host.update.test. 120 IN A 192.0.2.10") {
+		t.Errorf("Journal is missing the added record:\n%s", contents)
+	}
+
+	// Updates for zones the server does not serve are rejected
+	update.Header.ID = 0x0006
+	update.Questions[0].QNAME = "other.test"
+	response, _ = sendMessageAndParseResponse(t, conn, mydns.PackDNSMessage(update))
+	if rcode := response.Header.Flags & 0xF; rcode != 9 {
+		t.Errorf("RCODE mismatch: got %d, expected 9 (NOTAUTH)", rcode)
+	}
+}
+
+func dialServer(t *testing.T, address string) *net.UDPConn {
+	serverAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		t.Fatalf("Failed to resolve server address: %v", err)
+	}
+	conn, err := net.DialUDP("udp", nil, serverAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	return conn
+}
+
+func buildQuery(id uint16, name string, qtype uint16) []byte {
+	return mydns.PackDNSMessage(mydns.DNSMessage{
+		Header:    mydns.DNSHeader{ID: id},
+		Questions: []mydns.DNSQuestion{{QNAME: name, QTYPE: qtype, QCLASS: 1}},
+	})
+}
@@ -0,0 +1,48 @@
+package server_response_test
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+func TestExtendedDNSErrors(t *testing.T) {
+	// Nothing listens on the forwarder's port, so forwarding fails at once
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen: "127.0.0.1:2075",
+		Views:  []mydns.ViewConfig{{Name: "broken", Forwarders: []string{"127.0.0.1:2076"}}},
+	})
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2075")
+	defer conn.Close()
+
+	// Forwarding failures are SERVFAIL, explained to clients using EDNS
+	response, _ := sendMessageAndParseResponse(t, conn, withCookie(buildQuery(0x0b01, "codecrafters.io", 1), testClientCookie))
+	if rcode := response.Header.Flags & 0xF; rcode != 2 {
+		t.Errorf("RCODE mismatch: got %d, expected 2 (SERVFAIL)", rcode)
+	}
+	ede := findOption(response, 15)
+	if len(ede) < 2 || binary.BigEndian.Uint16(ede) != 23 || string(ede[2:]) != "no resolver could be reached" {
+		t.Errorf("Expected a Network Error, got %q", ede)
+	}
+	if strings.Contains(string(ede), "127.0.0.1") {
+		t.Errorf("Expected the EDE text not to reveal any addresses, got %q", ede)
+	}
+
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0b02, "codecrafters.io", 1))
+	if rcode := response.Header.Flags & 0xF; rcode != 2 || len(response.Additionals) != 0 {
+		t.Errorf("Expected SERVFAIL without an OPT record, got RCODE %d with %v", rcode, response.Additionals)
+	}
+
+	// Unsupported classes are refused as Not Supported
+	query := buildQuery(0x0b03, "codecrafters.io", 1)
+	binary.BigEndian.PutUint16(query[len(query)-2:], 3) // CH
+	response, _ = sendMessageAndParseResponse(t, conn, withCookie(query, testClientCookie))
+	if ede := findOption(response, 15); response.Header.Flags&0xF != 5 || len(ede) < 2 || binary.BigEndian.Uint16(ede) != 21 {
+		t.Errorf("Expected REFUSED with Not Supported, got RCODE %d with %q", response.Header.Flags&0xF, ede)
+	}
+}
@@ -0,0 +1,123 @@
+package server_response_test
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+const hostsTestFile = `# Hosts served by the test
+192.0.2.10	web.hosts.test web alias.hosts.test	# trailing comment
+2001:db8::10	web.hosts.test
+fe80::1%eth0	linklocal.hosts.test
+# 192.0.2.99	commented.hosts.test
+`
+
+const hostsUpstreamZone = `$ORIGIN hosts.test.
+$TTL 300
+@		IN	SOA	ns1 admin 1 3600 900 604800 60
+		IN	NS	ns1
+ns1		IN	A	192.0.2.1
+forwarded	IN	A	192.0.2.50
+commented	IN	A	192.0.2.51
+`
+
+func TestHostsFiles(t *testing.T) {
+	dir := t.TempDir()
+	zoneFile := filepath.Join(dir, "hosts.test.zone")
+	if err := os.WriteFile(zoneFile, []byte(hostsUpstreamZone), 0644); err != nil {
+		t.Fatalf("Failed to write zone file: %v", err)
+	}
+	hostsFile := filepath.Join(dir, "hosts")
+	if err := os.WriteFile(hostsFile, []byte(hostsTestFile), 0644); err != nil {
+		t.Fatalf("Failed to write hosts file: %v", err)
+	}
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen: "127.0.0.1:2104",
+		Zones:  []mydns.ZoneConfig{{Name: "hosts.test", File: zoneFile}},
+	})
+	time.Sleep(1 * time.Second)
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen:     "127.0.0.1:2105",
+		Resolver:   "127.0.0.1:2104",
+		HostsFiles: []string{hostsFile},
+	})
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2105")
+	defer conn.Close()
+
+	// Every name on a line, aliases included, resolves to the address
+	for _, name := range []string{"web.hosts.test", "web", "ALIAS.hosts.test"} {
+		response, _ := sendMessageAndParseResponse(t, conn, buildQuery(0x1301, name, 1))
+		if len(response.Answers) != 1 || net.IP(response.Answers[0].RDATA).String() != "192.0.2.10" {
+			t.Errorf("Expected %s to resolve to 192.0.2.10, got %v", name, response.Answers)
+		}
+	}
+
+	// IPv6 addresses answer AAAA queries, and zone identifiers are dropped
+	response, _ := sendMessageAndParseResponse(t, conn, buildQuery(0x1302, "web.hosts.test", 28))
+	if len(response.Answers) != 1 || net.IP(response.Answers[0].RDATA).String() != "2001:db8::10" {
+		t.Errorf("Expected web.hosts.test to resolve to 2001:db8::10, got %v", response.Answers)
+	}
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x1303, "linklocal.hosts.test", 28))
+	if len(response.Answers) != 1 || net.IP(response.Answers[0].RDATA).String() != "fe80::1" {
+		t.Errorf("Expected linklocal.hosts.test to resolve to fe80::1, got %v", response.Answers)
+	}
+
+	// A name in the file without an address of the type is NODATA
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x1304, "alias.hosts.test", 28))
+	if rcode := response.Header.Flags & 0xF; rcode != 0 || len(response.Answers) != 0 {
+		t.Errorf("Expected NODATA for the AAAA of alias.hosts.test, got RCODE %d with %d answers", rcode, len(response.Answers))
+	}
+
+	// Addresses resolve back to the first name on their line
+	reverse := map[string]string{
+		"10.2.0.192.in-addr.arpa": "web.hosts.test",
+		"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa": "web.hosts.test",
+	}
+	for name, target := range reverse {
+		response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x1305, name, 12))
+		if len(response.Answers) != 1 || !bytes.Equal(response.Answers[0].RDATA, encodeTestName(target)) {
+			t.Errorf("Expected %s to point to %s, got %v", name, target, response.Answers)
+		}
+	}
+
+	// Names the files do not contain, including commented out ones, are forwarded
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x1306, "forwarded.hosts.test", 1))
+	if len(response.Answers) != 1 || net.IP(response.Answers[0].RDATA).String() != "192.0.2.50" {
+		t.Errorf("Expected forwarded.hosts.test to be forwarded, got %v", response.Answers)
+	}
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x1307, "commented.hosts.test", 1))
+	if len(response.Answers) != 1 || net.IP(response.Answers[0].RDATA).String() != "192.0.2.51" {
+		t.Errorf("Expected commented.hosts.test to be forwarded, got %v", response.Answers)
+	}
+
+	// Changes to the file are picked up without a restart
+	updated := hostsTestFile + "192.0.2.30\tnew.hosts.test\n"
+	if err := os.WriteFile(hostsFile, []byte(updated), 0644); err != nil {
+		t.Fatalf("Failed to update hosts file: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(hostsFile, later, later); err != nil {
+		t.Fatalf("Failed to change the hosts file's modification time: %v", err)
+	}
+	deadline := time.Now().Add(8 * time.Second)
+	for {
+		response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x1308, "new.hosts.test", 1))
+		if len(response.Answers) == 1 && net.IP(response.Answers[0].RDATA).String() == "192.0.2.30" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected new.hosts.test to resolve after the reload, got %v", response.Answers)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
@@ -0,0 +1,50 @@
+package server_response_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+func TestAlwaysAnswers(t *testing.T) {
+	server, err := mydns.NewDNSServer(mydns.Config{
+		Listen: "127.0.0.1:2077",
+		Views:  []mydns.ViewConfig{{Name: "broken", Forwarders: []string{"127.0.0.1:2078"}}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	go server.Serve()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2077")
+	defer conn.Close()
+
+	// A query claiming an additional record it does not have is answered
+	// with FORMERR, echoing its ID and question
+	query := buildQuery(0x0c01, "codecrafters.io", 1)
+	query[11] = 1 // ARCOUNT
+	response, _ := sendMessageAndParseResponse(t, conn, query)
+	if response.Header.ID != 0x0c01 || response.Header.Flags&0xF != 1 {
+		t.Errorf("Expected FORMERR for query 0x0c01, got ID %#04x with RCODE %d", response.Header.ID, response.Header.Flags&0xF)
+	}
+	if len(response.Questions) != 1 || response.Questions[0].QNAME != "codecrafters.io" {
+		t.Errorf("Expected the question to be echoed, got %v", response.Questions)
+	}
+
+	// Packets without a whole header are dropped
+	if _, received := queryWithTimeout(t, conn, []byte{0x0c, 0x02, 0x01}); received {
+		t.Errorf("Expected no response to a 3 byte packet")
+	}
+
+	// Forwarding failures are SERVFAIL
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0c03, "codecrafters.io", 1))
+	if rcode := response.Header.Flags & 0xF; rcode != 2 {
+		t.Errorf("RCODE mismatch: got %d, expected 2 (SERVFAIL)", rcode)
+	}
+
+	if stats := server.QueryStats(); stats.FormErr != 1 || stats.ServFail != 1 || stats.Unparseable != 1 {
+		t.Errorf("Expected one each of FORMERR, SERVFAIL and unparseable, got %+v", stats)
+	}
+}
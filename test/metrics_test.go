@@ -0,0 +1,69 @@
+package server_response_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+func TestMetrics(t *testing.T) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2092})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	go serveTestUpstream(upstream, 300, nil, nil)
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen:   "127.0.0.1:2093",
+		Resolver: "127.0.0.1:2092",
+		Admin:    &mydns.AdminConfig{Listen: "127.0.0.1:2094"},
+	})
+	// Another server in the process forwarding to the same resolver keeps
+	// its own upstream counters
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen:   "127.0.0.1:2110",
+		Resolver: "127.0.0.1:2092",
+	})
+	time.Sleep(1 * time.Second)
+
+	other := dialServer(t, "127.0.0.1:2110")
+	defer other.Close()
+	sendMessageAndParseResponse(t, other, buildQuery(0x1200, "other.metrics.test", 1))
+
+	conn := dialServer(t, "127.0.0.1:2093")
+	defer conn.Close()
+	sendMessageAndParseResponse(t, conn, buildQuery(0x1201, "www.metrics.test", 1))
+	sendMessageAndParseResponse(t, conn, buildQuery(0x1202, "www.metrics.test", 1))
+
+	response, err := http.Get("http://127.0.0.1:2094/metrics")
+	if err != nil {
+		t.Fatalf("Failed to get the metrics: %v", err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	metrics := string(body)
+
+	for _, expected := range []string{
+		`dns_responses_total{type="A",rcode="NOERROR",transport="udp"} 2`,
+		`dns_response_duration_seconds_count{transport="udp"} 2`,
+		`dns_response_duration_seconds_bucket{transport="udp",le="+Inf"} 2`,
+		`dns_queries_received_total 2`,
+		`dns_cache_hits_total{view="default"} 1`,
+		`dns_cache_misses_total{view="default"} 1`,
+		`dns_cache_entries{view="default"} 1`,
+		`dns_upstream_queries_total{resolver="127.0.0.1:2092"} 1`,
+		`dns_upstream_rtt_seconds_count{resolver="127.0.0.1:2092"} 1`,
+		"# TYPE dns_response_duration_seconds histogram",
+		"# TYPE dns_goroutines gauge",
+	} {
+		if !strings.Contains(metrics, expected+"\n") {
+			t.Errorf("Expected the metrics to contain %q", expected)
+		}
+	}
+}
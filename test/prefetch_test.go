@@ -0,0 +1,69 @@
+package server_response_test
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+func TestCachePrefetch(t *testing.T) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2081})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	var answered atomic.Int32
+	go serveTestUpstream(upstream, 2, nil, &answered)
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen:   "127.0.0.1:2082",
+		Resolver: "127.0.0.1:2081",
+		Cache:    &mydns.CacheConfig{PrefetchPercent: 50, PrefetchHits: 2},
+	})
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen:   "127.0.0.1:2109",
+		Resolver: "127.0.0.1:2081",
+		Cache:    &mydns.CacheConfig{PrefetchPercent: 50, PrefetchHits: 2, PrefetchWindow: "500ms"},
+	})
+	time.Sleep(1 * time.Second)
+	answered.Store(0)
+
+	conn := dialServer(t, "127.0.0.1:2082")
+	defer conn.Close()
+	for i := range 2 {
+		sendMessageAndParseResponse(t, conn, buildQuery(0x0e01+uint16(i), "busy.prefetch.test", 1))
+	}
+
+	// With less than half its TTL left, the busy answer is refreshed in
+	// the background
+	time.Sleep(1100 * time.Millisecond)
+	sendMessageAndParseResponse(t, conn, buildQuery(0x0e03, "busy.prefetch.test", 1))
+	time.Sleep(100 * time.Millisecond)
+	if count := answered.Load(); count != 2 {
+		t.Errorf("Expected the answer to be prefetched, got %d upstream queries", count)
+	}
+
+	// so it is still cached after the first answer would have expired
+	time.Sleep(1100 * time.Millisecond)
+	response, _ := sendMessageAndParseResponse(t, conn, buildQuery(0x0e04, "busy.prefetch.test", 1))
+	if len(response.Answers) != 1 || answered.Load() != 2 {
+		t.Errorf("Expected a cached answer without another upstream query, got %v after %d queries", response.Answers, answered.Load())
+	}
+
+	// Hits from before the prefetch window do not make an answer busy
+	idle := dialServer(t, "127.0.0.1:2109")
+	defer idle.Close()
+	before := answered.Load()
+	for i := range 2 {
+		sendMessageAndParseResponse(t, idle, buildQuery(0x0e05+uint16(i), "idle.prefetch.test", 1))
+	}
+	time.Sleep(1100 * time.Millisecond)
+	sendMessageAndParseResponse(t, idle, buildQuery(0x0e07, "idle.prefetch.test", 1))
+	time.Sleep(100 * time.Millisecond)
+	if count := answered.Load() - before; count != 1 {
+		t.Errorf("Expected the answer not to be prefetched, got %d upstream queries", count)
+	}
+}
@@ -0,0 +1,96 @@
+package server_response_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+const qtypeTestZone = `$ORIGIN qtype.test.
+$TTL 300
+@	IN	SOA	ns1 admin 1 3600 900 604800 60
+	IN	NS	ns1
+ns1	IN	A	192.0.2.1
+host	IN	A	192.0.2.10
+host	IN	A	192.0.2.11
+multi	IN	A	192.0.2.20
+multi	IN	TXT	"text"
+`
+
+func TestQueryTypesAndClasses(t *testing.T) {
+	zoneFile := filepath.Join(t.TempDir(), "qtype.test.zone")
+	if err := os.WriteFile(zoneFile, []byte(qtypeTestZone), 0644); err != nil {
+		t.Fatalf("Failed to write zone file: %v", err)
+	}
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen: "127.0.0.1:2102",
+		Zones:  []mydns.ZoneConfig{{Name: "qtype.test", File: zoneFile}},
+	})
+	go mydns.StartDNSServerWithConfig(mydns.Config{Listen: "127.0.0.1:2103"})
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2102")
+	defer conn.Close()
+
+	// Other types of a name with only A records are NODATA with the SOA
+	for _, qtype := range []uint16{28, 15, 16} {
+		response, _ := sendMessageAndParseResponse(t, conn, buildQuery(0x1201, "host.qtype.test", qtype))
+		if rcode := response.Header.Flags & 0xF; rcode != 0 || len(response.Answers) != 0 {
+			t.Errorf("Expected NODATA for type %d, got RCODE %d with %d answers", qtype, rcode, len(response.Answers))
+		}
+		if len(response.Authorities) != 1 || response.Authorities[0].ATYPE != 6 || response.Authorities[0].ANAME != "qtype.test" {
+			t.Errorf("Expected the zone's SOA in the authority section for type %d, got %v", qtype, response.Authorities)
+			continue
+		}
+		if response.Authorities[0].TTL != 60 {
+			t.Errorf("Expected the SOA TTL to be capped at the minimum of 60, got %d", response.Authorities[0].TTL)
+		}
+	}
+
+	// ANY is answered with a single RRset of the name
+	response, _ := sendMessageAndParseResponse(t, conn, buildQuery(0x1202, "multi.qtype.test", 255))
+	if len(response.Answers) != 1 {
+		t.Errorf("Expected a single RRset of 1 record for ANY, got %v", response.Answers)
+	}
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x1203, "host.qtype.test", 255))
+	if len(response.Answers) != 2 || response.Answers[0].ATYPE != 1 || response.Answers[1].ATYPE != 1 {
+		t.Errorf("Expected the A RRset of 2 records for ANY, got %v", response.Answers)
+	}
+
+	// Classes other than IN are refused
+	response, _ = sendMessageAndParseResponse(t, conn, buildQueryWithClass(0x1204, "host.qtype.test", 1, 3))
+	if rcode := response.Header.Flags & 0xF; rcode != 5 {
+		t.Errorf("RCODE mismatch for class CH: got %d, expected 5 (REFUSED)", rcode)
+	}
+
+	placeholder := dialServer(t, "127.0.0.1:2103")
+	defer placeholder.Close()
+
+	// Without data of its own the server answers ANY with a short-lived HINFO
+	response, _ = sendMessageAndParseResponse(t, placeholder, buildQuery(0x1205, "example.com", 255))
+	if len(response.Answers) != 1 || response.Answers[0].ATYPE != 13 {
+		t.Fatalf("Expected a single HINFO answer for ANY, got %v", response.Answers)
+	}
+	if response.Answers[0].TTL != 60 {
+		t.Errorf("TTL mismatch: got %d, expected 60", response.Answers[0].TTL)
+	}
+	if string(response.Answers[0].RDATA) != "\x07RFC8482\x00" {
+		t.Errorf("Expected the HINFO CPU to be RFC8482, got %q", response.Answers[0].RDATA)
+	}
+
+	response, _ = sendMessageAndParseResponse(t, placeholder, buildQueryWithClass(0x1206, "example.com", 1, 4))
+	if rcode := response.Header.Flags & 0xF; rcode != 5 || len(response.Answers) != 0 {
+		t.Errorf("Expected REFUSED without answers for class HS, got RCODE %d with %d answers", rcode, len(response.Answers))
+	}
+}
+
+func buildQueryWithClass(id uint16, name string, qtype uint16, qclass uint16) []byte {
+	return mydns.PackDNSMessage(mydns.DNSMessage{
+		Header:    mydns.DNSHeader{ID: id},
+		Questions: []mydns.DNSQuestion{{QNAME: name, QTYPE: qtype, QCLASS: qclass}},
+	})
+}
@@ -0,0 +1,177 @@
+package server_response_test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+func TestQueryLimits(t *testing.T) {
+	// An upstream that never answers keeps forwarded queries in progress
+	blackHole, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2068})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer blackHole.Close()
+
+	concurrency, err := mydns.NewDNSServer(mydns.Config{
+		Listen:      "127.0.0.1:2069",
+		Views:       []mydns.ViewConfig{{Name: "slow", Forwarders: []string{"127.0.0.1:2068"}}},
+		QueryLimits: mydns.QueryLimitConfig{MaxInFlight: 2},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	go concurrency.Serve()
+
+	rate, err := mydns.NewDNSServer(mydns.Config{
+		Listen:      "127.0.0.1:2070",
+		QueryLimits: mydns.QueryLimitConfig{Workers: 1, QueriesPerSecond: 2, Action: "drop"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	go rate.Serve()
+
+	slowRate, err := mydns.NewDNSServer(mydns.Config{
+		Listen:      "127.0.0.1:2106",
+		QueryLimits: mydns.QueryLimitConfig{QueriesPerSecond: 0.5},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	go slowRate.Serve()
+
+	// An upstream that takes most of the interval between queries to answer
+	slowUpstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2111})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer slowUpstream.Close()
+	go answerSlowly(slowUpstream, 450*time.Millisecond)
+
+	slowAnswers, err := mydns.NewDNSServer(mydns.Config{
+		Listen:      "127.0.0.1:2112",
+		Resolver:    "127.0.0.1:2111",
+		QueryLimits: mydns.QueryLimitConfig{QueriesPerSecond: 2},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	go slowAnswers.Serve()
+	time.Sleep(1 * time.Second)
+
+	// With two queries waiting on the upstream, the third is refused
+	conn := dialServer(t, "127.0.0.1:2069")
+	defer conn.Close()
+	for i := range 2 {
+		if _, err := conn.Write(buildQuery(0x0901+uint16(i), "www.slow.test", 1)); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	response, _ := sendMessageAndParseResponse(t, conn, buildQuery(0x0903, "www.slow.test", 1))
+	if response.Header.ID != 0x0903 || response.Header.Flags&0xF != 5 {
+		t.Errorf("Expected query 0x0903 to be REFUSED, got ID %#04x with RCODE %d", response.Header.ID, response.Header.Flags&0xF)
+	}
+	stats := concurrency.QueryStats()
+	if stats.ConcurrencyLimited != 1 || stats.InFlight != 2 {
+		t.Errorf("Expected 1 query over the limit and 2 in flight, got %+v", stats)
+	}
+
+	// Queries over the rate are dropped
+	conn = dialServer(t, "127.0.0.1:2070")
+	defer conn.Close()
+	var answered int
+	for i := range 4 {
+		if _, received := queryWithTimeout(t, conn, buildQuery(0x0910+uint16(i), "codecrafters.io", 1)); received {
+			answered++
+		}
+	}
+	if answered != 2 {
+		t.Errorf("Expected 2 of 4 queries to be answered, got %d", answered)
+	}
+	if stats := rate.QueryStats(); stats.RateLimited != 2 || stats.Handled != 2 {
+		t.Errorf("Expected 2 queries handled and 2 over the rate, got %+v", stats)
+	}
+
+	// Rates below one a second still allow a query now and then
+	conn = dialServer(t, "127.0.0.1:2106")
+	defer conn.Close()
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0920, "codecrafters.io", 1))
+	if rcode := response.Header.Flags & 0xF; rcode != 0 {
+		t.Errorf("Expected the first query at half a query a second to be answered, got RCODE %d", rcode)
+	}
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0921, "codecrafters.io", 1))
+	if rcode := response.Header.Flags & 0xF; rcode != 5 {
+		t.Errorf("Expected the second query at half a query a second to be REFUSED, got RCODE %d", rcode)
+	}
+
+	// Time spent answering a query counts toward refilling the bucket, so
+	// slow queries sent at exactly the rate are all answered
+	conn = dialServer(t, "127.0.0.1:2112")
+	defer conn.Close()
+	start := time.Now()
+	for i := range 5 {
+		time.Sleep(time.Until(start.Add(time.Duration(i) * 500 * time.Millisecond)))
+		name := fmt.Sprintf("slow%d.example.test", i)
+		response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0930+uint16(i), name, 1))
+		if rcode := response.Header.Flags & 0xF; rcode == 5 {
+			t.Errorf("Expected query %d at two slow queries a second to be answered, got REFUSED", i+1)
+		}
+	}
+	if stats := slowAnswers.QueryStats(); stats.RateLimited != 0 {
+		t.Errorf("Expected no queries over the rate, got %+v", stats)
+	}
+}
+
+func TestQueryLimitsOutlastSweep(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the idle clients to be swept")
+	}
+	t.Parallel()
+
+	server, err := mydns.NewDNSServer(mydns.Config{
+		Listen:      "127.0.0.1:2114",
+		QueryLimits: mydns.QueryLimitConfig{QueriesPerSecond: 1.0 / 300},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	go server.Serve()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2114")
+	defer conn.Close()
+	response, _ := sendMessageAndParseResponse(t, conn, buildQuery(0x0940, "codecrafters.io", 1))
+	if rcode := response.Header.Flags & 0xF; rcode != 0 {
+		t.Fatalf("Expected the first query at one query every five minutes to be answered, got RCODE %d", rcode)
+	}
+
+	// A client whose bucket is still filling up is kept past the sweep of
+	// idle clients
+	time.Sleep(61 * time.Second)
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0941, "codecrafters.io", 1))
+	if rcode := response.Header.Flags & 0xF; rcode != 5 {
+		t.Errorf("Expected the query a minute later to be REFUSED, got RCODE %d", rcode)
+	}
+}
+
+// answerSlowly echoes each query back as a response after a delay.
+func answerSlowly(conn *net.UDPConn, delay time.Duration) {
+	for {
+		packet := make([]byte, 512)
+		n, source, err := conn.ReadFromUDP(packet)
+		if err != nil {
+			return
+		}
+		go func() {
+			time.Sleep(delay)
+			packet[2] |= 0x80
+			conn.WriteToUDP(packet[:n], source)
+		}()
+	}
+}
@@ -0,0 +1,82 @@
+package server_response_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+func TestQueryLog(t *testing.T) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2095})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	go serveTestUpstream(upstream, 300, nil, nil)
+
+	logFile := filepath.Join(t.TempDir(), "queries.log")
+	server, err := mydns.NewDNSServer(mydns.Config{
+		Listen:   "127.0.0.1:2096",
+		Resolver: "127.0.0.1:2095",
+		QueryLog: &mydns.QueryLogConfig{File: logFile},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	go server.Serve()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2096")
+	defer conn.Close()
+	sendMessageAndParseResponse(t, conn, buildQuery(0x1301, "www.querylog.test", 1))
+	sendMessageAndParseResponse(t, conn, buildQuery(0x1302, "www.querylog.test", 1))
+	server.Shutdown()
+
+	file, err := os.Open(logFile)
+	if err != nil {
+		t.Fatalf("Failed to open the query log: %v", err)
+	}
+	defer file.Close()
+	type entry struct {
+		Msg       string  `json:"msg"`
+		Client    string  `json:"client"`
+		Transport string  `json:"transport"`
+		Qname     string  `json:"qname"`
+		Qtype     string  `json:"qtype"`
+		Rcode     string  `json:"rcode"`
+		Answer    string  `json:"answer"`
+		View      string  `json:"view"`
+		Upstream  string  `json:"upstream"`
+		Cache     string  `json:"cache"`
+		Latency   float64 `json:"latency_ms"`
+	}
+	var entries []entry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Failed to parse %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 logged queries, got %d", len(entries))
+	}
+
+	first := entries[0]
+	if first.Msg != "query" || first.Client != conn.LocalAddr().String() || first.Transport != "udp" || first.Qname != "www.querylog.test" || first.Qtype != "A" || first.Rcode != "NOERROR" {
+		t.Errorf("Unexpected query log entry %+v", first)
+	}
+	if first.Answer != "A 192.0.2.100" || first.View != "default" || first.Upstream != "127.0.0.1:2095" || first.Cache != "miss" {
+		t.Errorf("Expected a forwarded answer, got %+v", first)
+	}
+	if second := entries[1]; second.Cache != "hit" || second.Upstream != "" {
+		t.Errorf("Expected an answer from the cache, got %+v", second)
+	}
+}
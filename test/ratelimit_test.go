@@ -0,0 +1,151 @@
+package server_response_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+const rateLimitZone = `$ORIGIN limited.test.
+$TTL 300
+@	IN	SOA	ns1 admin 1 3600 900 604800 60
+	IN	NS	ns1
+ns1	IN	A	192.0.2.1
+www	IN	A	192.0.2.30
+`
+
+func TestResponseRateLimiting(t *testing.T) {
+	zoneFile := filepath.Join(t.TempDir(), "limited.test.zone")
+	if err := os.WriteFile(zoneFile, []byte(rateLimitZone), 0644); err != nil {
+		t.Fatalf("Failed to write zone file: %v", err)
+	}
+	zones := []mydns.ZoneConfig{{Name: "limited.test", File: zoneFile}}
+	slip := 2
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen:    "127.0.0.1:2066",
+		Zones:     zones,
+		RateLimit: &mydns.RateLimitConfig{ResponsesPerSecond: 1, Slip: &slip},
+	})
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen:    "127.0.0.1:2067",
+		Zones:     zones,
+		RateLimit: &mydns.RateLimitConfig{ResponsesPerSecond: 1, LogOnly: true},
+	})
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen:    "127.0.0.1:2107",
+		Zones:     zones,
+		RateLimit: &mydns.RateLimitConfig{ResponsesPerSecond: 0.5},
+	})
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2066")
+	defer conn.Close()
+
+	// The first answer uses up the bucket, and the ones after it are
+	// dropped with every second one sent truncated
+	response, _ := sendMessageAndParseResponse(t, conn, buildQuery(0x0801, "www.limited.test", 1))
+	if len(response.Answers) != 1 {
+		t.Fatalf("Expected the first query to be answered, got %v", response.Answers)
+	}
+	var answered, truncated, dropped int
+	for i := range 6 {
+		response, received := queryWithTimeout(t, conn, buildQuery(0x0802+uint16(i), "www.limited.test", 1))
+		switch {
+		case !received:
+			dropped++
+		case response.Header.Flags&(1<<9) != 0 && len(response.Answers) == 0:
+			truncated++
+		default:
+			answered++
+		}
+	}
+	if answered != 0 || truncated != 3 || dropped != 3 {
+		t.Errorf("Expected 3 truncated and 3 dropped responses, got %d answered, %d truncated and %d dropped", answered, truncated, dropped)
+	}
+
+	// NXDOMAIN responses are counted separately
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0810, "missing.limited.test", 1))
+	if rcode := response.Header.Flags & 0xF; rcode != 3 || response.Header.Flags&(1<<9) != 0 {
+		t.Errorf("Expected a full NXDOMAIN response, got RCODE %d with flags %#04x", rcode, response.Header.Flags)
+	}
+
+	// In log-only mode every response is still sent
+	logOnly := dialServer(t, "127.0.0.1:2067")
+	defer logOnly.Close()
+	for i := range 5 {
+		response, received := queryWithTimeout(t, logOnly, buildQuery(0x0820+uint16(i), "www.limited.test", 1))
+		if !received || len(response.Answers) != 1 {
+			t.Errorf("Expected query %d to be answered in log-only mode", i+1)
+		}
+	}
+
+	// Rates below one a second still let a response through now and then
+	slow := dialServer(t, "127.0.0.1:2107")
+	defer slow.Close()
+	response, received := queryWithTimeout(t, slow, buildQuery(0x0830, "www.limited.test", 1))
+	if !received || len(response.Answers) != 1 {
+		t.Errorf("Expected the first query at half a response a second to be answered")
+	}
+	response, received = queryWithTimeout(t, slow, buildQuery(0x0831, "www.limited.test", 1))
+	if received && len(response.Answers) != 0 {
+		t.Errorf("Expected the second query at half a response a second to be limited")
+	}
+}
+
+func TestResponseRateLimitingOutlastsSweep(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the idle buckets to be swept")
+	}
+	t.Parallel()
+
+	zoneFile := filepath.Join(t.TempDir(), "limited.test.zone")
+	if err := os.WriteFile(zoneFile, []byte(rateLimitZone), 0644); err != nil {
+		t.Fatalf("Failed to write zone file: %v", err)
+	}
+	slip := 0
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen:    "127.0.0.1:2113",
+		Zones:     []mydns.ZoneConfig{{Name: "limited.test", File: zoneFile}},
+		RateLimit: &mydns.RateLimitConfig{ResponsesPerSecond: 1.0 / 300, Slip: &slip},
+	})
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2113")
+	defer conn.Close()
+	response, received := queryWithTimeout(t, conn, buildQuery(0x0840, "www.limited.test", 1))
+	if !received || len(response.Answers) != 1 {
+		t.Fatalf("Expected the first query at one response every five minutes to be answered")
+	}
+
+	// A bucket still filling up is kept past the sweep of idle buckets
+	time.Sleep(61 * time.Second)
+	if _, received := queryWithTimeout(t, conn, buildQuery(0x0841, "www.limited.test", 1)); received {
+		t.Errorf("Expected the query a minute later to still be limited")
+	}
+}
+
+// queryWithTimeout sends a query and waits briefly for a response, which
+// may not come.
+func queryWithTimeout(t *testing.T, conn *net.UDPConn, query []byte) (mydns.DNSMessage, bool) {
+	if _, err := conn.Write(query); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+
+	packet := make([]byte, 512)
+	n, err := conn.Read(packet)
+	if err != nil {
+		return mydns.DNSMessage{}, false
+	}
+	response, err := mydns.ParseDNSMessage(packet[:n])
+	if err != nil {
+		t.Fatalf("Failed to parse DNS response: %v", err)
+	}
+	return response, true
+}
@@ -0,0 +1,72 @@
+package server_response_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+const rewriteUpstreamZone = `$ORIGIN new.test.
+$TTL 300
+@	IN	SOA	ns1 admin 1 3600 900 604800 60
+	IN	NS	ns1
+ns1	IN	A	192.0.2.1
+www	IN	A	192.0.2.10
+www	IN	AAAA	2001:db8::10
+`
+
+func TestRewriteRules(t *testing.T) {
+	zoneFile := filepath.Join(t.TempDir(), "new.test.zone")
+	if err := os.WriteFile(zoneFile, []byte(rewriteUpstreamZone), 0644); err != nil {
+		t.Fatalf("Failed to write zone file: %v", err)
+	}
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen: "127.0.0.1:2060",
+		Zones:  []mydns.ZoneConfig{{Name: "new.test", File: zoneFile}},
+	})
+	time.Sleep(1 * time.Second)
+
+	ttl := uint32(42)
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen:   "127.0.0.1:2061",
+		Resolver: "127.0.0.1:2060",
+		Rewrites: []mydns.RewriteConfig{
+			{Match: "*.old.test", Rename: "*.new.test", TTL: &ttl},
+			{Match: "*", Types: []string{"AAAA"}, Strip: []string{"AAAA"}},
+			{Match: "gone.test", Rcode: "NXDOMAIN"},
+		},
+	})
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2061")
+	defer conn.Close()
+
+	// The query is forwarded for the new name and answered under the old one
+	response, _ := sendMessageAndParseResponse(t, conn, buildQuery(0x0501, "WWW.old.test", 1))
+	if len(response.Questions) != 1 || response.Questions[0].QNAME != "WWW.old.test" {
+		t.Errorf("Expected the question to be WWW.old.test, got %v", response.Questions)
+	}
+	if len(response.Answers) != 1 || net.IP(response.Answers[0].RDATA).String() != "192.0.2.10" {
+		t.Fatalf("Expected an answer of 192.0.2.10, got %v", response.Answers)
+	}
+	if response.Answers[0].ANAME != "WWW.old.test" || response.Answers[0].TTL != 42 {
+		t.Errorf("Expected WWW.old.test with TTL 42, got %s with TTL %d", response.Answers[0].ANAME, response.Answers[0].TTL)
+	}
+
+	// AAAA records are stripped from every answer
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0502, "www.new.test", 28))
+	if rcode := response.Header.Flags & 0xF; rcode != 0 || len(response.Answers) != 0 {
+		t.Errorf("Expected NODATA for the stripped AAAA query, got RCODE %d with %d answers", rcode, len(response.Answers))
+	}
+
+	// Rules with an RCODE answer without forwarding
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0503, "gone.test", 1))
+	if rcode := response.Header.Flags & 0xF; rcode != 3 {
+		t.Errorf("RCODE mismatch: got %d, expected 3 (NXDOMAIN)", rcode)
+	}
+}
@@ -0,0 +1,146 @@
+package server_response_test
+
+import (
+	"encoding/base64"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+const rpzUpstreamZone = `$ORIGIN upstream.test.
+$TTL 300
+@		IN	SOA	ns1 admin 1 3600 900 604800 60
+		IN	NS	ns1
+ns1		IN	A	192.0.2.1
+www		IN	A	192.0.2.10
+ads		IN	A	192.0.2.20
+walled		IN	A	192.0.2.30
+bad		IN	A	198.51.100.7
+drop		IN	A	192.0.2.40
+tcp		IN	A	192.0.2.50
+allowed		IN	A	192.0.2.60
+x.wild		IN	A	192.0.2.70
+`
+
+const rpzOtherZone = `$ORIGIN other.test.
+$TTL 300
+@		IN	SOA	ns admin 1 3600 900 604800 60
+		IN	NS	ns
+ns		IN	A	203.0.113.53
+host		IN	A	203.0.113.80
+`
+
+// The first policy zone is served by the upstream and transferred with TSIG
+const rpzTransferredZone = `$ORIGIN policy.test.
+$TTL 300
+@			IN	SOA	localhost. admin 1 3600 900 604800 60
+			IN	NS	localhost.
+ads.upstream.test	IN	CNAME	.
+*.wild.upstream.test	IN	CNAME	*.
+walled.upstream.test	IN	A	192.0.2.254
+32.7.100.51.198.rpz-ip	IN	CNAME	.
+drop.upstream.test	IN	CNAME	rpz-drop.
+tcp.upstream.test	IN	CNAME	rpz-tcp-only.
+allowed.upstream.test	IN	CNAME	rpz-passthru.
+`
+
+const rpzFileZone = `$ORIGIN local.rpz.
+$TTL 300
+@				IN	SOA	localhost. admin 1 3600 900 604800 60
+				IN	NS	localhost.
+allowed.upstream.test		IN	CNAME	.
+bad.upstream.test		IN	A	192.0.2.253
+ns.other.test.rpz-nsdname	IN	CNAME	*.
+`
+
+func TestResponsePolicyZones(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"upstream.test": rpzUpstreamZone, "other.test": rpzOtherZone, "policy.test": rpzTransferredZone, "local.rpz": rpzFileZone}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("Failed to write zone file: %v", err)
+		}
+	}
+	key := mydns.KeyConfig{Name: "rpz-key", Algorithm: "hmac-sha256", Secret: base64.StdEncoding.EncodeToString(tsigTestSecret)}
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen: "127.0.0.1:2058",
+		Keys:   []mydns.KeyConfig{key},
+		Zones: []mydns.ZoneConfig{
+			{Name: "upstream.test", File: filepath.Join(dir, "upstream.test")},
+			{Name: "other.test", File: filepath.Join(dir, "other.test")},
+			{Name: "policy.test", File: filepath.Join(dir, "policy.test"), AllowTransfer: []string{"key:rpz-key"}},
+		},
+	})
+	time.Sleep(1 * time.Second)
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen:   "127.0.0.1:2059",
+		Resolver: "127.0.0.1:2058",
+		Keys:     []mydns.KeyConfig{key},
+		RPZ: []mydns.RPZConfig{
+			{Name: "policy.test", Primary: "127.0.0.1:2058", Key: "rpz-key"},
+			{Name: "local.rpz", File: filepath.Join(dir, "local.rpz")},
+		},
+	})
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2059")
+	defer conn.Close()
+
+	// Names without a policy are forwarded as usual
+	response, _ := sendMessageAndParseResponse(t, conn, buildQuery(0x0401, "www.upstream.test", 1))
+	if len(response.Answers) != 1 || net.IP(response.Answers[0].RDATA).String() != "192.0.2.10" {
+		t.Errorf("Expected the upstream answer for www.upstream.test, got %v", response.Answers)
+	}
+
+	expectRcode := func(id uint16, name string, rcode uint16, answers int) {
+		t.Helper()
+		response, _ := sendMessageAndParseResponse(t, conn, buildQuery(id, name, 1))
+		if got := response.Header.Flags & 0xF; got != rcode || len(response.Answers) != answers {
+			t.Errorf("%s: got RCODE %d with %d answers, expected RCODE %d with %d answers", name, got, len(response.Answers), rcode, answers)
+		}
+	}
+	expectRcode(0x0402, "ads.upstream.test", 3, 0)    // QNAME trigger, NXDOMAIN
+	expectRcode(0x0403, "x.wild.upstream.test", 0, 0) // wildcard QNAME trigger, NODATA
+	expectRcode(0x0404, "bad.upstream.test", 3, 0)    // IP trigger on the answer, ahead of the QNAME trigger in local.rpz
+	expectRcode(0x0405, "host.other.test", 0, 0)      // NSDNAME trigger
+	expectRcode(0x0406, "allowed.upstream.test", 0, 1)
+
+	// Blocked answers carry the policy zone's SOA so they can be cached
+	for _, name := range []string{"ads.upstream.test", "x.wild.upstream.test"} {
+		response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x040b, name, 1))
+		if len(response.Authorities) != 1 || response.Authorities[0].ATYPE != 6 || response.Authorities[0].ANAME != "policy.test" {
+			t.Errorf("Expected the SOA of policy.test in the authority section for %s, got %v", name, response.Authorities)
+		}
+	}
+
+	// Local data replaces the upstream answer
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0407, "walled.upstream.test", 1))
+	if len(response.Answers) != 1 || net.IP(response.Answers[0].RDATA).String() != "192.0.2.254" {
+		t.Errorf("Expected local data of 192.0.2.254, got %v", response.Answers)
+	}
+
+	// TCP-only truncates over UDP and answers over TCP
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0408, "tcp.upstream.test", 1))
+	if response.Header.Flags&(1<<9) == 0 || len(response.Answers) != 0 {
+		t.Errorf("Expected an empty truncated response over UDP, got flags %016b with %d answers", response.Header.Flags, len(response.Answers))
+	}
+	tcpResponses := sendTCPMessage(t, "127.0.0.1:2059", buildQuery(0x0409, "tcp.upstream.test", 1))
+	if tcpResponse, err := mydns.ParseDNSMessage(tcpResponses[0]); err != nil || len(tcpResponse.Answers) != 1 {
+		t.Errorf("Expected the upstream answer over TCP, got %v (%v)", tcpResponse.Answers, err)
+	}
+
+	// Dropped queries get no response at all
+	if _, err := conn.Write(buildQuery(0x040a, "drop.upstream.test", 1)); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 512)); err == nil {
+		t.Errorf("Expected no response for a dropped query, got %d bytes", n)
+	}
+}
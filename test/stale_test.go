@@ -0,0 +1,85 @@
+package server_response_test
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+func TestServeStale(t *testing.T) {
+	// An upstream answering with a 1 second TTL until it is told to be quiet
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2079})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	var quiet atomic.Bool
+	go serveTestUpstream(upstream, 1, &quiet, nil)
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen:   "127.0.0.1:2080",
+		Resolver: "127.0.0.1:2079",
+		Cache:    &mydns.CacheConfig{StaleWindow: "1m", StaleClientTimeout: "300ms"},
+	})
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2080")
+	defer conn.Close()
+	response, _ := sendMessageAndParseResponse(t, conn, buildQuery(0x0d01, "www.stale.test", 1))
+	if len(response.Answers) != 1 || response.Answers[0].TTL != 1 {
+		t.Fatalf("Expected an answer with TTL 1, got %v", response.Answers)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	// With the upstream quiet, the expired answer is served once the client
+	// timer runs out
+	quiet.Store(true)
+	start := time.Now()
+	response, _ = sendMessageAndParseResponse(t, conn, withCookie(buildQuery(0x0d02, "www.stale.test", 1), testClientCookie))
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the stale answer after the client timeout, took %v", elapsed)
+	}
+	if len(response.Answers) != 1 || net.IP(response.Answers[0].RDATA).String() != "192.0.2.100" || response.Answers[0].TTL != 30 {
+		t.Fatalf("Expected the stale answer with TTL 30, got %v", response.Answers)
+	}
+	if ede := findOption(response, 15); len(ede) < 2 || binary.BigEndian.Uint16(ede) != 3 {
+		t.Errorf("Expected the Stale Answer EDE, got %q", ede)
+	}
+
+	// Once the upstream is unreachable it is served straight away
+	upstream.Close()
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0d03, "www.stale.test", 1))
+	if len(response.Answers) != 1 || response.Answers[0].TTL != 30 {
+		t.Errorf("Expected the stale answer with TTL 30, got %v", response.Answers)
+	}
+}
+
+// serveTestUpstream answers every A query with 192.0.2.100 and the given
+// TTL, unless told to be quiet, counting the queries it answers.
+func serveTestUpstream(conn *net.UDPConn, ttl uint32, quiet *atomic.Bool, answered *atomic.Int32) {
+	packet := make([]byte, 4096)
+	for {
+		n, source, err := conn.ReadFromUDP(packet)
+		if err != nil {
+			return
+		}
+		query, err := mydns.ParseDNSMessage(packet[:n])
+		if err != nil || (quiet != nil && quiet.Load()) {
+			continue
+		}
+		if answered != nil {
+			answered.Add(1)
+		}
+		conn.WriteToUDP(mydns.PackDNSMessage(mydns.DNSMessage{
+			Header:    mydns.DNSHeader{ID: query.Header.ID, Flags: 1<<15 | 1<<8 | 1<<7},
+			Questions: query.Questions,
+			Answers: []mydns.DNSAnswer{{
+				ANAME: query.Questions[0].QNAME, ATYPE: 1, ACLASS: 1, TTL: ttl, RDATA: net.ParseIP("192.0.2.100").To4(),
+			}},
+		}), source)
+	}
+}
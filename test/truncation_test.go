@@ -0,0 +1,80 @@
+package server_response_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+func TestTruncation(t *testing.T) {
+	// An RRset of about 2500 bytes, too large for any UDP response
+	var zone strings.Builder
+	zone.WriteString("$ORIGIN large.test.\n$TTL 300\n@\tIN\tSOA\tns1 admin 1 3600 900 604800 60\n\tIN\tNS\tns1\nns1\tIN\tA\t192.0.2.1\n")
+	for i := range 40 {
+		fmt.Fprintf(&zone, "big\tIN\tTXT\t\"%02d%s\"\n", i, strings.Repeat("x", 48))
+	}
+	zoneFile := filepath.Join(t.TempDir(), "large.test.zone")
+	if err := os.WriteFile(zoneFile, []byte(zone.String()), 0644); err != nil {
+		t.Fatalf("Failed to write zone file: %v", err)
+	}
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen: "127.0.0.1:2108",
+		Zones:  []mydns.ZoneConfig{{Name: "large.test", File: zoneFile}},
+	})
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2108")
+	defer conn.Close()
+
+	// Clients without EDNS get at most 512 bytes
+	response, packet := sendMessageAndParseResponse(t, conn, buildQuery(0x1401, "big.large.test", 16))
+	if len(packet) > 512 || response.Header.Flags&(1<<9) == 0 {
+		t.Errorf("Expected a truncated response of at most 512 bytes, got %d bytes with flags %016b", len(packet), response.Header.Flags)
+	}
+	if len(response.Questions) != 1 || len(response.Answers) != 0 {
+		t.Errorf("Expected only the question in the truncated response, got %d questions and %d answers", len(response.Questions), len(response.Answers))
+	}
+
+	// EDNS clients get up to the size they advertise, capped at 1232 bytes
+	for _, size := range []uint16{1024, 4096} {
+		query, _ := mydns.ParseDNSMessage(buildQuery(0x1402, "big.large.test", 16))
+		query.Additionals = []mydns.DNSAnswer{{ATYPE: 41, ACLASS: size}}
+		if _, err := conn.Write(mydns.PackDNSMessage(query)); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		response, err := mydns.ParseDNSMessage(buf[:n])
+		if err != nil {
+			t.Fatalf("Failed to parse DNS response: %v", err)
+		}
+		if n > min(int(size), 1232) || response.Header.Flags&(1<<9) == 0 {
+			t.Errorf("Expected a truncated response of at most %d bytes, got %d bytes with flags %016b", min(int(size), 1232), n, response.Header.Flags)
+		}
+		if len(response.Additionals) != 1 || response.Additionals[0].ATYPE != 41 {
+			t.Errorf("Expected the OPT record to be kept in the truncated response, got %v", response.Additionals)
+		}
+	}
+
+	// TCP responses are sent whole
+	responses := sendTCPMessage(t, "127.0.0.1:2108", buildQuery(0x1403, "big.large.test", 16))
+	tcpResponse, err := mydns.ParseDNSMessage(responses[0])
+	if err != nil || len(tcpResponse.Answers) != 40 || tcpResponse.Header.Flags&(1<<9) != 0 {
+		t.Errorf("Expected all 40 records over TCP without TC, got %d (%v)", len(tcpResponse.Answers), err)
+	}
+
+	// Responses that fit are left alone
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x1404, "ns1.large.test", 1))
+	if response.Header.Flags&(1<<9) != 0 || len(response.Answers) != 1 {
+		t.Errorf("Expected a whole answer for ns1.large.test, got flags %016b with %d answers", response.Header.Flags, len(response.Answers))
+	}
+}
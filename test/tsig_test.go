@@ -0,0 +1,206 @@
+package server_response_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+const tsigTestZone = `$ORIGIN tsig.test.
+$TTL 300
+@	IN	SOA	ns1 admin 1 3600 900 604800 60
+	IN	NS	ns1
+ns1	IN	A	192.0.2.1
+www	IN	A	192.0.2.2
+`
+
+var tsigTestSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func TestTSIGZoneTransfer(t *testing.T) {
+	zoneFile := filepath.Join(t.TempDir(), "tsig.test.zone")
+	if err := os.WriteFile(zoneFile, []byte(tsigTestZone), 0644); err != nil {
+		t.Fatalf("Failed to write zone file: %v", err)
+	}
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen: "127.0.0.1:2055",
+		Keys: []mydns.KeyConfig{
+			{Name: "transfer-key", Algorithm: "hmac-sha256", Secret: base64.StdEncoding.EncodeToString(tsigTestSecret)},
+		},
+		Zones: []mydns.ZoneConfig{
+			{Name: "tsig.test", File: zoneFile, AllowTransfer: []string{"key:transfer-key"}},
+		},
+	})
+	time.Sleep(1 * time.Second)
+
+	axfr := buildQuery(0x0101, "tsig.test", 252)
+
+	// Unsigned transfers are refused
+	responses := sendTCPMessage(t, "127.0.0.1:2055", axfr)
+	if rcode := binary.BigEndian.Uint16(responses[0][2:]) & 0xF; rcode != 5 {
+		t.Errorf("RCODE mismatch: got %d, expected 5 (REFUSED)", rcode)
+	}
+
+	// Signed transfers arrive as a chain of signed messages
+	signed, requestMAC := signQuery(axfr, "transfer-key", tsigTestSecret, time.Now())
+	responses = sendTCPMessage(t, "127.0.0.1:2055", signed)
+	var answers []mydns.DNSAnswer
+	for _, packet := range responses {
+		message, err := mydns.ParseDNSMessage(packet)
+		if err != nil {
+			t.Fatalf("Failed to parse transfer message: %v", err)
+		}
+		if len(message.Additionals) != 1 || message.Additionals[0].ATYPE != 250 {
+			t.Fatalf("Expected every transfer message to be signed")
+		}
+		answers = append(answers, message.Answers...)
+	}
+	if len(answers) != 5 || answers[0].ATYPE != 6 || answers[len(answers)-1].ATYPE != 6 {
+		t.Errorf("Expected the transfer to contain 5 records between two SOAs, got %d", len(answers))
+	}
+	verifyFirstResponseMAC(t, responses[0], requestMAC)
+
+	// Requests signed with unknown keys get NOTAUTH with BADKEY
+	signed, _ = signQuery(axfr, "unknown-key", tsigTestSecret, time.Now())
+	responses = sendTCPMessage(t, "127.0.0.1:2055", signed)
+	checkTSIGError(t, responses[0], 17)
+
+	// Requests signed too long ago get NOTAUTH with BADTIME
+	signed, _ = signQuery(axfr, "transfer-key", tsigTestSecret, time.Now().Add(-time.Hour))
+	responses = sendTCPMessage(t, "127.0.0.1:2055", signed)
+	checkTSIGError(t, responses[0], 18)
+}
+
+// sendTCPMessage sends a message over TCP and reads responses until the
+// server stops sending them.
+func sendTCPMessage(t *testing.T, address string, message []byte) [][]byte {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(message)))
+	if _, err := conn.Write(append(framed, message...)); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	var responses [][]byte
+	for {
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			break
+		}
+		response := make([]byte, length)
+		if _, err := io.ReadFull(conn, response); err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		responses = append(responses, response)
+	}
+	if len(responses) == 0 {
+		t.Fatalf("No response received from server")
+	}
+	return responses
+}
+
+func tsigVariables(keyName string, timeSigned time.Time, tsigError uint16) []byte {
+	variables := new(bytes.Buffer)
+	variables.Write(encodeTestName(keyName))
+	binary.Write(variables, binary.BigEndian, uint16(255)) // Class: ANY
+	binary.Write(variables, binary.BigEndian, uint32(0))   // TTL
+	variables.Write(encodeTestName("hmac-sha256"))
+	variables.Write(tsigTimers(timeSigned))
+	binary.Write(variables, binary.BigEndian, tsigError)
+	binary.Write(variables, binary.BigEndian, uint16(0)) // Other Len
+	return variables.Bytes()
+}
+
+func tsigTimers(timeSigned time.Time) []byte {
+	timers := make([]byte, 8)
+	binary.BigEndian.PutUint16(timers, uint16(timeSigned.Unix()>>32))
+	binary.BigEndian.PutUint32(timers[2:], uint32(timeSigned.Unix()))
+	binary.BigEndian.PutUint16(timers[6:], 300) // Fudge
+	return timers
+}
+
+func signQuery(query []byte, keyName string, secret []byte, timeSigned time.Time) ([]byte, []byte) {
+	h := hmac.New(sha256.New, secret)
+	h.Write(query)
+	h.Write(tsigVariables(keyName, timeSigned, 0))
+	mac := h.Sum(nil)
+
+	rdata := new(bytes.Buffer)
+	rdata.Write(encodeTestName("hmac-sha256"))
+	rdata.Write(tsigTimers(timeSigned))
+	binary.Write(rdata, binary.BigEndian, uint16(len(mac)))
+	rdata.Write(mac)
+	rdata.Write(query[:2])                                // Original ID
+	binary.Write(rdata, binary.BigEndian, []uint16{0, 0}) // Error, Other Len
+
+	message, _ := mydns.ParseDNSMessage(query)
+	message.Additionals = append(message.Additionals, mydns.DNSAnswer{
+		ANAME: keyName, ATYPE: 250, ACLASS: 255, RDATA: rdata.Bytes(),
+	})
+	return mydns.PackDNSMessage(message), mac
+}
+
+// verifyFirstResponseMAC checks the MAC of a response covers the request MAC,
+// the response without its TSIG record, and the TSIG variables.
+func verifyFirstResponseMAC(t *testing.T, response []byte, requestMAC []byte) {
+	message, _ := mydns.ParseDNSMessage(response)
+	tsig := message.Additionals[0].RDATA
+	algorithmLength := len(encodeTestName("hmac-sha256"))
+	timeSigned := int64(binary.BigEndian.Uint16(tsig[algorithmLength:]))<<32 | int64(binary.BigEndian.Uint32(tsig[algorithmLength+2:]))
+	macSize := int(binary.BigEndian.Uint16(tsig[algorithmLength+8:]))
+	mac := tsig[algorithmLength+10 : algorithmLength+10+macSize]
+
+	message.Additionals = nil
+	h := hmac.New(sha256.New, tsigTestSecret)
+	binary.Write(h, binary.BigEndian, uint16(len(requestMAC)))
+	h.Write(requestMAC)
+	h.Write(mydns.PackDNSMessage(message))
+	h.Write(tsigVariables("transfer-key", time.Unix(timeSigned, 0), 0))
+	if !hmac.Equal(mac, h.Sum(nil)) {
+		t.Errorf("Response MAC does not verify")
+	}
+}
+
+func checkTSIGError(t *testing.T, response []byte, expected uint16) {
+	message, err := mydns.ParseDNSMessage(response)
+	if err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if rcode := message.Header.Flags & 0xF; rcode != 9 {
+		t.Errorf("RCODE mismatch: got %d, expected 9 (NOTAUTH)", rcode)
+	}
+	if len(message.Additionals) != 1 || message.Additionals[0].ATYPE != 250 {
+		t.Fatalf("Expected a TSIG record in the response")
+	}
+	tsig := message.Additionals[0].RDATA
+	macSize := int(binary.BigEndian.Uint16(tsig[len(encodeTestName("hmac-sha256"))+8:]))
+	errorOffset := len(encodeTestName("hmac-sha256")) + 10 + macSize + 2
+	if tsigError := binary.BigEndian.Uint16(tsig[errorOffset:]); tsigError != expected {
+		t.Errorf("TSIG error mismatch: got %d, expected %d", tsigError, expected)
+	}
+}
+
+func encodeTestName(name string) []byte {
+	encoded := new(bytes.Buffer)
+	for _, label := range bytes.Split([]byte(name), []byte(".")) {
+		encoded.WriteByte(byte(len(label)))
+		encoded.Write(label)
+	}
+	encoded.WriteByte(0)
+	return encoded.Bytes()
+}
@@ -0,0 +1,98 @@
+package server_response_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+const viewTestZone = `$ORIGIN horizon.test.
+$TTL 300
+@	IN	SOA	ns1 admin 1 3600 900 604800 60
+	IN	NS	ns1
+ns1	IN	A	192.0.2.1
+www	IN	A	%s
+`
+
+const viewUpstreamZone = `$ORIGIN cached.test.
+$TTL 300
+@	IN	SOA	ns1 admin 1 3600 900 604800 60
+	IN	NS	ns1
+ns1	IN	A	192.0.2.1
+www	IN	A	192.0.2.80
+`
+
+func TestSplitHorizonViews(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"internal": fmt.Sprintf(viewTestZone, "10.0.0.10"),
+		"public":   fmt.Sprintf(viewTestZone, "192.0.2.10"),
+		"upstream": viewUpstreamZone,
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("Failed to write zone file: %v", err)
+		}
+	}
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen: "127.0.0.1:2062",
+		Zones:  []mydns.ZoneConfig{{Name: "cached.test", File: filepath.Join(dir, "upstream")}},
+	})
+	time.Sleep(1 * time.Second)
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen:   "127.0.0.1:2063",
+		Resolver: "127.0.0.1:2062",
+		Keys:     []mydns.KeyConfig{{Name: "view-key", Secret: base64.StdEncoding.EncodeToString(tsigTestSecret)}},
+		Zones:    []mydns.ZoneConfig{{Name: "horizon.test", File: filepath.Join(dir, "public")}},
+		Views: []mydns.ViewConfig{
+			{Name: "remote", MatchClients: []string{"198.51.100.0/24"}},
+			{Name: "partners", MatchClients: []string{"key:view-key"}, Zones: []mydns.ZoneConfig{{Name: "horizon.test", File: filepath.Join(dir, "internal")}}},
+		},
+	})
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2063")
+	defer conn.Close()
+
+	// Clients matching no view get the zones at the top level
+	response, _ := sendMessageAndParseResponse(t, conn, buildQuery(0x0601, "www.horizon.test", 1))
+	if len(response.Answers) != 1 || net.IP(response.Answers[0].RDATA).String() != "192.0.2.10" {
+		t.Errorf("Expected the public address 192.0.2.10, got %v", response.Answers)
+	}
+
+	// Requests signed with the view's key see its own copy of the zone
+	signed, _ := signQuery(buildQuery(0x0602, "www.horizon.test", 1), "view-key", tsigTestSecret, time.Now())
+	response, _ = sendMessageAndParseResponse(t, conn, signed)
+	if len(response.Answers) != 1 || net.IP(response.Answers[0].RDATA).String() != "10.0.0.10" {
+		t.Errorf("Expected the internal address 10.0.0.10, got %v", response.Answers)
+	}
+
+	// The partners view has no forwarders, so it refuses names it has no data for
+	signed, _ = signQuery(buildQuery(0x0603, "www.cached.test", 1), "view-key", tsigTestSecret, time.Now())
+	response, _ = sendMessageAndParseResponse(t, conn, signed)
+	if rcode := response.Header.Flags & 0xF; rcode != 5 {
+		t.Errorf("RCODE mismatch: got %d, expected 5 (REFUSED)", rcode)
+	}
+
+	// Forwarded answers are cached, with their TTLs counting down
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0604, "www.cached.test", 1))
+	if len(response.Answers) != 1 || response.Answers[0].TTL != 300 {
+		t.Fatalf("Expected an answer with TTL 300, got %v", response.Answers)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0605, "WWW.cached.test", 1))
+	if response.Header.ID != 0x0605 || response.Questions[0].QNAME != "WWW.cached.test" {
+		t.Errorf("Expected the cached answer to match the query, got ID %#04x for %v", response.Header.ID, response.Questions)
+	}
+	if len(response.Answers) != 1 || response.Answers[0].TTL >= 300 {
+		t.Errorf("Expected a cached answer with a TTL below 300, got %v", response.Answers)
+	}
+}
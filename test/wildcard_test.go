@@ -0,0 +1,74 @@
+package server_response_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/mydns"
+)
+
+const wildcardTestZone = `$ORIGIN wildcard.test.
+$TTL 300
+@		IN	SOA	ns1 admin 1 3600 900 604800 60
+		IN	NS	ns1
+ns1		IN	A	192.0.2.1
+*.apps		IN	A	192.0.2.80
+api.apps	IN	TXT	"exists"
+host.ent	IN	A	192.0.2.2
+*		IN	A	192.0.2.99
+`
+
+func TestWildcardMatching(t *testing.T) {
+	zoneFile := filepath.Join(t.TempDir(), "wildcard.test.zone")
+	if err := os.WriteFile(zoneFile, []byte(wildcardTestZone), 0644); err != nil {
+		t.Fatalf("Failed to write zone file: %v", err)
+	}
+
+	go mydns.StartDNSServerWithConfig(mydns.Config{
+		Listen: "127.0.0.1:2056",
+		Zones:  []mydns.ZoneConfig{{Name: "wildcard.test", File: zoneFile}},
+	})
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, "127.0.0.1:2056")
+	defer conn.Close()
+
+	// Non-existent names below apps are synthesized with the query name as owner
+	response, packet := sendMessageAndParseResponse(t, conn, buildQuery(0x0201, "Web.Apps.wildcard.test", 1))
+	if len(response.Answers) != 1 || net.IP(response.Answers[0].RDATA).String() != "192.0.2.80" {
+		t.Fatalf("Expected a synthesized answer of 192.0.2.80, got %v", response.Answers)
+	}
+	if response.Answers[0].ANAME != "Web.Apps.wildcard.test" {
+		t.Errorf("ANAME mismatch: got %s, expected Web.Apps.wildcard.test", response.Answers[0].ANAME)
+	}
+	answerOffset := 12 + len("Web.Apps.wildcard.test") + 2 + 4
+	if packet[answerOffset] != 0xc0 || packet[answerOffset+1] != 0x0c {
+		t.Errorf("Expected the synthesized owner to be compressed to the question name")
+	}
+
+	// Existing names are not matched by the wildcard
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0202, "api.apps.wildcard.test", 1))
+	if rcode := response.Header.Flags & 0xF; rcode != 0 || len(response.Answers) != 0 {
+		t.Errorf("Expected NODATA for api.apps.wildcard.test, got RCODE %d with %d answers", rcode, len(response.Answers))
+	}
+
+	// The closest encloser of a name below an empty non-terminal is the
+	// empty non-terminal, so the wildcard at the apex does not apply
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0203, "missing.ent.wildcard.test", 1))
+	if rcode := response.Header.Flags & 0xF; rcode != 3 {
+		t.Errorf("RCODE mismatch: got %d, expected 3 (NXDOMAIN)", rcode)
+	}
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0204, "ent.wildcard.test", 1))
+	if rcode := response.Header.Flags & 0xF; rcode != 0 || len(response.Answers) != 0 {
+		t.Errorf("Expected NODATA for the empty non-terminal, got RCODE %d with %d answers", rcode, len(response.Answers))
+	}
+
+	// Other names fall back to the wildcard at the apex
+	response, _ = sendMessageAndParseResponse(t, conn, buildQuery(0x0205, "other.wildcard.test", 1))
+	if len(response.Answers) != 1 || net.IP(response.Answers[0].RDATA).String() != "192.0.2.99" {
+		t.Errorf("Expected a synthesized answer of 192.0.2.99, got %v", response.Answers)
+	}
+}